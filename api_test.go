@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"busapp/config"
+	"busapp/db"
+	"busapp/handlers"
+	"busapp/metrics"
+	"busapp/middleware"
+	"busapp/migrations"
+	"busapp/models"
+	"busapp/search"
+	"busapp/seed"
+	"busapp/spatial"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var testDBs atomic.Int64
+
+// newTestDB opens a migrated, seeded in-memory SQLite database of its own
+func newTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	// a named shared-cache database lives as long as its connections
+	dsn := fmt.Sprintf("file:test%d?mode=memory&cache=shared", testDBs.Add(1))
+	gdb, err := db.InitDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1) // no "table is locked" between connections
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if _, err := migrations.Up(gdb, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Seed(gdb); err != nil {
+		t.Fatal(err)
+	}
+	if err := search.Setup(gdb); err != nil {
+		t.Fatal(err)
+	}
+	if err := spatial.Setup(gdb); err != nil {
+		t.Fatal(err)
+	}
+	return gdb
+}
+
+// testAPI is the full router on a test database
+type testAPI struct {
+	router *gin.Engine
+	token  string // of the seeded platform admin
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	config.Set(config.Default())
+	api := &testAPI{router: newRouter(newTestDB(t), config.Default())}
+	api.token = api.login(t, "admin", "admin123")
+	return api
+}
+
+// request is a call to the API; body is JSON unless it is a *multipartBody
+type request struct {
+	method, url string
+	body        interface{}
+	token       string
+	header      map[string]string
+}
+
+// multipartBody is an upload in the "file" field
+type multipartBody struct {
+	filename, content string
+}
+
+func (a *testAPI) do(t *testing.T, req request) *httptest.ResponseRecorder {
+	t.Helper()
+	var body io.Reader
+	contentType := ""
+	switch b := req.body.(type) {
+	case nil:
+	case *multipartBody:
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("file", b.filename)
+		fw.Write([]byte(b.content))
+		mw.Close()
+		body, contentType = &buf, mw.FormDataContentType()
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, contentType = bytes.NewReader(raw), "application/json"
+	}
+
+	r := httptest.NewRequest(req.method, req.url, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if req.token != "" {
+		r.Header.Set("Authorization", "Bearer "+req.token)
+	}
+	for k, v := range req.header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	return w
+}
+
+func (a *testAPI) login(t *testing.T, username, password string) string {
+	t.Helper()
+	w := a.do(t, request{method: http.MethodPost, url: "/api/v1/auth/login",
+		body: map[string]string{"username": username, "password": password}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login as %s: %d %s", username, w.Code, w.Body)
+	}
+	var resp struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Token
+}
+
+// jsonField reads a top-level (or dotted) field of a JSON object response
+func jsonField(t *testing.T, w *httptest.ResponseRecorder, path string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("response is not JSON: %s", w.Body)
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.Fatalf("no %s in %s", path, w.Body)
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// apiCase is one call of TestEndpoints
+type apiCase struct {
+	route string // "METHOD /path" as registered under /api/v1
+	url   func() string
+	body  interface{}
+	auth  string // token to send (see TestEndpoints)
+	want  int
+	// contains, when set, must appear in the response body
+	contains string
+	// after runs on the response, e.g. to remember a created ID
+	after func(t *testing.T, w *httptest.ResponseRecorder)
+}
+
+// path returns a fixed URL
+func path(url string) func() string { return func() string { return url } }
+
+// TestEndpoints calls every endpoint in turn on one seeded database (agency
+// 1 with route 1: stops 1-4, schedules 1-2; admin 1 "admin"), as a platform
+// admin unless stated otherwise, then checks that no endpoint was left out
+func TestEndpoints(t *testing.T) {
+	api := newTestAPI(t)
+	const admin = "admin"
+	var agencyToken, apiKey string
+	var apiKeyID, auditID, draftID float64
+
+	csvImport := "route_name,stop_name,stop_lat,stop_lon,stop_order,departure,frequency_min\n" +
+		"Imported,North,6.60,3.35,1,05:00,20\n" +
+		"Imported,South,6.50,3.37,2,,\n"
+
+	cases := []apiCase{
+		// auth
+		{route: "POST /auth/login", url: path("/auth/login"), body: map[string]string{"username": "admin", "password": "wrong"}, want: 401},
+		{route: "POST /auth/login", url: path("/auth/login"), body: map[string]string{"username": "admin", "password": "admin123"}, want: 200, contains: "token"},
+		{route: "POST /auth/register", url: path("/auth/register"), body: map[string]interface{}{"username": "intruder", "password": "x", "agency_id": 0}, want: 401},
+		{route: "POST /auth/register", url: path("/auth/register"), auth: admin, body: map[string]interface{}{"username": "ops", "password": "ops-pass", "agency_id": 1}, want: 201},
+		{route: "POST /auth/register", url: path("/auth/register"), auth: admin, body: map[string]interface{}{"username": "ops", "password": "again"}, want: 409},
+		{route: "POST /auth/login", url: path("/auth/login"), body: map[string]string{"username": "ops", "password": "ops-pass"}, want: 200,
+			after: func(t *testing.T, w *httptest.ResponseRecorder) { agencyToken = jsonField(t, w, "token").(string) }},
+		{route: "POST /auth/register", url: path("/auth/register"), auth: "agency", body: map[string]interface{}{"username": "ops2", "password": "x", "agency_id": 2}, want: 403},
+		{route: "POST /auth/register", url: path("/auth/register"), auth: "agency", body: map[string]interface{}{"username": "root2", "password": "x", "agency_id": 0}, want: 403},
+
+		// public
+		{route: "GET /public/agencies", url: path("/public/agencies"), want: 200, contains: "Lagos Bus Services"},
+		{route: "GET /public/routes", url: path("/public/routes?q=yaba"), want: 200, contains: "Yaba–Ikeja"},
+		{route: "GET /public/routes", url: path("/public/routes?q=%25&stop=_"), want: 200, // wildcards match literally
+			after: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+					t.Errorf("got %s, want no routes", body)
+				}
+			}},
+		{route: "GET /public/routes/:id", url: path("/public/routes/1"), want: 200, contains: "Ojuelegba"},
+		{route: "GET /public/routes/:id", url: path("/public/routes/999"), want: 404},
+		{route: "GET /public/routes/:id", url: path("/public/routes/abc"), want: 400},
+		{route: "GET /public/next-bus/:id", url: path("/public/next-bus/1"), want: 200, contains: `"buses"`},
+		{route: "GET /public/next-bus/:id", url: path("/public/next-bus/999"), want: 404},
+		{route: "GET /public/search", url: path("/public/search?q=Maryland"), want: 200, contains: "Maryland"},
+		{route: "GET /public/search", url: path("/public/search"), want: 400},
+		{route: "GET /public/stops", url: path("/public/stops?bbox=3.3,6.5,3.4,6.7"), want: 200, contains: "Ikeja"},
+		{route: "GET /public/stops", url: path("/public/stops?bbox=1,2"), want: 400},
+		{route: "GET /public/stops/nearby", url: path("/public/stops/nearby?lat=6.5086&lon=3.3747&radius_km=1"), want: 200, contains: "Yaba"},
+		{route: "GET /public/stops/nearby", url: path("/public/stops/nearby?lat=x"), want: 400},
+		{route: "GET /public/health", url: path("/public/health"), want: 200, contains: "ok"},
+		{route: "GET /graphql", url: path("/graphql?query=%7Broutes%7Bname%7D%7D"), want: 200, contains: "Yaba–Ikeja"},
+		{route: "POST /graphql", url: path("/graphql"), body: map[string]string{"query": "{route(id: 1){stops{name}}}"}, want: 200, contains: "Ikeja"},
+		{route: "POST /graphql", url: path("/graphql"), body: map[string]string{"query": `mutation{deleteRoute(id: 1)}`}, want: 200, contains: "unauthorized"},
+		{route: "POST /graphql", url: path("/graphql"), body: map[string]string{"query": "{routes(limit: 1000){stops{name}}}"}, want: 400, contains: handlers.CodeQueryTooComplex},
+
+		// admin: auth and tenancy
+		{route: "GET /admin/validate", url: path("/admin/validate"), want: 401},
+		{route: "GET /admin/validate", url: path("/admin/validate"), auth: admin, want: 200, contains: `"valid":true`},
+
+		// agencies
+		{route: "POST /admin/agencies", url: path("/admin/agencies"), auth: admin, body: map[string]string{"name": "Metro", "timezone": "Europe/Paris"}, want: 201},
+		{route: "POST /admin/agencies", url: path("/admin/agencies"), auth: admin, body: map[string]string{"name": "Bad", "timezone": "Mars/Base"}, want: 400},
+		{route: "PUT /admin/agencies/:id", url: path("/admin/agencies/2"), auth: admin, body: map[string]string{"name": "Metro Bus", "timezone": "Europe/Paris"}, want: 200, contains: "Metro Bus"},
+
+		// routes, stops, schedules (route 2 in agency 2: stops 5-6, schedule 3)
+		{route: "POST /admin/routes", url: path("/admin/routes"), auth: admin, want: 201, body: map[string]interface{}{
+			"name": "Test Line", "agency_id": 2,
+			"stops": []map[string]interface{}{
+				{"name": "A", "latitude": 48.85, "longitude": 2.35, "order_index": 1},
+				{"name": "B", "latitude": 48.86, "longitude": 2.36, "order_index": 2},
+			},
+			"schedules": []map[string]interface{}{{"departure": "06:00", "frequency_min": 10}},
+		}},
+		{route: "POST /admin/routes", url: path("/admin/routes"), auth: admin, body: map[string]string{}, want: 400},
+		{route: "PUT /admin/routes/:id", url: path("/admin/routes/2"), auth: admin, body: map[string]string{"description": "updated"}, want: 200, contains: "updated"},
+		{route: "PUT /admin/routes/:id", url: path("/admin/routes/2"), auth: "agency", body: map[string]string{"name": "hijacked"}, want: 404},
+		{route: "POST /graphql", url: path("/graphql"), auth: admin, body: map[string]string{"query": `mutation{updateRoute(id: 2, input: {description: "via graphql"}){description}}`}, want: 200, contains: "via graphql"},
+		{route: "POST /graphql", url: path("/graphql"), auth: "agency", body: map[string]string{"query": `mutation{deleteRoute(id: 2)}`}, want: 200, contains: "not found"},
+		{route: "PUT /admin/routes/:id", url: path("/admin/routes/999"), auth: admin, body: map[string]string{"name": "x"}, want: 404},
+		{route: "POST /admin/routes/:id/stops", url: path("/admin/routes/2/stops"), auth: admin, want: 201,
+			body: map[string]interface{}{"name": "C", "latitude": 48.87, "longitude": 2.37, "order_index": 3}},
+		{route: "POST /admin/routes/:id/stops", url: path("/admin/routes/2/stops"), auth: admin, want: 400,
+			body: map[string]interface{}{"name": "D", "latitude": 48.88, "longitude": 2.38, "after_stop_id": 1}},
+		{route: "PUT /admin/routes/:id/stops/order", url: path("/admin/routes/2/stops/order"), auth: admin, body: map[string][]uint{"stop_ids": {7, 5, 6}}, want: 200},
+		{route: "PUT /admin/stops/:id", url: path("/admin/stops/7"), auth: admin, body: map[string]string{"name": "C2"}, want: 200, contains: "C2"},
+		{route: "POST /admin/routes/:id/schedules", url: path("/admin/routes/2/schedules"), auth: admin, body: map[string]interface{}{"departure": "08:00", "frequency_min": 15}, want: 201},
+		{route: "POST /admin/routes/:id/schedules", url: path("/admin/routes/2/schedules?strict=true"), auth: admin, body: map[string]interface{}{"departure": "25:00", "frequency_min": 15}, want: 422},
+		{route: "PUT /admin/schedules/:id", url: path("/admin/schedules/4"), auth: admin, body: map[string]int{"frequency_min": 20}, want: 200},
+		{route: "POST /admin/routes/:id/clone", url: path("/admin/routes/2/clone"), auth: admin, body: map[string]interface{}{"name": "Test Line back", "reverse": true}, want: 201, contains: "Test Line back"},
+		{route: "DELETE /admin/schedules/:id", url: path("/admin/schedules/4"), auth: admin, want: 200},
+		{route: "DELETE /admin/stops/:id", url: path("/admin/stops/7"), auth: admin, want: 200},
+		{route: "DELETE /admin/stops/:id", url: path("/admin/stops/7"), auth: admin, want: 404},
+
+		// trash
+		{route: "GET /admin/trash", url: path("/admin/trash"), auth: admin, want: 200, contains: "C2"},
+		{route: "POST /admin/trash/:entity/:id/restore", url: path("/admin/trash/stop/7/restore"), auth: admin, want: 200},
+		{route: "POST /admin/trash/:entity/:id/restore", url: path("/admin/trash/stop/7/restore"), auth: admin, want: 404},
+		{route: "DELETE /admin/routes/:id", url: path("/admin/routes/3"), auth: admin, want: 200},
+		{route: "POST /admin/trash/:entity/:id/restore", url: path("/admin/trash/stop/8/restore"), auth: admin, want: 409, contains: "restore the route first"},
+
+		// audit
+		{route: "GET /admin/audit", url: path("/admin/audit?entity=route&entity_id=3&limit=1"), auth: admin, want: 200, contains: `"action":"delete"`,
+			after: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var entries []map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &entries)
+				if len(entries) == 1 {
+					auditID = entries[0]["id"].(float64)
+				}
+			}},
+		{route: "POST /admin/audit/:id/revert", url: func() string { return fmt.Sprintf("/admin/audit/%.0f/revert", auditID) }, auth: admin, want: 200},
+		{route: "GET /public/routes/:id", url: path("/public/routes/3"), want: 200, contains: "Test Line back"},
+
+		// import, export, validation
+		{route: "POST /admin/upload-csv", url: path("/admin/upload-csv"), auth: admin, body: &multipartBody{"t.csv", csvImport}, want: 400, contains: "agency_id"},
+		{route: "POST /admin/upload-csv", url: path("/admin/upload-csv?agency_id=1&dry_run=true"), auth: admin, body: &multipartBody{"t.csv", csvImport}, want: 200, contains: `"dry_run":true`},
+		{route: "POST /admin/upload-csv", url: path("/admin/upload-csv?agency_id=1"), auth: admin, body: &multipartBody{"t.csv", csvImport}, want: 200, contains: `"routes_created":1`},
+		{route: "POST /admin/upload-csv", url: path("/admin/upload-csv?agency_id=1"), auth: admin, body: &multipartBody{"t.csv", "route_name,stop_lat\nX,north\n"}, want: 422, contains: `"line":2`},
+		{route: "GET /admin/export", url: path("/admin/export?format=csv"), auth: admin, want: 200},
+		{route: "GET /admin/export", url: path("/admin/export?format=xlsx&route_id=1"), auth: admin, want: 200},
+		{route: "GET /admin/export", url: path("/admin/export?format=gtfs"), auth: admin, want: 200},
+		{route: "GET /admin/export", url: path("/admin/export?format=geojson"), auth: admin, want: 200, contains: "FeatureCollection"},
+		{route: "GET /admin/export", url: path("/admin/export?format=pdf"), auth: admin, want: 400},
+
+		// drafts and versions (agency 1)
+		{route: "POST /admin/drafts", url: path("/admin/drafts"), auth: "agency", want: 201,
+			body: map[string]interface{}{"entity": "route", "action": "update", "entity_id": 1, "data": map[string]string{"description": "drafted"}}},
+		{route: "POST /admin/drafts", url: path("/admin/drafts"), auth: "agency", want: 201,
+			body:  map[string]interface{}{"entity": "route", "action": "delete", "entity_id": 1},
+			after: func(t *testing.T, w *httptest.ResponseRecorder) { draftID = jsonField(t, w, "id").(float64) }},
+		{route: "POST /admin/drafts", url: path("/admin/drafts"), auth: "agency", body: map[string]interface{}{"entity": "bus", "action": "create"}, want: 400},
+		{route: "GET /admin/drafts", url: path("/admin/drafts"), auth: "agency", want: 200, contains: "drafted"},
+		{route: "DELETE /admin/drafts/:id", url: func() string { return fmt.Sprintf("/admin/drafts/%.0f", draftID) }, auth: "agency", want: 200},
+		{route: "GET /admin/drafts/preview", url: path("/admin/drafts/preview"), auth: "agency", want: 200, contains: "drafted"},
+		{route: "POST /admin/drafts/publish", url: path("/admin/drafts/publish"), auth: admin, want: 400, contains: "agency_id"},
+		{route: "POST /admin/drafts/publish", url: path("/admin/drafts/publish"), auth: "agency", body: map[string]string{"note": "new description"}, want: 201},
+		{route: "POST /admin/drafts/publish", url: path("/admin/drafts/publish"), auth: "agency", want: 409, contains: "no staged changes"},
+		{route: "GET /public/routes/:id", url: path("/public/routes/1"), want: 200, contains: "drafted"},
+		{route: "GET /admin/audit", url: path("/admin/audit?entity=route&entity_id=1&limit=1"), auth: "agency", want: 200, contains: `"description":"drafted"`},
+		{route: "GET /admin/versions", url: path("/admin/versions?agency_id=1"), auth: admin, want: 200, contains: "new description"},
+		{route: "POST /admin/versions/rollback", url: path("/admin/versions/rollback"), auth: admin, want: 400, contains: "agency_id"},
+		{route: "POST /admin/versions/rollback", url: path("/admin/versions/rollback"), auth: "agency", want: 200},
+		{route: "POST /admin/versions/rollback", url: path("/admin/versions/rollback"), auth: "agency", want: 409, contains: "no previous version"},
+		{route: "GET /public/routes/:id", url: path("/public/routes/1"), want: 200, contains: "Sample route via Ojuelegba"},
+		{route: "GET /admin/audit", url: path("/admin/audit?entity=route&entity_id=1&limit=1"), auth: "agency", want: 200, contains: `"action":"revert"`},
+		{route: "GET /public/routes/:id", url: path("/public/routes/2"), want: 200}, // other agencies untouched
+		{route: "POST /admin/drafts", url: path("/admin/drafts"), auth: "agency", want: 201,
+			body:  map[string]interface{}{"entity": "schedule", "action": "update", "entity_id": 1, "data": map[string]string{"departure": "25:00"}},
+			after: func(t *testing.T, w *httptest.ResponseRecorder) { draftID = jsonField(t, w, "id").(float64) }},
+		{route: "POST /admin/drafts/publish", url: path("/admin/drafts/publish?strict=true"), auth: "agency", want: 422},
+		{route: "DELETE /admin/drafts/:id", url: func() string { return fmt.Sprintf("/admin/drafts/%.0f", draftID) }, auth: "agency", want: 200},
+
+		// API keys
+		{route: "POST /admin/api-keys", url: path("/admin/api-keys"), auth: admin, body: map[string]string{"name": "app", "owner": "tests"}, want: 201,
+			after: func(t *testing.T, w *httptest.ResponseRecorder) {
+				apiKey = jsonField(t, w, "key").(string)
+				apiKeyID = jsonField(t, w, "api_key.id").(float64)
+			}},
+		{route: "GET /public/routes", url: func() string { return "/public/routes?api_key=" + apiKey }, want: 200, contains: "Yaba–Ikeja"},
+		{route: "GET /admin/api-keys", url: path("/admin/api-keys"), auth: admin, want: 200, contains: `"owner":"tests"`},
+		{route: "GET /admin/api-keys/:id/usage", url: func() string { return fmt.Sprintf("/admin/api-keys/%.0f/usage", apiKeyID) }, auth: admin, want: 200, contains: "/public/routes"},
+		{route: "DELETE /admin/api-keys/:id", url: func() string { return fmt.Sprintf("/admin/api-keys/%.0f", apiKeyID) }, auth: admin, want: 200},
+		{route: "GET /public/routes", url: func() string { return "/public/routes?api_key=" + apiKey }, want: 401},
+		{route: "GET /admin/audit", url: path("/admin/audit?entity=api_key&limit=1"), auth: admin, want: 200, contains: `"revoked_at"`},
+
+		// deleting last, so the route is gone for the rest of the run
+		{route: "DELETE /admin/routes/:id", url: path("/admin/routes/2"), auth: "agency", want: 404},
+		{route: "DELETE /admin/routes/:id", url: path("/admin/routes/2"), auth: admin, want: 200},
+		{route: "GET /public/routes/:id", url: path("/public/routes/2"), want: 404},
+	}
+
+	covered := map[string]bool{}
+	for i, tc := range cases {
+		covered[tc.route] = true
+		method := strings.Fields(tc.route)[0]
+		url := "/api/v1" + tc.url()
+		t.Run(fmt.Sprintf("%02d %s %s", i, method, url), func(t *testing.T) {
+			token := ""
+			switch tc.auth {
+			case admin:
+				token = api.token
+			case "agency":
+				token = agencyToken
+			}
+			w := api.do(t, request{method: method, url: url, body: tc.body, token: token})
+			if w.Code != tc.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+			if tc.contains != "" && !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("response lacks %q: %s", tc.contains, w.Body)
+			}
+			if tc.after != nil {
+				tc.after(t, w)
+			}
+		})
+	}
+
+	for _, rt := range api.router.Routes() {
+		if p, ok := strings.CutPrefix(rt.Path, "/api/v1"); ok && !covered[rt.Method+" "+p] {
+			t.Errorf("%s %s has no test case", rt.Method, rt.Path)
+		}
+	}
+}
+
+func TestAuthRateLimit(t *testing.T) {
+	api := newTestAPI(t) // one login
+	for i := 2; i <= 11; i++ {
+		w := api.do(t, request{method: http.MethodPost, url: "/api/v1/auth/login",
+			body: map[string]string{"username": "admin", "password": "wrong"}})
+		if i <= 10 && w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: %d, want 401", i, w.Code)
+		}
+		if i == 11 && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+			t.Fatalf("attempt %d: %d (Retry-After %q), want 429", i, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	// the legacy path shares the limit
+	if w := api.do(t, request{method: http.MethodPost, url: "/auth/login", body: map[string]string{"username": "admin", "password": "admin123"}}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("legacy login: %d, want 429", w.Code)
+	}
+}
+
+func TestPublicRateLimits(t *testing.T) {
+	api := newTestAPI(t)
+	get := func(key string) *httptest.ResponseRecorder {
+		return api.do(t, request{method: http.MethodGet, url: "/api/v1/public/routes", header: map[string]string{"X-API-Key": key}})
+	}
+
+	// a key over its own limit is refused, and the refusal is not usage
+	w := api.do(t, request{method: http.MethodPost, url: "/api/v1/admin/api-keys", token: api.token,
+		body: map[string]interface{}{"name": "slow", "owner": "tests", "rate_limit": 1}})
+	key, keyID := jsonField(t, w, "key").(string), jsonField(t, w, "api_key.id").(float64)
+	if w := get(key); w.Code != http.StatusOK {
+		t.Fatalf("first call: %d", w.Code)
+	}
+	if w := get(key); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second call: %d, want 429", w.Code)
+	}
+	w = api.do(t, request{method: http.MethodGet, url: fmt.Sprintf("/api/v1/admin/api-keys/%.0f/usage", keyID), token: api.token})
+	if count := jsonField(t, w, "usage").([]interface{})[0].(map[string]interface{})["count"]; count != 1.0 {
+		t.Errorf("usage count %v, want 1", count)
+	}
+
+	// guessing keys is limited per IP (the two calls above count too)
+	for i := 3; i <= middleware.KeyLookupRateLimit; i++ {
+		if w := get(fmt.Sprintf("guess-%d", i)); w.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: %d, want 401", i, w.Code)
+		}
+	}
+	if w := get("one-more-guess"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("guess over the limit: %d, want 429", w.Code)
+	}
+}
+
+func TestStrictValidationSetting(t *testing.T) {
+	api := newTestAPI(t)
+	cfg := config.Default()
+	cfg.ValidationStrict = true
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(config.Default()) })
+
+	// ?strict=false does not turn the server setting off
+	w := api.do(t, request{method: http.MethodPost, url: "/api/v1/admin/routes/1/schedules?strict=false", token: api.token,
+		body: map[string]interface{}{"departure": "25:00", "frequency_min": 15}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid schedule with ?strict=false: %d, want 422: %s", w.Code, w.Body)
+	}
+	if issues, _ := jsonField(t, w, "error.details.issues").([]interface{}); len(issues) == 0 {
+		t.Errorf("no issues in the details: %s", w.Body)
+	}
+
+	// the legacy body has them next to the message
+	w = api.do(t, request{method: http.MethodPost, url: "/admin/routes/1/schedules", token: api.token,
+		body: map[string]interface{}{"departure": "25:00", "frequency_min": 15}})
+	if issues, _ := jsonField(t, w, "issues").([]interface{}); w.Code != http.StatusUnprocessableEntity || len(issues) == 0 {
+		t.Errorf("legacy path: %d %s, want 422 with issues", w.Code, w.Body)
+	}
+}
+
+func TestWritesNeedTheirAuditEntry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config.Set(config.Default())
+	gdb := newTestDB(t)
+	api := &testAPI{router: newRouter(gdb, config.Default())}
+	api.token = api.login(t, "admin", "admin123")
+	if err := gdb.Migrator().DropTable(&models.AuditEntry{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := api.do(t, request{method: http.MethodPut, url: "/api/v1/admin/routes/1", token: api.token, body: map[string]string{"name": "Unaudited"}})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("update without an audit log: %d, want 500", w.Code)
+	}
+	w = api.do(t, request{method: http.MethodGet, url: "/api/v1/public/routes/1"})
+	if strings.Contains(w.Body.String(), "Unaudited") {
+		t.Error("the update stood without its audit entry")
+	}
+}
+
+func TestLegacyPathsAreDeprecated(t *testing.T) {
+	api := newTestAPI(t)
+	for _, url := range []string{"/routes/1", "/public/routes/1"} {
+		w := api.do(t, request{method: http.MethodGet, url: url})
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", url, w.Code)
+		}
+		if w.Header().Get("Deprecation") == "" {
+			t.Errorf("GET %s has no Deprecation header", url)
+		}
+	}
+}
+
+func TestProbesAndMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config.Set(config.Default())
+	gdb := newTestDB(t)
+	if err := metrics.InstrumentDB(gdb); err != nil {
+		t.Fatal(err)
+	}
+	jobs := newWorkers(context.Background())
+	api := &testAPI{router: newRouter(gdb, config.Default(), handlers.ReadyCheck{Name: "workers", Check: jobs.check})}
+	get := func(url string) *httptest.ResponseRecorder {
+		return api.do(t, request{method: http.MethodGet, url: url})
+	}
+
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("healthz: %d", w.Code)
+	}
+	if w := get("/readyz"); w.Code != http.StatusOK || jsonField(t, w, "checks.workers") != "ok" {
+		t.Errorf("readyz: %d %s", w.Code, w.Body)
+	}
+
+	get("/api/v1/public/next-bus/1")
+	w := get("/metrics")
+	for _, want := range []string{
+		`busapp_http_request_duration_seconds_count{method="GET",route="/api/v1/public/next-bus/:id",status="200"}`,
+		`busapp_db_query_duration_seconds_count{operation="query",table="routes"}`,
+		`busapp_eta_computation_duration_seconds_count`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+
+	// a job stuck past two intervals, then the database gone
+	jobs.beats["stuck"] = &heartbeat{interval: time.Minute, last: time.Now().Add(-3 * time.Minute)}
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable || jsonField(t, w, "checks.workers") != "stalled: stuck" {
+		t.Errorf("readyz with a stalled job: %d %s", w.Code, w.Body)
+	}
+	sqlDB, _ := gdb.DB()
+	sqlDB.Close()
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable || jsonField(t, w, "checks.database") == "ok" {
+		t.Errorf("readyz without a database: %d %s", w.Code, w.Body)
+	}
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("healthz without a database: %d", w.Code)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"busapp/config"
+	"busapp/db"
+	"busapp/handlers"
+	"busapp/migrations"
+	"busapp/models"
+	"busapp/repository"
+	"busapp/seed"
+	"busapp/service"
+	"busapp/validation"
+
+	"gorm.io/gorm"
+)
+
+// Operational subcommands. They call the same functions as the admin
+// endpoints, acting as handlers.CLIActor in the audit log, so a job scripted
+// here behaves like the matching HTTP call without needing a token.
+
+// newCommand starts a subcommand: its flag set with the config flags
+func newCommand(name string) (*flag.FlagSet, *config.Flags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	return fs, config.RegisterFlags(fs)
+}
+
+// migrateCommand runs "migrate up [version] | down [steps] | status"
+func migrateCommand(args []string) error {
+	fs, flags := newCommand("migrate")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) == 0 || len(rest) > 2 {
+		return errUsage
+	}
+	action := rest[0]
+	n := 0
+	if len(rest) == 2 {
+		if n, err = strconv.Atoi(rest[1]); err != nil || n < 0 {
+			return fmt.Errorf("invalid number %q", rest[1])
+		}
+	}
+	_, db, err := open(flags)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		ran, err := migrations.Up(db, n)
+		for _, m := range ran {
+			log.Printf("applied %d %s", m.Version, m.Name)
+		}
+		if err == nil && len(ran) == 0 {
+			log.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		ran, err := migrations.Down(db, n)
+		for _, m := range ran {
+			log.Printf("reverted %d %s", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrations.Statuses(db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-20s %s\n", s.Version, s.Name, state)
+		}
+		return nil
+	}
+	return errUsage
+}
+
+// seedCommand inserts the sample data
+func seedCommand(args []string) error {
+	fs, flags := newCommand("seed")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		return errUsage
+	}
+	_, db, err := openMigrated(flags)
+	if err != nil {
+		return err
+	}
+	if err := seed.Seed(db); err != nil {
+		return err
+	}
+	log.Println("sample data in place")
+	return nil
+}
+
+// createAdminCommand adds an admin; the password is read from
+// $ADMIN_PASSWORD or the first line of stdin, never from a flag
+func createAdminCommand(args []string) error {
+	fs, flags := newCommand("create-admin")
+	username := fs.String("username", "", "admin username (required)")
+	agencyID := fs.Uint("agency", 0, "agency of the admin (0 = platform admin)")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 || *username == "" {
+		return errUsage
+	}
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	_, db, err := openMigrated(flags)
+	if err != nil {
+		return err
+	}
+	admin, err := handlers.CreateAdmin(db, *username, password, uint(*agencyID))
+	if err != nil {
+		return err
+	}
+	log.Printf("admin %q created (id %d)", admin.Username, admin.ID)
+	return nil
+}
+
+// importCommand runs "import csv|gtfs FILE"
+func importCommand(args []string) error {
+	fs, flags := newCommand("import")
+	agencyID := fs.Uint("agency", 0, "agency to import into (required)")
+	dryRun := fs.Bool("dry-run", false, "validate and report without saving")
+	strict := fs.Bool("strict", false, "reject the import when the validation rules find errors (default: validation_strict setting)")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 2 || (rest[0] != "csv" && rest[0] != "gtfs") || *agencyID == 0 {
+		return errUsage
+	}
+	kind, path := rest[0], rest[1]
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var sheets []handlers.ImportSheet
+	if kind == "gtfs" {
+		archive, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return fmt.Errorf("cannot read zip: %w", err)
+		}
+		sheets, err = handlers.ReadGTFS(archive)
+		if err != nil {
+			return err
+		}
+	} else if sheets, err = handlers.ReadImportSheets(path, file, info.Size()); err != nil {
+		return err
+	}
+
+	cfg, db, err := openMigrated(flags)
+	if err != nil {
+		return err
+	}
+	if !flagSet(fs, "strict") {
+		*strict = cfg.ValidationStrict
+	}
+	agency := uint(*agencyID)
+	if err := db.First(&models.Agency{}, agency).Error; err != nil {
+		return fmt.Errorf("agency %d: %w", agency, err)
+	}
+
+	result, err := handlers.RunImport(db, sheets, &agency, *strict, *dryRun, handlers.CLIActor)
+	if issues, ok := service.FailedIssues(err); ok {
+		result.Issues = issues
+	}
+	if printErr := printJSON(os.Stdout, result); printErr != nil {
+		return printErr
+	}
+	return err
+}
+
+// exportCommand runs "export csv|xlsx|gtfs|geojson"
+func exportCommand(args []string) error {
+	fs, flags := newCommand("export")
+	out := fs.String("o", "", "output file (default stdout)")
+	agencyID := fs.Uint("agency", 0, "export one agency (0 = all)")
+	routeID := fs.Uint("route", 0, "export one route")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		return errUsage
+	}
+	write := map[string]func(io.Writer, *gorm.DB) error{
+		"csv": func(w io.Writer, db *gorm.DB) error {
+			tables, err := handlers.ExportNetwork(db, uint(*agencyID), uint(*routeID))
+			if err != nil {
+				return err
+			}
+			return handlers.WriteCSVZip(w, tables)
+		},
+		"xlsx": func(w io.Writer, db *gorm.DB) error {
+			tables, err := handlers.ExportNetwork(db, uint(*agencyID), uint(*routeID))
+			if err != nil {
+				return err
+			}
+			return handlers.WriteXLSX(w, tables)
+		},
+		"gtfs": func(w io.Writer, db *gorm.DB) error {
+			routes, err := handlers.ExportRoutes(db, uint(*agencyID), uint(*routeID))
+			if err != nil {
+				return err
+			}
+			return handlers.WriteGTFS(w, routes)
+		},
+		"geojson": func(w io.Writer, db *gorm.DB) error {
+			routes, err := handlers.ExportRoutes(db, uint(*agencyID), uint(*routeID))
+			if err != nil {
+				return err
+			}
+			return handlers.WriteGeoJSON(w, routes)
+		},
+	}[rest[0]]
+	if write == nil {
+		return errUsage
+	}
+
+	_, db, err := openMigrated(flags)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return write(os.Stdout, db)
+	}
+
+	// write next to the target and rename, so a failed export leaves no partial file
+	tmp, err := os.CreateTemp(dirOf(*out), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp, db); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *out)
+}
+
+// validateCommand runs the validation rules and fails when they find errors
+func validateCommand(args []string) error {
+	fs, flags := newCommand("validate")
+	agencyID := fs.Uint("agency", 0, "validate one agency (0 = all)")
+	routeID := fs.Uint("route", 0, "validate one route")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		return errUsage
+	}
+	_, db, err := openMigrated(flags)
+	if err != nil {
+		return err
+	}
+
+	var routeIDs []uint
+	if *routeID != 0 {
+		routeIDs = append(routeIDs, uint(*routeID))
+	}
+	issues, err := service.ValidateRoutes(repository.New(db), uint(*agencyID), routeIDs...)
+	if err != nil {
+		return err
+	}
+	errs := validation.Errors(issues)
+
+	if *asJSON {
+		if err := printJSON(os.Stdout, issues); err != nil {
+			return err
+		}
+	} else {
+		for _, i := range issues {
+			fmt.Printf("%-7s route %d %s %d: %s\n", i.Severity, i.RouteID, i.Entity, i.EntityID, i.Message)
+		}
+		fmt.Printf("%d error(s), %d warning(s)\n", len(errs), len(issues)-len(errs))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d validation error(s)", len(errs))
+	}
+	return nil
+}
+
+// backupCommand writes a consistent copy of the database to FILE: a SQLite
+// file (VACUUM INTO) or a pg_dump custom-format archive
+func backupCommand(args []string) error {
+	fs, flags := newCommand("backup")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		return errUsage
+	}
+	target := rest[0]
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("%s already exists", target)
+	}
+
+	cfg, gdb, err := open(flags)
+	if err != nil {
+		return err
+	}
+	switch db.Driver(cfg.DatabaseDSN) {
+	case db.DriverPostgres:
+		cmd := exec.Command("pg_dump", "--format=custom", "--file="+target, "--dbname="+cfg.DatabaseDSN)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			if errors.Is(err, exec.ErrNotFound) {
+				return errors.New("pg_dump is needed to back up PostgreSQL")
+			}
+			return err
+		}
+	default:
+		if err := gdb.Exec("VACUUM INTO ?", target).Error; err != nil {
+			return err
+		}
+	}
+	log.Printf("backup written to %s", target)
+	return nil
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// dirOf is the directory of a file path ("." for a bare name)
+func dirOf(path string) string {
+	if i := strings.LastIndexAny(path, `/\`); i >= 0 {
+		return path[:i+1]
+	}
+	return "."
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load runs Flags.load on args with env as the whole environment
+func load(t *testing.T, args []string, env map[string]string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return flags.load(func(name string) string { return env[name] })
+}
+
+func TestPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"addr": ":1000", "timezone": "Europe/Paris", "log_level": "warn", "graphql_max_cost": 500}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONFIG_FILE": file, "TIMEZONE": "Africa/Lagos", "LOG_LEVEL": "debug"}
+
+	c, err := load(t, []string{"-log-level", "error"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting   string
+		got, want interface{}
+	}{
+		{"token ttl (default)", c.TokenTTL, 24 * time.Hour},
+		{"addr (file)", c.Addr, ":1000"},
+		{"graphql max cost (file)", c.GraphQLMaxCost, 500},
+		{"timezone (env over file)", c.Timezone, "Africa/Lagos"},
+		{"log level (flag over env and file)", c.LogLevel, "error"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+
+	// -config wins over CONFIG_FILE
+	if _, err := load(t, []string{"-config", filepath.Join(t.TempDir(), "missing.json")}, env); err == nil {
+		t.Error("-config with a missing file: want an error")
+	}
+}
+
+func TestProductionSecret(t *testing.T) {
+	tests := []struct {
+		secret string
+		err    string // "" when valid
+	}{
+		{"", "jwt_secret is the default secret"},
+		{DefaultJWTSecret, "jwt_secret is the default secret"},
+		{strings.Repeat("x", minProductionSecretLen-1), "at least 32 characters"},
+		{strings.Repeat("x", minProductionSecretLen), ""},
+	}
+	for _, tt := range tests {
+		_, err := load(t, nil, map[string]string{"APP_ENV": EnvProduction, "JWT_SECRET": tt.secret, "CORS_ORIGINS": "https://bus.example"})
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("secret of %d characters: %v", len(tt.secret), err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("secret %q: error %v, want %q", tt.secret, err, tt.err)
+		}
+	}
+
+	// development keeps the default
+	if _, err := load(t, nil, map[string]string{}); err != nil {
+		t.Errorf("development defaults: %v", err)
+	}
+}
+
+func TestProductionCORS(t *testing.T) {
+	secret := strings.Repeat("x", minProductionSecretLen)
+	tests := []struct {
+		origins string // "" for the default
+		err     string // "" when valid
+	}{
+		{"", "cors_origins must list the allowed origins"},
+		{"*", "cors_origins must list the allowed origins"},
+		{"https://bus.example,*", "cors_origins must list the allowed origins"},
+		{"https://bus.example,https://admin.bus.example", ""},
+	}
+	for _, tt := range tests {
+		_, err := load(t, nil, map[string]string{"APP_ENV": EnvProduction, "JWT_SECRET": secret, "CORS_ORIGINS": tt.origins})
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("origins %q: %v", tt.origins, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("origins %q: error %v, want %q", tt.origins, err, tt.err)
+		}
+	}
+}
+
+func TestInvalidEnv(t *testing.T) {
+	_, err := load(t, nil, map[string]string{"TOKEN_TTL": "soon"})
+	if err == nil || !strings.Contains(err.Error(), "TOKEN_TTL") {
+		t.Errorf("bad TOKEN_TTL: %v", err)
+	}
+	_, err = load(t, nil, map[string]string{"GRAPHQL_MAX_COST": "-1"})
+	if err == nil || !strings.Contains(err.Error(), "graphql_max_cost must be positive") {
+		t.Errorf("negative GRAPHQL_MAX_COST: %v", err)
+	}
+}
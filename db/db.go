@@ -1,13 +1,39 @@
 package db
 
 import (
+	"strings"
+
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// InitDB opens (or creates) the SQLite DB file
-func InitDB(path string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+// Drivers selected by the DSN
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Driver picks the driver for a DSN: PostgreSQL URLs
+// (postgres://, postgresql://) and key=value strings ("host=... dbname=...")
+// use PostgreSQL, anything else is a SQLite file path
+func Driver(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return DriverPostgres
+	}
+	if strings.Contains(dsn, "=") && !strings.HasPrefix(dsn, "file:") && !strings.Contains(dsn, "?") {
+		return DriverPostgres
+	}
+	return DriverSQLite
+}
+
+// InitDB opens the database named by dsn (creating the file for SQLite)
+func InitDB(dsn string) (*gorm.DB, error) {
+	dialector := sqlite.Open(dsn)
+	if Driver(dsn) == DriverPostgres {
+		dialector = postgres.Open(dsn)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,51 @@
+package docs
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+API documentation:
+- GET /openapi.json -> OpenAPI 3 document for /api/v1
+- GET /docs         -> interactive docs rendering that document
+*/
+
+var (
+	specOnce sync.Once
+	spec     Document
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// Spec returns the OpenAPI document (built once)
+func Spec() Document {
+	specOnce.Do(func() { spec = build(operations) })
+	return spec
+}
+
+// Documented reports whether the spec has an operation for a gin route
+// (method and path relative to /api/v1)
+func Documented(method, ginPath string) bool {
+	item, ok := Spec().Paths[OpenAPIPath(ginPath)]
+	if !ok {
+		return false
+	}
+	_, ok = item[strings.ToLower(method)]
+	return ok
+}
+
+// SpecHandler - serves the OpenAPI document
+func SpecHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, Spec())
+}
+
+// UIHandler - serves the docs page
+func UIHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", indexHTML)
+}
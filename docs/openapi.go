@@ -0,0 +1,354 @@
+package docs
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPI 3 document types (only the parts the spec uses)
+
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers"`
+	Tags       []Tag               `json:"tags,omitempty"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Server struct {
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lowercase HTTP methods to operations
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Tags        []string              `json:"tags,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	OperationID string                `json:"operationId"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaGen turns Go types into schemas, collecting named structs as components
+type schemaGen struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaGen() *schemaGen {
+	return &schemaGen{components: map[string]*Schema{}, names: map[reflect.Type]string{}}
+}
+
+// schemaOf returns the schema of v's type (nil for nil)
+func (g *schemaGen) schemaOf(v interface{}) *Schema {
+	if v == nil {
+		return nil
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *schemaGen) schema(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawJSONType:
+		return &Schema{Description: "any JSON value"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := *g.schema(t.Elem())
+		if s.Ref != "" {
+			return &s // $ref siblings are ignored, keep it plain
+		}
+		s.Nullable = true
+		return &s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.componentName(t)
+			g.names[t] = name
+			g.components[name] = &Schema{} // placeholder for recursive types
+			*g.components[name] = *g.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{Description: "any JSON value"}
+}
+
+// componentName is the type name, prefixed with its package on a clash
+func (g *schemaGen) componentName(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := g.components[name]; taken {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	return name
+}
+
+// structSchema lists the JSON fields of a struct the way encoding/json sees them
+func (g *schemaGen) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			embedded := g.structSchema(f.Type)
+			for k, v := range embedded.Properties {
+				s.Properties[k] = v
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+		if strings.Contains(f.Tag.Get("binding"), "required") {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// errorSchema is the error envelope with details of the type of details
+func (g *schemaGen) errorSchema(details interface{}) *Schema {
+	apiError := g.structSchema(reflect.TypeOf(errorResponse.Error))
+	apiError.Properties["details"] = g.schemaOf(details)
+	return &Schema{Type: "object", Properties: map[string]*Schema{"error": apiError}}
+}
+
+// graphErrorSchema is a GraphQL response whose errors carry details of the
+// type of details in their extensions
+func (g *schemaGen) graphErrorSchema(details interface{}) *Schema {
+	extensions := &Schema{Type: "object", Properties: map[string]*Schema{
+		"code":    {Type: "string"},
+		"details": g.schemaOf(details),
+	}}
+	graphError := &Schema{Type: "object", Properties: map[string]*Schema{
+		"message":    {Type: "string"},
+		"extensions": extensions,
+	}}
+	return &Schema{Type: "object", Properties: map[string]*Schema{"errors": {Type: "array", Items: graphError}}}
+}
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// OpenAPIPath converts a gin path ("/routes/:id") to OpenAPI form ("/routes/{id}")
+func OpenAPIPath(ginPath string) string {
+	return pathParam.ReplaceAllString(ginPath, "{$1}")
+}
+
+// build assembles the document from the operation table
+func build(ops []operation) Document {
+	g := newSchemaGen()
+	doc := Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:   "Bus Routes API",
+			Version: "1.0.0",
+			Description: "Routes, stops and timetables. Errors use the envelope " +
+				`{"error": {"code", "message", "details", "request_id"}}. ` +
+				"The unversioned legacy paths are deprecated.",
+		},
+		Servers: []Server{{URL: "/api/v1"}},
+		Tags: []Tag{
+			{Name: "auth", Description: "Admin accounts and tokens"},
+			{Name: "public", Description: "Read-only data for riders and partners; an API key raises the rate limit"},
+			{Name: "admin", Description: "Network management; requires a bearer token"},
+			{Name: "graphql", Description: "Routes, stops, departures and alerts in one request; mutations require a bearer token"},
+		},
+		Paths: map[string]PathItem{},
+		Components: Components{
+			SecuritySchemes: map[string]SecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+				"apiKey":     {Type: "apiKey", In: "header", Name: "X-API-Key"},
+			},
+		},
+	}
+	errSchema := g.schemaOf(errorResponse)
+
+	for _, op := range ops {
+		path := OpenAPIPath(op.path)
+		o := &Operation{
+			Tags:        []string{op.tag},
+			Summary:     op.summary,
+			OperationID: op.id,
+			Responses:   map[string]Response{},
+		}
+
+		for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+			typ := "integer"
+			if m[1] == "entity" {
+				typ = "string"
+			}
+			o.Parameters = append(o.Parameters, Parameter{Name: m[1], In: "path", Required: true, Schema: &Schema{Type: typ}})
+		}
+		for _, q := range op.query {
+			o.Parameters = append(o.Parameters, Parameter{Name: q.name, In: "query", Description: q.desc, Schema: &Schema{Type: q.typ}})
+		}
+
+		switch {
+		case op.upload:
+			o.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{
+				"multipart/form-data": {Schema: &Schema{Type: "object", Required: []string{"file"},
+					Properties: map[string]*Schema{"file": {Type: "string", Format: "binary"}}}},
+			}}
+		case op.body != nil:
+			o.RequestBody = &RequestBody{Required: !op.optionalBody, Content: map[string]MediaType{
+				"application/json": {Schema: g.schemaOf(op.body)},
+			}}
+		}
+
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := Response{Description: http.StatusText(status)}
+		switch {
+		case op.download != "":
+			resp.Content = map[string]MediaType{}
+			for _, ct := range strings.Split(op.download, ",") {
+				resp.Content[ct] = MediaType{Schema: &Schema{Type: "string", Format: "binary"}}
+			}
+		case op.resp != nil:
+			resp.Content = map[string]MediaType{"application/json": {Schema: g.schemaOf(op.resp)}}
+		}
+		o.Responses[strconv.Itoa(status)] = resp
+		o.Responses["default"] = Response{Description: "Error", Content: map[string]MediaType{
+			"application/json": {Schema: errSchema},
+		}}
+		errs := map[int]interface{}{}
+		for _, q := range op.query {
+			if q == strictParam {
+				errs[http.StatusUnprocessableEntity] = validationDetails
+			}
+		}
+		for status, details := range op.errors {
+			errs[status] = details
+		}
+		for status, details := range errs {
+			schema := g.errorSchema(details)
+			if op.tag == "graphql" {
+				schema = g.graphErrorSchema(details)
+			}
+			o.Responses[strconv.Itoa(status)] = Response{Description: http.StatusText(status), Content: map[string]MediaType{
+				"application/json": {Schema: schema},
+			}}
+		}
+
+		switch op.auth {
+		case authBearer:
+			o.Security = []map[string][]string{{"bearerAuth": {}}}
+		case authAPIKey:
+			o.Security = []map[string][]string{{"apiKey": {}}, {}} // optional
+		}
+
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = PathItem{}
+			doc.Paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+
+	doc.Components.Schemas = g.components
+	return doc
+}
@@ -0,0 +1,213 @@
+package docs
+
+import (
+	"net/http"
+
+	"busapp/handlers"
+	"busapp/models"
+	"busapp/search"
+	"busapp/spatial"
+)
+
+// The operation table behind the spec. Request and response schemas are
+// generated from the handler payload and response types, so they follow the
+// code; routes_test.go in package main fails when a registered route has no
+// entry here.
+
+const (
+	authNone   = ""
+	authBearer = "bearer"
+	authAPIKey = "apiKey" // optional key for higher rate limits
+)
+
+type queryParam struct {
+	name, typ, desc string
+}
+
+type operation struct {
+	method, path string
+	id, tag      string
+	summary      string
+	auth         string
+	query        []queryParam
+	body         interface{} // payload type (zero value)
+	optionalBody bool
+	upload       bool // multipart "file"
+	status       int  // success status, default 200
+	resp         interface{}
+	download     string // comma separated content types of a file response
+	// errors maps error statuses to the type of their details; writes
+	// taking strictParam answer 422 with validationDetails
+	errors map[int]interface{}
+}
+
+var (
+	errorResponse     = handlers.ErrorResponse{}
+	validationDetails = handlers.ValidationDetails{}
+)
+
+var (
+	routeListParams = []queryParam{
+		{"limit", "integer", "page size (default 50, max 500)"},
+		{"offset", "integer", "index of the first route"},
+		{"q", "string", "route name contains"},
+		{"agency", "integer", "agency ID"},
+		{"stop_id", "integer", "routes serving this stop"},
+		{"stop", "string", "routes serving a stop whose name contains this"},
+		{"sort", "string", "id, name or created_at; prefix - for descending"},
+		{"include", "string", "comma list of stops, schedules, agency, or none"},
+	}
+	strictParam = queryParam{"strict", "boolean", "reject writes that leave validation errors (422)"}
+	agencyParam = queryParam{"agency_id", "integer", "agency to work on (required for platform admins)"}
+
+	graphErrors = map[int]interface{}{http.StatusBadRequest: handlers.QueryCostDetails{}}
+)
+
+var operations = []operation{
+	// auth
+	{method: http.MethodPost, path: "/auth/register", id: "register", tag: "auth", summary: "Add an admin (agency admins: to their own agency)", auth: authBearer,
+		body: handlers.RegisterPayload{}, status: http.StatusCreated, resp: handlers.MessageResponse{}},
+	{method: http.MethodPost, path: "/auth/login", id: "login", tag: "auth", summary: "Log in and get a JWT",
+		body: handlers.LoginPayload{}, resp: handlers.TokenResponse{}},
+
+	// public
+	{method: http.MethodGet, path: "/public/agencies", id: "listAgencies", tag: "public", summary: "List agencies",
+		auth: authAPIKey, resp: []models.Agency{}},
+	{method: http.MethodGet, path: "/public/routes", id: "listRoutes", tag: "public",
+		summary: "List routes (X-Total-Count and a rel=next Link header carry paging)",
+		auth:    authAPIKey, query: routeListParams, resp: []models.Route{}},
+	{method: http.MethodGet, path: "/public/routes/:id", id: "getRoute", tag: "public", summary: "Get a route with its stops and schedules",
+		auth: authAPIKey, resp: models.Route{}},
+	{method: http.MethodGet, path: "/public/next-bus/:id", id: "getNextBus", tag: "public", summary: "Next departures and stop ETAs",
+		auth: authAPIKey, resp: handlers.NextBusResponse{}},
+	{method: http.MethodGet, path: "/public/search", id: "search", tag: "public", summary: "Fuzzy search over routes and stops",
+		auth: authAPIKey, resp: handlers.SearchResponse{Results: []search.Result{}},
+		query: []queryParam{
+			{"q", "string", "search text (required)"},
+			{"type", "string", "route or stop"},
+			{"agency", "integer", "agency ID"},
+			{"lat", "number", "caller latitude, ranks nearby results higher"},
+			{"lon", "number", "caller longitude"},
+			{"limit", "integer", "max results (1-100, default 20)"},
+		}},
+	{method: http.MethodGet, path: "/public/stops", id: "stopsInBBox", tag: "public", summary: "Stops inside a bounding box",
+		auth: authAPIKey, resp: handlers.StopsResponse{Stops: []spatial.Stop{}},
+		query: []queryParam{
+			{"bbox", "string", "min_lon,min_lat,max_lon,max_lat (required)"},
+			{"agency", "integer", "agency ID"},
+			{"limit", "integer", "max results (1-200, default 50)"},
+		}},
+	{method: http.MethodGet, path: "/public/stops/nearby", id: "nearbyStops", tag: "public", summary: "Stops around a point, closest first",
+		auth: authAPIKey, resp: handlers.StopsResponse{Stops: []spatial.Stop{}},
+		query: []queryParam{
+			{"lat", "number", "latitude (required)"},
+			{"lon", "number", "longitude (required)"},
+			{"radius_km", "number", "search radius (up to 50, default 1)"},
+			{"agency", "integer", "agency ID"},
+			{"limit", "integer", "max results (1-200, default 50)"},
+		}},
+	{method: http.MethodGet, path: "/public/health", id: "health", tag: "public", summary: "Liveness check",
+		resp: handlers.StatusResponse{}},
+
+	// GraphQL
+	{method: http.MethodGet, path: "/graphql", id: "graphqlQuery", tag: "graphql", summary: "Run a GraphQL query (mutations need POST)",
+		auth: authAPIKey, resp: handlers.GraphQLResponse{}, errors: graphErrors,
+		query: []queryParam{
+			{"query", "string", "GraphQL document (required)"},
+			{"operationName", "string", "operation to run"},
+			{"variables", "string", "JSON object of variables"},
+		}},
+	{method: http.MethodPost, path: "/graphql", id: "graphql", tag: "graphql",
+		summary: "Run a GraphQL query or mutation (mutations need a bearer token)",
+		auth:    authAPIKey, body: handlers.GraphQLRequest{}, resp: handlers.GraphQLResponse{}, errors: graphErrors},
+
+	// admin: agencies
+	{method: http.MethodPost, path: "/admin/agencies", id: "createAgency", tag: "admin", summary: "Create an agency (platform admins)",
+		auth: authBearer, body: handlers.AgencyPayload{}, status: http.StatusCreated, resp: models.Agency{}},
+	{method: http.MethodPut, path: "/admin/agencies/:id", id: "updateAgency", tag: "admin", summary: "Update an agency",
+		auth: authBearer, body: handlers.AgencyPayload{}, resp: models.Agency{}},
+
+	// admin: routes, stops, schedules
+	{method: http.MethodPost, path: "/admin/routes", id: "createRoute", tag: "admin", summary: "Create a route with optional stops and schedules",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.CreateRoutePayload{}, status: http.StatusCreated, resp: models.Route{}},
+	{method: http.MethodPut, path: "/admin/routes/:id", id: "updateRoute", tag: "admin", summary: "Update a route",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.UpdateRoutePayload{}, resp: models.Route{}},
+	{method: http.MethodDelete, path: "/admin/routes/:id", id: "deleteRoute", tag: "admin", summary: "Move a route to the trash",
+		auth: authBearer, resp: handlers.StatusResponse{}},
+	{method: http.MethodPost, path: "/admin/routes/:id/clone", id: "cloneRoute", tag: "admin",
+		summary: "Clone a route (dry_run returns the CreateRoutePayload without saving)",
+		auth:    authBearer, query: []queryParam{strictParam, {"dry_run", "boolean", "return the clone without saving it"}},
+		body: handlers.CloneRoutePayload{}, optionalBody: true, status: http.StatusCreated, resp: models.Route{}},
+	{method: http.MethodPost, path: "/admin/routes/:id/stops", id: "addStop", tag: "admin", summary: "Add a stop to a route",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.CreateStopPayload{}, status: http.StatusCreated, resp: models.Stop{}},
+	{method: http.MethodPut, path: "/admin/routes/:id/stops/order", id: "reorderStops", tag: "admin", summary: "Renumber all stops of a route",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.ReorderStopsPayload{}, resp: []models.Stop{}},
+	{method: http.MethodPut, path: "/admin/stops/:id", id: "updateStop", tag: "admin", summary: "Update a stop",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.UpdateStopPayload{}, resp: models.Stop{}},
+	{method: http.MethodDelete, path: "/admin/stops/:id", id: "deleteStop", tag: "admin", summary: "Move a stop to the trash",
+		auth: authBearer, resp: handlers.StatusResponse{}},
+	{method: http.MethodPost, path: "/admin/routes/:id/schedules", id: "addSchedule", tag: "admin", summary: "Add a schedule to a route",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.CreateScheduleBody{}, status: http.StatusCreated, resp: models.Schedule{}},
+	{method: http.MethodPut, path: "/admin/schedules/:id", id: "updateSchedule", tag: "admin", summary: "Update a schedule",
+		auth: authBearer, query: []queryParam{strictParam}, body: handlers.UpdateSchedulePayload{}, resp: models.Schedule{}},
+	{method: http.MethodDelete, path: "/admin/schedules/:id", id: "deleteSchedule", tag: "admin", summary: "Move a schedule to the trash",
+		auth: authBearer, resp: handlers.StatusResponse{}},
+
+	// admin: import, export, validation
+	{method: http.MethodPost, path: "/admin/upload-csv", id: "importTimetable", tag: "admin", summary: "Import a CSV, zip of CSVs, xlsx workbook or GTFS zip",
+		auth: authBearer, query: []queryParam{agencyParam, strictParam, {"dry_run", "boolean", "validate and report without saving"}},
+		upload: true, resp: handlers.ImportResult{}, errors: map[int]interface{}{http.StatusUnprocessableEntity: handlers.ImportResult{}}},
+	{method: http.MethodGet, path: "/admin/export", id: "exportNetwork", tag: "admin", summary: "Export the network in the import format, GTFS or GeoJSON",
+		auth: authBearer, download: "application/zip,text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/geo+json",
+		query: []queryParam{
+			{"format", "string", "csv (default), xlsx, gtfs or geojson"},
+			{"route_id", "integer", "export a single route"},
+			{"entity", "string", "routes, stops or schedules: a single CSV table"},
+		}},
+	{method: http.MethodGet, path: "/admin/validate", id: "validateNetwork", tag: "admin", summary: "Run the validation rules",
+		auth: authBearer, query: []queryParam{{"route_id", "integer", "validate a single route"}}, resp: handlers.ValidationReport{}},
+
+	// admin: drafts and versions
+	{method: http.MethodPost, path: "/admin/drafts", id: "stageDraft", tag: "admin", summary: "Stage a change",
+		auth: authBearer, query: []queryParam{agencyParam, strictParam}, body: handlers.StageDraftPayload{}, status: http.StatusCreated, resp: models.DraftChange{}},
+	{method: http.MethodGet, path: "/admin/drafts", id: "listDrafts", tag: "admin", summary: "List staged changes",
+		auth: authBearer, query: []queryParam{agencyParam}, resp: []models.DraftChange{}},
+	{method: http.MethodGet, path: "/admin/drafts/preview", id: "previewDrafts", tag: "admin", summary: "Routes as they would look once published",
+		auth: authBearer, query: []queryParam{agencyParam}, resp: []models.Route{}},
+	{method: http.MethodPost, path: "/admin/drafts/publish", id: "publishDrafts", tag: "admin", summary: "Publish staged changes as a new version",
+		auth: authBearer, query: []queryParam{agencyParam, strictParam}, body: handlers.PublishPayload{}, optionalBody: true, status: http.StatusCreated, resp: models.NetworkVersion{}},
+	{method: http.MethodDelete, path: "/admin/drafts/:id", id: "discardDraft", tag: "admin", summary: "Discard a staged change",
+		auth: authBearer, query: []queryParam{agencyParam}, resp: handlers.StatusResponse{}},
+	{method: http.MethodGet, path: "/admin/versions", id: "listVersions", tag: "admin", summary: "List published versions",
+		auth: authBearer, query: []queryParam{agencyParam}, resp: []models.NetworkVersion{}},
+	{method: http.MethodPost, path: "/admin/versions/rollback", id: "rollbackVersion", tag: "admin", summary: "Go back to the previous version",
+		auth: authBearer, query: []queryParam{agencyParam, strictParam}, resp: models.NetworkVersion{}},
+
+	// admin: trash and audit
+	{method: http.MethodGet, path: "/admin/trash", id: "listTrash", tag: "admin", summary: "List deleted routes, stops and schedules",
+		auth: authBearer, query: []queryParam{{"entity", "string", "route, stop or schedule"}}, resp: []handlers.TrashItem{}},
+	{method: http.MethodPost, path: "/admin/trash/:entity/:id/restore", id: "restoreFromTrash", tag: "admin", summary: "Restore a deleted entity",
+		auth: authBearer, query: []queryParam{strictParam}},
+	{method: http.MethodGet, path: "/admin/audit", id: "listAudit", tag: "admin", summary: "List audit entries, newest first",
+		auth: authBearer, resp: []models.AuditEntry{},
+		query: []queryParam{
+			{"entity", "string", "route, stop, schedule, alert, agency or api_key"},
+			{"entity_id", "integer", ""},
+			{"actor", "string", "admin ID or username"},
+			{"from", "string", "RFC3339 time or date"},
+			{"to", "string", "RFC3339 time or date"},
+			{"limit", "integer", "max entries (default 100)"},
+		}},
+	{method: http.MethodPost, path: "/admin/audit/:id/revert", id: "revertAudit", tag: "admin", summary: "Restore an entity to its state before an entry",
+		auth: authBearer, query: []queryParam{strictParam}},
+
+	// admin: API keys
+	{method: http.MethodPost, path: "/admin/api-keys", id: "createAPIKey", tag: "admin", summary: "Issue an API key (the plain key is returned once)",
+		auth: authBearer, body: handlers.CreateAPIKeyPayload{}, status: http.StatusCreated, resp: handlers.CreatedAPIKeyResponse{}},
+	{method: http.MethodGet, path: "/admin/api-keys", id: "listAPIKeys", tag: "admin", summary: "List API keys",
+		auth: authBearer, resp: []models.APIKey{}},
+	{method: http.MethodDelete, path: "/admin/api-keys/:id", id: "revokeAPIKey", tag: "admin", summary: "Revoke an API key",
+		auth: authBearer, resp: handlers.StatusResponse{}},
+	{method: http.MethodGet, path: "/admin/api-keys/:id/usage", id: "getAPIKeyUsage", tag: "admin", summary: "Requests per day and endpoint",
+		auth: authBearer, resp: handlers.APIKeyUsageResponse{}},
+}
@@ -1,9 +1,10 @@
 package handlers
 
 import (
+	"busapp/config"
 	"busapp/models"
+	"busapp/service"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -23,80 +24,114 @@ func CheckPassword(hash, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-// JWT secret key (from env or fallback)
+// JWT secret key (from the config, see the config package)
 func GetJWTSecret() string {
-	if s := os.Getenv("JWT_SECRET"); s != "" {
-		return s
-	}
-	return "supersecretkey"
+	return config.Get().JWTSecret
 }
 
 // GenerateJWT creates a signed token
 func GenerateJWT(admin models.Admin) (string, error) {
 	claims := jwt.MapClaims{
-		"id":       admin.ID,
-		"username": admin.Username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
+		"id":        admin.ID,
+		"username":  admin.Username,
+		"agency_id": admin.AgencyID,
+		"exp":       time.Now().Add(config.Get().TokenTTL).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(GetJWTSecret()))
 }
 
+// CreateAdmin adds an admin account, attached to agencyID unless 0 (a
+// platform admin). Callers check that the caller may create it.
+func CreateAdmin(db *gorm.DB, username, password string, agencyID uint) (models.Admin, error) {
+	if username == "" || password == "" {
+		return models.Admin{}, service.Invalid("username and password are required")
+	}
+
+	var existing models.Admin
+	if err := db.Where("username = ?", username).First(&existing).Error; err == nil {
+		return existing, service.Conflict("username already exists")
+	}
+
+	if agencyID != 0 {
+		if err := db.First(&models.Agency{}, agencyID).Error; err != nil {
+			return models.Admin{}, service.Invalid("agency not found")
+		}
+	}
+
+	admin := models.Admin{Username: username, Password: HashPassword(password), AgencyID: agencyID}
+	if err := db.Create(&admin).Error; err != nil {
+		return admin, err
+	}
+	return admin, nil
+}
+
 // ----------- Handlers ------------
 
-// Register new admin
+type RegisterPayload struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	// AgencyID defaults to the caller's agency; only platform admins may
+	// set another one, or 0 for a platform admin
+	AgencyID *uint `json:"agency_id,omitempty"`
+}
+
+type LoginPayload struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// Register a new admin, for a signed-in admin: agency admins can only add
+// admins to their own agency (the first admin comes from the create-admin
+// command)
 func RegisterHandler(c *gin.Context, db *gorm.DB) {
-	var body struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-	}
+	var body RegisterPayload
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var existing models.Admin
-	if err := db.Where("username = ?", body.Username).First(&existing).Error; err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "username already exists"})
-		return
+	agencyID := tenantID(c)
+	if body.AgencyID != nil {
+		if agencyID != 0 && *body.AgencyID != agencyID {
+			respondError(c, http.StatusForbidden, "admins can only be added to your own agency")
+			return
+		}
+		agencyID = *body.AgencyID
 	}
 
-	admin := models.Admin{Username: body.Username, Password: HashPassword(body.Password)}
-	if err := db.Create(&admin).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register"})
+	if _, err := CreateAdmin(db, body.Username, body.Password, agencyID); err != nil {
+		respondWriteError(c, err, "failed to register")
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "admin registered"})
+	c.JSON(http.StatusCreated, MessageResponse{Message: "admin registered"})
 }
 
 // Login and get token
 func LoginHandler(c *gin.Context, db *gorm.DB) {
-	var body struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-	}
+	var body LoginPayload
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	var admin models.Admin
 	if err := db.Where("username = ?", body.Username).First(&admin).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
+		respondError(c, http.StatusUnauthorized, "invalid username or password")
 		return
 	}
 
 	if !CheckPassword(admin.Password, body.Password) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
+		respondError(c, http.StatusUnauthorized, "invalid username or password")
 		return
 	}
 
 	token, err := GenerateJWT(admin)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		respondInternalError(c, err, "failed to create token")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	c.JSON(http.StatusOK, TokenResponse{Token: token})
 }
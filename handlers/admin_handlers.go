@@ -1,11 +1,14 @@
 package handlers
 
 import (
-	"encoding/csv"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"busapp/models"
+	"busapp/repository"
+	"busapp/service"
+	"busapp/validation"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -15,19 +18,28 @@ import (
 Admin endpoints added:
 - POST   /admin/routes            -> create route (+ optional stops & schedules)
 - PUT    /admin/routes/:id        -> update route (name/description)
-- DELETE /admin/routes/:id        -> delete route (cascade deletes stops & schedules)
+- DELETE /admin/routes/:id        -> move route with its stops & schedules to the trash
 
-- POST   /admin/routes/:id/stops  -> add stop to route
+- POST   /admin/routes/:id/stops  -> add stop to route (optionally after another stop)
+- PUT    /admin/routes/:id/stops/order -> renumber all stops (see stop_order.go)
 - PUT    /admin/stops/:id         -> update stop
 - DELETE /admin/stops/:id        -> delete stop
 
 - POST   /admin/routes/:id/schedules -> add schedule to route
 - PUT    /admin/schedules/:id        -> update schedule
 - DELETE /admin/schedules/:id       -> delete schedule
+
+- POST   /admin/upload-csv           -> import timetable CSV (see csv_import.go)
+
+The writes run through the route and schedule services (see the service
+package): every create, update and delete is limited to the admin's agency
+(see agencies.go), checked by the validation rules (see validate.go) and
+recorded in the audit log (see audit.go).
 */
 
 // Payloads
 type CreateRoutePayload struct {
+	AgencyID    *uint                `json:"agency_id,omitempty"` // platform admins only
 	Name        string               `json:"name" binding:"required"`
 	Description string               `json:"description"`
 	Stops       []CreateStopPayload  `json:"stops,omitempty"`
@@ -35,10 +47,11 @@ type CreateRoutePayload struct {
 }
 
 type CreateStopPayload struct {
-	Name       string  `json:"name" binding:"required"`
-	Latitude   float64 `json:"latitude" binding:"required"`
-	Longitude  float64 `json:"longitude" binding:"required"`
-	OrderIndex int     `json:"order_index"`
+	Name        string  `json:"name" binding:"required"`
+	Latitude    float64 `json:"latitude" binding:"required"`
+	Longitude   float64 `json:"longitude" binding:"required"`
+	OrderIndex  int     `json:"order_index"`
+	AfterStopID *uint   `json:"after_stop_id,omitempty"` // insert after this stop (0 = first) instead of using order_index
 }
 
 type CreateScheduleBody struct {
@@ -46,86 +59,220 @@ type CreateScheduleBody struct {
 	FrequencyMin int    `json:"frequency_min" binding:"required"` // 30
 }
 
-// CreateRouteHandler - creates route with optional stops and schedules
-func CreateRouteHandler(c *gin.Context, db *gorm.DB) {
-	var payload CreateRoutePayload
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+// Partial update payloads: only non-nil fields are changed
+type UpdateRoutePayload struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
 
+type UpdateStopPayload struct {
+	Name       *string  `json:"name"`
+	Latitude   *float64 `json:"latitude"`
+	Longitude  *float64 `json:"longitude"`
+	OrderIndex *int     `json:"order_index"`
+}
+
+type UpdateSchedulePayload struct {
+	Departure    *string `json:"departure"`
+	FrequencyMin *int    `json:"frequency_min"`
+}
+
+// NewRoute builds a route model (with stops and schedules) from the payload
+func (p CreateRoutePayload) NewRoute() models.Route {
 	route := models.Route{
-		Name:        payload.Name,
-		Description: payload.Description,
+		AgencyID:    p.AgencyID,
+		Name:        p.Name,
+		Description: p.Description,
 	}
+	for _, s := range p.Stops {
+		route.Stops = append(route.Stops, s.NewStop(0))
+	}
+	for _, sch := range p.Schedules {
+		route.Schedules = append(route.Schedules, sch.NewSchedule(0))
+	}
+	return route
+}
 
-	// build stops and schedules
-	for _, s := range payload.Stops {
-		route.Stops = append(route.Stops, models.Stop{
-			Name:       s.Name,
-			Latitude:   s.Latitude,
-			Longitude:  s.Longitude,
-			OrderIndex: s.OrderIndex,
-		})
+// NewStop builds a stop model for the given route
+func (p CreateStopPayload) NewStop(routeID uint) models.Stop {
+	return models.Stop{
+		RouteID:    routeID,
+		Name:       p.Name,
+		Latitude:   p.Latitude,
+		Longitude:  p.Longitude,
+		OrderIndex: p.OrderIndex,
 	}
-	for _, sch := range payload.Schedules {
-		route.Schedules = append(route.Schedules, models.Schedule{
-			Departure:    sch.Departure,
-			FrequencyMin: sch.FrequencyMin,
-		})
+}
+
+// NewSchedule builds a schedule model for the given route
+func (p CreateScheduleBody) NewSchedule(routeID uint) models.Schedule {
+	return models.Schedule{
+		RouteID:      routeID,
+		Departure:    p.Departure,
+		FrequencyMin: p.FrequencyMin,
 	}
+}
 
-	if err := db.Create(&route).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create route"})
-		return
+// Apply copies the set fields onto the route
+func (p UpdateRoutePayload) Apply(route *models.Route) {
+	if p.Name != nil {
+		route.Name = *p.Name
+	}
+	if p.Description != nil {
+		route.Description = *p.Description
 	}
-	c.JSON(http.StatusCreated, route)
 }
 
-// UpdateRouteHandler - updates simple route fields
-func UpdateRouteHandler(c *gin.Context, db *gorm.DB) {
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
+// Apply copies the set fields onto the stop
+func (p UpdateStopPayload) Apply(stop *models.Stop) {
+	if p.Name != nil {
+		stop.Name = *p.Name
+	}
+	if p.Latitude != nil {
+		stop.Latitude = *p.Latitude
+	}
+	if p.Longitude != nil {
+		stop.Longitude = *p.Longitude
+	}
+	if p.OrderIndex != nil {
+		stop.OrderIndex = *p.OrderIndex
+	}
+}
 
-	var payload struct {
-		Name        *string `json:"name"`
-		Description *string `json:"description"`
+// Apply copies the set fields onto the schedule
+func (p UpdateSchedulePayload) Apply(sch *models.Schedule) {
+	if p.Departure != nil {
+		sch.Departure = *p.Departure
 	}
+	if p.FrequencyMin != nil {
+		sch.FrequencyMin = *p.FrequencyMin
+	}
+}
+
+// statusOf is the HTTP status of a service error kind
+var statusOf = map[service.Kind]int{
+	service.KindInvalid:  http.StatusBadRequest,
+	service.KindNotFound: http.StatusNotFound,
+	service.KindConflict: http.StatusConflict,
+}
+
+// respondWriteError answers an error returned by a service write;
+// fallback is the message for unexpected (500) errors
+func respondWriteError(c *gin.Context, err error, fallback string) {
+	var se *service.Error
+	switch {
+	case errors.As(err, &se):
+		respondError(c, statusOf[se.Kind], se.Message)
+	case respondValidationFailure(c, err):
+	default:
+		respondInternalError(c, err, fallback)
+	}
+}
+
+// changeOf describes a write by the current admin: limited to their agency,
+// validated as asked by the request (see validate.go) and audited
+func changeOf(c *gin.Context) service.Change {
+	return service.Change{
+		Actor:     actorOf(c),
+		Strict:    strictValidation(c),
+		Validated: func(issues []validation.Issue) { setValidationHeaders(c, issues) },
+	}
+}
+
+func routeService(db *gorm.DB) service.RouteService {
+	return service.NewRouteService(repository.New(db))
+}
+
+func scheduleService(db *gorm.DB) service.ScheduleService {
+	return service.NewScheduleService(repository.New(db))
+}
+
+// The admin writes, shared by the REST handlers and the GraphQL mutations
+// (see graphql.go)
+
+func createRoute(c *gin.Context, db *gorm.DB, payload CreateRoutePayload) (models.Route, error) {
+	return routeService(db).Create(changeOf(c), payload.NewRoute())
+}
+
+func updateRoute(c *gin.Context, db *gorm.DB, id uint, payload UpdateRoutePayload) (models.Route, error) {
+	return routeService(db).Update(changeOf(c), id, payload.Apply)
+}
+
+func deleteRoute(c *gin.Context, db *gorm.DB, id uint) error {
+	return routeService(db).Delete(changeOf(c), id)
+}
+
+func addStop(c *gin.Context, db *gorm.DB, routeID uint, payload CreateStopPayload) (models.Stop, error) {
+	return routeService(db).AddStop(changeOf(c), payload.NewStop(routeID), payload.AfterStopID)
+}
+
+func updateStop(c *gin.Context, db *gorm.DB, id uint, payload UpdateStopPayload) (models.Stop, error) {
+	return routeService(db).UpdateStop(changeOf(c), id, payload.Apply)
+}
+
+func deleteStop(c *gin.Context, db *gorm.DB, id uint) error {
+	return routeService(db).DeleteStop(changeOf(c), id)
+}
+
+func addSchedule(c *gin.Context, db *gorm.DB, routeID uint, payload CreateScheduleBody) (models.Schedule, error) {
+	return scheduleService(db).Add(changeOf(c), payload.NewSchedule(routeID))
+}
+
+func updateSchedule(c *gin.Context, db *gorm.DB, id uint, payload UpdateSchedulePayload) (models.Schedule, error) {
+	return scheduleService(db).Update(changeOf(c), id, payload.Apply)
+}
+
+func deleteSchedule(c *gin.Context, db *gorm.DB, id uint) error {
+	return scheduleService(db).Delete(changeOf(c), id)
+}
+
+// ----------- Handlers ------------
+
+// CreateRouteHandler - creates route with optional stops and schedules
+func CreateRouteHandler(c *gin.Context, db *gorm.DB) {
+	var payload CreateRoutePayload
 	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var route models.Route
-	if err := db.First(&route, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "route not found"})
+	route, err := createRoute(c, db, payload)
+	if err != nil {
+		respondWriteError(c, err, "failed to create route")
 		return
 	}
+	c.JSON(http.StatusCreated, route)
+}
 
-	if payload.Name != nil {
-		route.Name = *payload.Name
-	}
-	if payload.Description != nil {
-		route.Description = *payload.Description
+// UpdateRouteHandler - updates simple route fields
+func UpdateRouteHandler(c *gin.Context, db *gorm.DB) {
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	var payload UpdateRoutePayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if err := db.Save(&route).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update route"})
+	route, err := updateRoute(c, db, uint(id), payload)
+	if err != nil {
+		respondWriteError(c, err, "failed to update route")
 		return
 	}
 	c.JSON(http.StatusOK, route)
 }
 
-// DeleteRouteHandler - deletes a route (cascade deletes stops/schedules by GORM constraints)
+// DeleteRouteHandler - moves a route with its stops and schedules to the trash
 func DeleteRouteHandler(c *gin.Context, db *gorm.DB) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
 
-	if err := db.Delete(&models.Route{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete route"})
+	if err := deleteRoute(c, db, uint(id)); err != nil {
+		respondWriteError(c, err, "failed to delete route")
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	c.JSON(http.StatusOK, StatusResponse{Status: "deleted"})
 }
 
 // AddStopHandler - add stop to a route
@@ -135,26 +282,13 @@ func AddStopHandler(c *gin.Context, db *gorm.DB) {
 
 	var payload CreateStopPayload
 	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Ensure route exists
-	var route models.Route
-	if err := db.First(&route, routeID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "route not found"})
-		return
-	}
-
-	stop := models.Stop{
-		RouteID:    uint(routeID),
-		Name:       payload.Name,
-		Latitude:   payload.Latitude,
-		Longitude:  payload.Longitude,
-		OrderIndex: payload.OrderIndex,
-	}
-	if err := db.Create(&stop).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create stop"})
+	stop, err := addStop(c, db, uint(routeID), payload)
+	if err != nil {
+		respondWriteError(c, err, "failed to create stop")
 		return
 	}
 	c.JSON(http.StatusCreated, stop)
@@ -165,38 +299,15 @@ func UpdateStopHandler(c *gin.Context, db *gorm.DB) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
 
-	var payload struct {
-		Name       *string  `json:"name"`
-		Latitude   *float64 `json:"latitude"`
-		Longitude  *float64 `json:"longitude"`
-		OrderIndex *int     `json:"order_index"`
-	}
+	var payload UpdateStopPayload
 	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	var stop models.Stop
-	if err := db.First(&stop, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "stop not found"})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if payload.Name != nil {
-		stop.Name = *payload.Name
-	}
-	if payload.Latitude != nil {
-		stop.Latitude = *payload.Latitude
-	}
-	if payload.Longitude != nil {
-		stop.Longitude = *payload.Longitude
-	}
-	if payload.OrderIndex != nil {
-		stop.OrderIndex = *payload.OrderIndex
-	}
-
-	if err := db.Save(&stop).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update stop"})
+	stop, err := updateStop(c, db, uint(id), payload)
+	if err != nil {
+		respondWriteError(c, err, "failed to update stop")
 		return
 	}
 	c.JSON(http.StatusOK, stop)
@@ -207,11 +318,11 @@ func DeleteStopHandler(c *gin.Context, db *gorm.DB) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
 
-	if err := db.Delete(&models.Stop{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete stop"})
+	if err := deleteStop(c, db, uint(id)); err != nil {
+		respondWriteError(c, err, "failed to delete stop")
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	c.JSON(http.StatusOK, StatusResponse{Status: "deleted"})
 }
 
 // AddScheduleHandler - add schedule to a route
@@ -221,24 +332,13 @@ func AddScheduleHandler(c *gin.Context, db *gorm.DB) {
 
 	var payload CreateScheduleBody
 	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// ensure route
-	var route models.Route
-	if err := db.First(&route, routeID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "route not found"})
-		return
-	}
-
-	sch := models.Schedule{
-		RouteID:      uint(routeID),
-		Departure:    payload.Departure,
-		FrequencyMin: payload.FrequencyMin,
-	}
-	if err := db.Create(&sch).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create schedule"})
+	sch, err := addSchedule(c, db, uint(routeID), payload)
+	if err != nil {
+		respondWriteError(c, err, "failed to create schedule")
 		return
 	}
 	c.JSON(http.StatusCreated, sch)
@@ -249,29 +349,15 @@ func UpdateScheduleHandler(c *gin.Context, db *gorm.DB) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
 
-	var payload struct {
-		Departure    *string `json:"departure"`
-		FrequencyMin *int    `json:"frequency_min"`
-	}
+	var payload UpdateSchedulePayload
 	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var sch models.Schedule
-	if err := db.First(&sch, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
-		return
-	}
-
-	if payload.Departure != nil {
-		sch.Departure = *payload.Departure
-	}
-	if payload.FrequencyMin != nil {
-		sch.FrequencyMin = *payload.FrequencyMin
-	}
-	if err := db.Save(&sch).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update schedule"})
+	sch, err := updateSchedule(c, db, uint(id), payload)
+	if err != nil {
+		respondWriteError(c, err, "failed to update schedule")
 		return
 	}
 	c.JSON(http.StatusOK, sch)
@@ -282,86 +368,9 @@ func DeleteScheduleHandler(c *gin.Context, db *gorm.DB) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
 
-	if err := db.Delete(&models.Schedule{}, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete schedule"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
-}
-
-func UploadCSVHandler(c *gin.Context, db *gorm.DB) {
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "file required"})
-		return
-	}
-
-	src, _ := file.Open()
-	defer src.Close()
-	reader := csv.NewReader(src)
-	reader.TrimLeadingSpace = true
-	records, _ := reader.ReadAll()
-
-	for i, row := range records {
-		if i == 0 { // skip header
-			continue
-		}
-		routeName, description := row[0], row[1]
-		stopName, orderIndexStr := row[2], row[3]
-		departureTime, freqStr := row[4], row[5]
-
-		var route models.Route
-		if err := db.Where("name = ?", routeName).First(&route).Error; err != nil {
-			// route not found, create
-			route = models.Route{Name: routeName, Description: description}
-			db.Create(&route)
-		}
-
-		// create stop
-		orderIndex, _ := strconv.Atoi(orderIndexStr)
-		stop := models.Stop{Name: stopName, OrderIndex: orderIndex, RouteID: route.ID}
-		db.Create(&stop)
-
-		// create schedule
-		freq, _ := strconv.Atoi(freqStr)
-		schedule := models.Schedule{RouteID: route.ID, Departure: departureTime, FrequencyMin: freq}
-		db.Create(&schedule)
-	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "CSV imported successfully"})
-}
-
-// GetRoutesHandler - returns all routes with stops & schedules
-func GetRoutesHandler(c *gin.Context, db *gorm.DB) {
-	var routes []models.Route
-	if err := db.Preload("Stops", func(db *gorm.DB) *gorm.DB {
-		return db.Order("order_index asc")
-	}).Preload("Schedules").Find(&routes).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query routes"})
-		return
-	}
-	c.JSON(http.StatusOK, routes)
-}
-
-// GetRouteByIDHandler - returns a single route
-func GetRouteByIDHandler(c *gin.Context, db *gorm.DB) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
-	}
-
-	var route models.Route
-	if err := db.Preload("Stops", func(db *gorm.DB) *gorm.DB {
-		return db.Order("order_index asc")
-	}).Preload("Schedules").First(&route, id).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "route not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query route"})
+	if err := deleteSchedule(c, db, uint(id)); err != nil {
+		respondWriteError(c, err, "failed to delete schedule")
 		return
 	}
-	c.JSON(http.StatusOK, route)
+	c.JSON(http.StatusOK, StatusResponse{Status: "deleted"})
 }
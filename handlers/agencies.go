@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Agency (tenant) endpoints:
+- GET  /public/agencies     -> list agencies with branding metadata
+- POST /admin/agencies      -> create agency (platform admins only)
+- PUT  /admin/agencies/:id  -> update agency (platform admins only)
+
+Admins with an agency only see and edit that agency's routes; stops and
+schedules belong to the agency of their route. Admins without an agency
+(agency_id 0) are platform admins and see every agency.
+*/
+
+// AgencyIDContextKey holds the agency of the logged-in admin (unset for platform admins)
+const AgencyIDContextKey = "agency_id"
+
+type AgencyPayload struct {
+	Name     string `json:"name" binding:"required"`
+	URL      string `json:"url"`
+	Timezone string `json:"timezone"`
+	Phone    string `json:"phone"`
+}
+
+// tenantID returns the agency of the current admin, 0 for platform admins
+func tenantID(c *gin.Context) uint {
+	return c.GetUint(AgencyIDContextKey)
+}
+
+// routeScope limits route queries to an agency (0 = no limit)
+var routeScope = repository.RouteScope
+
+// routeAgency picks the agency for a new route: the admin's own agency, or
+// the requested one for platform admins
+func routeAgency(c *gin.Context, requested *uint) *uint {
+	if id := tenantID(c); id != 0 {
+		return &id
+	}
+	return requested
+}
+
+// requestedAgency returns the agency a request works on: the admin's own,
+// or ?agency_id= for platform admins
+func requestedAgency(c *gin.Context, db *gorm.DB) (uint, bool) {
+	if id := tenantID(c); id != 0 {
+		return id, true
+	}
+	id, err := strconv.ParseUint(c.Query("agency_id"), 10, 64)
+	if err != nil || id == 0 {
+		respondError(c, http.StatusBadRequest, "agency_id is required for platform admins")
+		return 0, false
+	}
+	if err := db.First(&models.Agency{}, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, "agency not found")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// requirePlatformAdmin rejects admins that belong to an agency
+func requirePlatformAdmin(c *gin.Context) bool {
+	if tenantID(c) != 0 {
+		respondError(c, http.StatusForbidden, "platform admin required")
+		return false
+	}
+	return true
+}
+
+func agencyService(db *gorm.DB) service.AgencyService {
+	return service.NewAgencyService(repository.New(db))
+}
+
+// validTimezone accepts empty or IANA names
+func validTimezone(tz string) bool {
+	if tz == "" {
+		return true
+	}
+	_, err := time.LoadLocation(tz)
+	return err == nil
+}
+
+// PublicGetAgenciesHandler - lists agencies (public)
+func PublicGetAgenciesHandler(c *gin.Context, db *gorm.DB) {
+	var agencies []models.Agency
+	if err := db.Order("name asc").Find(&agencies).Error; err != nil {
+		respondInternalError(c, err, "failed to fetch agencies")
+		return
+	}
+	c.JSON(http.StatusOK, agencies)
+}
+
+// CreateAgencyHandler - creates an agency
+func CreateAgencyHandler(c *gin.Context, db *gorm.DB) {
+	if !requirePlatformAdmin(c) {
+		return
+	}
+
+	var payload AgencyPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validTimezone(payload.Timezone) {
+		respondError(c, http.StatusBadRequest, "invalid timezone")
+		return
+	}
+
+	agency, err := agencyService(db).Create(changeOf(c), models.Agency{
+		Name: payload.Name, URL: payload.URL, Timezone: payload.Timezone, Phone: payload.Phone,
+	})
+	if err != nil {
+		respondWriteError(c, err, "failed to create agency")
+		return
+	}
+	c.JSON(http.StatusCreated, agency)
+}
+
+// UpdateAgencyHandler - replaces agency metadata
+func UpdateAgencyHandler(c *gin.Context, db *gorm.DB) {
+	if !requirePlatformAdmin(c) {
+		return
+	}
+
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	var payload AgencyPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validTimezone(payload.Timezone) {
+		respondError(c, http.StatusBadRequest, "invalid timezone")
+		return
+	}
+
+	agency, err := agencyService(db).Update(changeOf(c), uint(id), func(a *models.Agency) {
+		a.Name, a.URL, a.Timezone, a.Phone = payload.Name, payload.URL, payload.Timezone, payload.Phone
+	})
+	if err != nil {
+		respondWriteError(c, err, "failed to update agency")
+		return
+	}
+	c.JSON(http.StatusOK, agency)
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+API key endpoints (admin):
+- POST   /admin/api-keys           -> issue a key (plain key returned once)
+- GET    /admin/api-keys           -> list keys
+- DELETE /admin/api-keys/:id       -> revoke key
+- GET    /admin/api-keys/:id/usage -> usage per day and endpoint
+
+Keys are not tied to an agency, so only platform admins manage them.
+*/
+
+const (
+	// ScopePublicRead grants access to the /public endpoints
+	ScopePublicRead = "public:read"
+
+	// DefaultAPIKeyRateLimit is used when no rate limit is given (requests per minute)
+	DefaultAPIKeyRateLimit = 600
+
+	apiKeyPrefix = "bus_"
+)
+
+// knownScopes lists the scopes that can be granted to a key
+var knownScopes = map[string]bool{
+	ScopePublicRead: true,
+}
+
+type CreateAPIKeyPayload struct {
+	Name      string   `json:"name" binding:"required"`
+	Owner     string   `json:"owner" binding:"required"`
+	Scopes    []string `json:"scopes"`
+	RateLimit int      `json:"rate_limit"` // requests per minute
+}
+
+func apiKeyService(db *gorm.DB) service.APIKeyService {
+	return service.NewAPIKeyService(repository.New(db))
+}
+
+// GenerateAPIKey returns a new random plain key
+func GenerateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// HashAPIKey hashes a plain key for storage and lookup
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKeyHandler - issues a new key; the plain key is only returned here
+func CreateAPIKeyHandler(c *gin.Context, db *gorm.DB) {
+	if !requirePlatformAdmin(c) {
+		return
+	}
+
+	var payload CreateAPIKeyPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	scopes := payload.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopePublicRead}
+	}
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			respondError(c, http.StatusBadRequest, "unknown scope: "+s)
+			return
+		}
+	}
+	if payload.RateLimit < 0 {
+		respondError(c, http.StatusBadRequest, "rate_limit must be positive")
+		return
+	}
+	if payload.RateLimit == 0 {
+		payload.RateLimit = DefaultAPIKeyRateLimit
+	}
+
+	plain, err := GenerateAPIKey()
+	if err != nil {
+		respondInternalError(c, err, "failed to generate key")
+		return
+	}
+
+	key, err := apiKeyService(db).Create(changeOf(c), models.APIKey{
+		Name:      payload.Name,
+		Owner:     payload.Owner,
+		Prefix:    plain[:len(apiKeyPrefix)+8],
+		KeyHash:   HashAPIKey(plain),
+		Scopes:    strings.Join(scopes, ","),
+		RateLimit: payload.RateLimit,
+	})
+	if err != nil {
+		respondWriteError(c, err, "failed to create api key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreatedAPIKeyResponse{Key: plain, APIKey: key})
+}
+
+// ListAPIKeysHandler - returns all keys (without secrets)
+func ListAPIKeysHandler(c *gin.Context, db *gorm.DB) {
+	if !requirePlatformAdmin(c) {
+		return
+	}
+
+	var keys []models.APIKey
+	if err := db.Order("id asc").Find(&keys).Error; err != nil {
+		respondInternalError(c, err, "failed to query api keys")
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKeyHandler - revokes a key; usage history is kept
+func RevokeAPIKeyHandler(c *gin.Context, db *gorm.DB) {
+	if !requirePlatformAdmin(c) {
+		return
+	}
+
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	if _, err := apiKeyService(db).Revoke(changeOf(c), uint(id)); err != nil {
+		respondWriteError(c, err, "failed to revoke api key")
+		return
+	}
+	c.JSON(http.StatusOK, StatusResponse{Status: "revoked"})
+}
+
+// GetAPIKeyUsageHandler - returns request counts for a key, newest day first
+func GetAPIKeyUsageHandler(c *gin.Context, db *gorm.DB) {
+	if !requirePlatformAdmin(c) {
+		return
+	}
+
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	var key models.APIKey
+	if err := db.First(&key, id).Error; err != nil {
+		respondError(c, http.StatusNotFound, "api key not found")
+		return
+	}
+
+	var usage []models.APIKeyUsage
+	if err := db.Where("api_key_id = ?", key.ID).Order("day desc, path asc").Find(&usage).Error; err != nil {
+		respondInternalError(c, err, "failed to query usage")
+		return
+	}
+	c.JSON(http.StatusOK, APIKeyUsageResponse{APIKey: key, Usage: usage})
+}
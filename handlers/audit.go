@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/service"
+	"busapp/validation"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Audit endpoints (admin):
+- GET  /admin/audit            -> list entries (?entity=&entity_id=&actor=&from=&to=&limit=)
+- POST /admin/audit/:id/revert -> restore the entity to its state before that entry
+*/
+
+// Context keys set by middleware.AuthMiddleware from the JWT claims
+const (
+	AdminIDContextKey       = "admin_id"
+	AdminUsernameContextKey = "admin_username"
+)
+
+// Audited entity names
+const (
+	EntityRoute    = validation.EntityRoute
+	EntityStop     = validation.EntityStop
+	EntitySchedule = validation.EntitySchedule
+	EntityAlert    = service.EntityAlert // not validated, see graphql.go
+)
+
+// Actor is who made a change (see the service package)
+type Actor = service.Actor
+
+// CLIActor is the actor of changes made with the busapp command
+var CLIActor = Actor{Name: "cli"}
+
+// actorOf is the admin making the current request
+func actorOf(c *gin.Context) Actor {
+	return Actor{
+		AgencyID: tenantID(c),
+		ID:       c.GetUint(AdminIDContextKey),
+		Name:     c.GetString(AdminUsernameContextKey),
+		IP:       c.ClientIP(),
+	}
+}
+
+// parseAuditTime accepts RFC3339 timestamps or plain dates
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// ListAuditHandler - returns audit entries, newest first
+func ListAuditHandler(c *gin.Context, db *gorm.DB) {
+	q := db.Model(&models.AuditEntry{})
+	if agencyID := tenantID(c); agencyID != 0 {
+		q = q.Where("agency_id = ?", agencyID)
+	}
+
+	if entity := c.Query("entity"); entity != "" {
+		q = q.Where("entity = ?", entity)
+	}
+	if entityID := c.Query("entity_id"); entityID != "" {
+		q = q.Where("entity_id = ?", entityID)
+	}
+	if actor := c.Query("actor"); actor != "" {
+		if id, err := strconv.Atoi(actor); err == nil {
+			q = q.Where("actor_id = ?", id)
+		} else {
+			q = q.Where("actor_name = ?", actor)
+		}
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := parseAuditTime(from)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid from")
+			return
+		}
+		q = q.Where("created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseAuditTime(to)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid to")
+			return
+		}
+		q = q.Where("created_at <= ?", t)
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	var entries []models.AuditEntry
+	if err := q.Order("id desc").Limit(limit).Find(&entries).Error; err != nil {
+		respondInternalError(c, err, "failed to query audit log")
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// RevertAuditHandler - puts the entity back in the state it had before the
+// given entry (see service.AuditService.Revert)
+func RevertAuditHandler(c *gin.Context, db *gorm.DB) {
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	reverted, err := service.NewAuditService(repository.New(db)).Revert(changeOf(c), uint(id))
+	if err != nil {
+		respondWriteError(c, err, "failed to revert")
+		return
+	}
+	if reverted == nil {
+		c.JSON(http.StatusOK, StatusResponse{Status: "reverted"})
+		return
+	}
+	c.JSON(http.StatusOK, reverted)
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"busapp/models"
+	"busapp/validation"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Route cloning (admin):
+- POST /admin/routes/:id/clone[?dry_run=true] -> copy a route with its stops
+                                                 and schedules
+
+Options: "name"/"description" rename the copy (default "<name> (copy)", or
+"(return)" when reversed), "reverse" flips the stop order for the return
+direction, "schedules" is copy (default), shift (moves every departure by
+"shift_min" minutes) or none. With dry_run the clone is returned as a
+CreateRoutePayload instead of being saved, so it can be edited and posted
+to /admin/routes.
+*/
+
+const (
+	CloneSchedulesCopy  = "copy"
+	CloneSchedulesShift = "shift"
+	CloneSchedulesNone  = "none"
+)
+
+type CloneRoutePayload struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Reverse     bool    `json:"reverse"`
+	Schedules   string  `json:"schedules"` // copy, shift or none
+	ShiftMin    int     `json:"shift_min"`
+}
+
+// clonePayload builds the CreateRoutePayload for a copy of route
+func (p CloneRoutePayload) clonePayload(route models.Route) CreateRoutePayload {
+	out := CreateRoutePayload{
+		AgencyID:    route.AgencyID,
+		Name:        route.Name + " (copy)",
+		Description: route.Description,
+	}
+	if p.Reverse {
+		out.Name = route.Name + " (return)"
+	}
+	if p.Name != nil {
+		out.Name = *p.Name
+	}
+	if p.Description != nil {
+		out.Description = *p.Description
+	}
+
+	// stops are preloaded in order; number the copy 1..n
+	for i := range route.Stops {
+		s := route.Stops[i]
+		if p.Reverse {
+			s = route.Stops[len(route.Stops)-1-i]
+		}
+		out.Stops = append(out.Stops, CreateStopPayload{
+			Name:       s.Name,
+			Latitude:   s.Latitude,
+			Longitude:  s.Longitude,
+			OrderIndex: i + 1,
+		})
+	}
+
+	if p.Schedules == CloneSchedulesNone {
+		return out
+	}
+	for _, sch := range route.Schedules {
+		departure := sch.Departure
+		if p.Schedules == CloneSchedulesShift {
+			departure = shiftDeparture(departure, p.ShiftMin)
+		}
+		out.Schedules = append(out.Schedules, CreateScheduleBody{
+			Departure:    departure,
+			FrequencyMin: sch.FrequencyMin,
+		})
+	}
+	return out
+}
+
+// shiftDeparture moves an HH:MM departure by minutes, wrapping around
+// midnight. Invalid departures are kept as they are for validation to flag.
+func shiftDeparture(departure string, minutes int) string {
+	t, err := time.Parse(validation.DepartureLayout, departure)
+	if err != nil {
+		return departure
+	}
+	return t.Add(time.Duration(minutes) * time.Minute).Format(validation.DepartureLayout)
+}
+
+// CloneRouteHandler - copies a route, optionally reversed and with shifted schedules
+func CloneRouteHandler(c *gin.Context, db *gorm.DB) {
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	var payload CloneRoutePayload
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	switch payload.Schedules {
+	case "":
+		payload.Schedules = CloneSchedulesCopy
+	case CloneSchedulesCopy, CloneSchedulesShift, CloneSchedulesNone:
+	default:
+		respondError(c, http.StatusBadRequest, "schedules must be copy, shift or none")
+		return
+	}
+
+	var source models.Route
+	err := db.Scopes(routeScope(tenantID(c))).Preload("Stops", func(db *gorm.DB) *gorm.DB {
+		return db.Order("order_index asc")
+	}).Preload("Schedules", func(db *gorm.DB) *gorm.DB {
+		return db.Order("departure asc")
+	}).First(&source, id).Error
+	if err != nil {
+		respondError(c, http.StatusNotFound, "route not found")
+		return
+	}
+
+	clone := payload.clonePayload(source)
+	if dryRun, _ := strconv.ParseBool(c.DefaultQuery("dry_run", "false")); dryRun {
+		c.JSON(http.StatusOK, clone)
+		return
+	}
+
+	route, err := routeService(db).Create(changeOf(c), clone.NewRoute())
+	if err != nil {
+		respondWriteError(c, err, "failed to clone route")
+		return
+	}
+	c.JSON(http.StatusCreated, route)
+}
@@ -0,0 +1,611 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/service"
+	"busapp/validation"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+/*
+CSV timetable import:
+- POST /admin/upload-csv           -> import (multipart field "file")
+- POST /admin/upload-csv?dry_run=1 -> validate and report what would change
+
+Routes are imported into the admin's agency, or ?agency_id= for platform admins.
+
+The upload can be a CSV file, a zip of CSV files or an xlsx workbook; each
+file or sheet is a table in the format below, imported in order. A GTFS zip
+is converted to that format first (see gtfs.go). The files
+from GET /admin/export can be imported back as they are.
+
+The first line is a header; columns are matched by name (case-insensitive,
+any order, aliases in parentheses):
+
+	route_name         required (route)
+	route_description  optional (description)
+	stop_name          (stop)
+	stop_lat           required with stop_name (lat, latitude)
+	stop_lon           required with stop_name (lon, lng, longitude)
+	stop_order         optional, defaults to the next index on the route (order, order_index)
+	departure          "HH:MM" (departure_time)
+	frequency_min      minutes, required with departure (frequency)
+
+A row can describe a route only, a stop, a schedule or both. Routes are matched by name,
+stops by route and name, and schedules by route, departure and frequency,
+so importing the same file twice changes nothing. The whole file is imported
+in one transaction: any row error rejects it with the line numbers at fault.
+*/
+
+// maxCSVUploadBytes caps the size of an uploaded timetable
+const maxCSVUploadBytes = 10 << 20
+
+// CSV columns and the header names accepted for them
+const (
+	colRouteName = "route_name"
+	colRouteDesc = "route_description"
+	colStopName  = "stop_name"
+	colStopLat   = "stop_lat"
+	colStopLon   = "stop_lon"
+	colStopOrder = "stop_order"
+	colDeparture = "departure"
+	colFrequency = "frequency_min"
+)
+
+var csvColumnAliases = map[string]string{
+	"route_name": colRouteName, "route": colRouteName,
+	"route_description": colRouteDesc, "description": colRouteDesc,
+	"stop_name": colStopName, "stop": colStopName,
+	"stop_lat": colStopLat, "lat": colStopLat, "latitude": colStopLat,
+	"stop_lon": colStopLon, "lon": colStopLon, "lng": colStopLon, "longitude": colStopLon,
+	"stop_order": colStopOrder, "order": colStopOrder, "order_index": colStopOrder,
+	"departure": colDeparture, "departure_time": colDeparture,
+	"frequency_min": colFrequency, "frequency": colFrequency,
+}
+
+// ImportRowError points at a problem in the uploaded file
+type ImportRowError struct {
+	Sheet   string `json:"sheet,omitempty"` // file or sheet name for multi-table imports
+	Line    int    `json:"line"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportResult summarises an import (or what a dry run would do)
+type ImportResult struct {
+	DryRun           bool               `json:"dry_run"`
+	Rows             int                `json:"rows"`
+	RoutesCreated    int                `json:"routes_created"`
+	RoutesUpdated    int                `json:"routes_updated"`
+	StopsCreated     int                `json:"stops_created"`
+	StopsUpdated     int                `json:"stops_updated"`
+	SchedulesCreated int                `json:"schedules_created"`
+	Errors           []ImportRowError   `json:"errors,omitempty"`
+	Issues           []validation.Issue `json:"issues,omitempty"` // validation of the imported routes
+
+	changes []importChange // for the audit log once committed
+}
+
+type importChange struct {
+	action, entity string
+	id             uint
+	before, after  interface{}
+}
+
+// ErrImportInvalid is returned by ImportSheets when rows failed validation
+var ErrImportInvalid = errors.New("import has invalid rows")
+
+// csvRow is a validated data line
+type csvRow struct {
+	sheet                string
+	line                 int
+	routeName, routeDesc string
+	stopName             string
+	lat, lon             float64
+	order                *int
+	departure            string
+	frequency            int
+}
+
+// UploadCSVHandler - imports a timetable CSV in a single transaction
+func UploadCSVHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "file required")
+		return
+	}
+	if file.Size > maxCSVUploadBytes {
+		respondError(c, http.StatusRequestEntityTooLarge, "file too large")
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "cannot read file")
+		return
+	}
+	defer src.Close()
+
+	sheets, err := ReadImportSheets(file.Filename, src, file.Size)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	result, err := RunImport(db, sheets, &agencyID, strictValidation(c), dryRun, actorOf(c))
+
+	switch {
+	case respondValidationFailure(c, err):
+		return
+	case errors.Is(err, ErrImportInvalid):
+		if apiV1(c) {
+			respondError(c, http.StatusUnprocessableEntity, "import has errors", result)
+		} else {
+			c.JSON(http.StatusUnprocessableEntity, result)
+		}
+		return
+	case err != nil:
+		respondInternalError(c, err, "failed to import csv")
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// RunImport imports sheets in one transaction (see ImportSheets), recording
+// the changes in the audit log as actor. A dry run rolls everything back and
+// reports what would change.
+func RunImport(db *gorm.DB, sheets []ImportSheet, agencyID *uint, strict, dryRun bool, actor Actor) (ImportResult, error) {
+	var result ImportResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = ImportSheets(tx, sheets, agencyID, strict)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return errPreviewRollback
+		}
+		for _, ch := range result.changes {
+			if err := service.RecordAudit(repository.New(tx), actor, ch.action, ch.entity, ch.id, ch.before, ch.after); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	result.DryRun = dryRun
+	if errors.Is(err, errPreviewRollback) {
+		return result, nil
+	}
+	return result, err
+}
+
+// ReadImportSheets opens an upload as CSV, a zip of CSV files, an xlsx
+// workbook (one table per file or sheet, imported in order) or a GTFS feed
+// (see gtfs.go)
+func ReadImportSheets(filename string, src multipart.File, size int64) ([]ImportSheet, error) {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".xlsx":
+		book, err := excelize.OpenReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read workbook: %w", err)
+		}
+		defer book.Close()
+
+		var sheets []ImportSheet
+		for _, name := range book.GetSheetList() {
+			rows, err := book.GetRows(name)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read sheet %s: %w", name, err)
+			}
+			if len(rows) > 0 {
+				sheets = append(sheets, RecordsSheet(name, rows))
+			}
+		}
+		return sheets, nil
+
+	case ".zip":
+		archive, err := zip.NewReader(src, size)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read zip: %w", err)
+		}
+		if IsGTFS(archive) {
+			return ReadGTFS(archive)
+		}
+		var sheets []ImportSheet
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() || strings.ToLower(path.Ext(f.Name)) != ".csv" {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s: %w", f.Name, err)
+			}
+			// zip entries are small; read them now so nothing stays open
+			data, err := io.ReadAll(io.LimitReader(r, maxCSVUploadBytes))
+			r.Close()
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s: %w", f.Name, err)
+			}
+			sheets = append(sheets, CSVSheet(f.Name, bytes.NewReader(data)))
+		}
+		return sheets, nil
+	}
+	return []ImportSheet{CSVSheet("", src)}, nil
+}
+
+// ImportSheet is one table of an import: a CSV file, a zip entry or a
+// workbook sheet. Read returns the next record with its 1-based line number,
+// and io.EOF once done.
+type ImportSheet struct {
+	Name string
+	Read func() (record []string, line int, err error)
+}
+
+// CSVSheet reads an import table from CSV
+func CSVSheet(name string, r io.Reader) ImportSheet {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	return ImportSheet{Name: name, Read: func() ([]string, int, error) {
+		record, err := reader.Read()
+		var line int
+		var perr *csv.ParseError
+		switch {
+		case err == nil:
+			line, _ = reader.FieldPos(0)
+		case errors.As(err, &perr):
+			line = perr.Line
+		}
+		return record, line, err
+	}}
+}
+
+// RecordsSheet reads an import table from rows already in memory (e.g. xlsx)
+func RecordsSheet(name string, records [][]string) ImportSheet {
+	i := 0
+	return ImportSheet{Name: name, Read: func() ([]string, int, error) {
+		if i >= len(records) {
+			return nil, 0, io.EOF
+		}
+		i++
+		return records[i-1], i, nil
+	}}
+}
+
+// ImportCSV validates and applies a single timetable CSV using tx (see ImportSheets)
+func ImportCSV(tx *gorm.DB, r io.Reader, agencyID *uint, strict bool) (ImportResult, error) {
+	return ImportSheets(tx, []ImportSheet{CSVSheet("", r)}, agencyID, strict)
+}
+
+// ImportSheets validates every sheet (see the column spec above), then applies
+// them in order using tx. New routes are given agencyID; existing routes are
+// only matched within that agency. It returns ErrImportInvalid, with
+// result.Errors set, when any row is invalid; nothing is written in that case.
+// The imported routes are then checked by the validation rules; in strict
+// mode any error fails the import with a *service.ValidationError.
+func ImportSheets(tx *gorm.DB, sheets []ImportSheet, agencyID *uint, strict bool) (ImportResult, error) {
+	var result ImportResult
+	var rows []csvRow
+	for _, sheet := range sheets {
+		sheetRows, count, errs := parseSheet(sheet)
+		rows = append(rows, sheetRows...)
+		result.Rows += count
+		result.Errors = append(result.Errors, errs...)
+	}
+	if len(result.Errors) > 0 {
+		return result, ErrImportInvalid
+	}
+
+	routeIDs, err := applyCSVRows(tx, rows, agencyID, &result)
+	if err != nil {
+		return result, err
+	}
+
+	if len(routeIDs) > 0 {
+		issues, err := service.ValidateRoutes(repository.New(tx), 0, routeIDs...)
+		if err != nil {
+			return result, err
+		}
+		result.Issues = issues
+		if errs := validation.Errors(issues); len(errs) > 0 && strict {
+			return result, &service.ValidationError{Issues: errs}
+		}
+	}
+	return result, nil
+}
+
+// parseSheet validates a sheet, returning its valid rows, the number of data
+// lines and the errors found
+func parseSheet(sheet ImportSheet) ([]csvRow, int, []ImportRowError) {
+	var errs []ImportRowError
+	fail := func(line int, msg string) {
+		errs = append(errs, ImportRowError{Sheet: sheet.Name, Line: line, Message: msg})
+	}
+
+	header, _, err := sheet.Read()
+	if err != nil {
+		fail(1, "missing header: "+err.Error())
+		return nil, 0, errs
+	}
+	columns, headerErrs := mapCSVHeader(header)
+	if len(headerErrs) > 0 {
+		for _, e := range headerErrs {
+			e.Sheet = sheet.Name
+			errs = append(errs, e)
+		}
+		return nil, 0, errs
+	}
+
+	var rows []csvRow
+	count := 0
+	for {
+		record, line, err := sheet.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(line, err.Error())
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				count++
+				continue
+			}
+			break
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+		count++
+		row, rowErrs := parseCSVRow(line, record, columns)
+		row.sheet = sheet.Name
+		for _, e := range rowErrs {
+			e.Sheet = sheet.Name
+			errs = append(errs, e)
+		}
+		if len(rowErrs) == 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows, count, errs
+}
+
+// mapCSVHeader resolves header names to column positions
+func mapCSVHeader(header []string) (map[string]int, []ImportRowError) {
+	columns := map[string]int{}
+	var errs []ImportRowError
+	for i, h := range header {
+		name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		col, ok := csvColumnAliases[name]
+		if !ok {
+			errs = append(errs, ImportRowError{Line: 1, Column: h, Message: "unknown column"})
+			continue
+		}
+		if _, dup := columns[col]; dup {
+			errs = append(errs, ImportRowError{Line: 1, Column: h, Message: "duplicate column"})
+			continue
+		}
+		columns[col] = i
+	}
+
+	has := func(col string) bool { _, ok := columns[col]; return ok }
+	if !has(colRouteName) {
+		errs = append(errs, ImportRowError{Line: 1, Column: colRouteName, Message: "required column missing"})
+	}
+	if has(colStopName) && (!has(colStopLat) || !has(colStopLon)) {
+		errs = append(errs, ImportRowError{Line: 1, Column: colStopName, Message: "stop_lat and stop_lon columns are required with stop_name"})
+	}
+	if has(colDeparture) != has(colFrequency) {
+		errs = append(errs, ImportRowError{Line: 1, Column: colDeparture, Message: "departure and frequency_min go together"})
+	}
+	return columns, errs
+}
+
+// parseCSVRow validates one data line
+func parseCSVRow(line int, record []string, columns map[string]int) (csvRow, []ImportRowError) {
+	get := func(col string) string {
+		i, ok := columns[col]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	var errs []ImportRowError
+	fail := func(col, msg string) {
+		errs = append(errs, ImportRowError{Line: line, Column: col, Message: msg})
+	}
+
+	row := csvRow{
+		line:      line,
+		routeName: get(colRouteName),
+		routeDesc: get(colRouteDesc),
+		stopName:  get(colStopName),
+		departure: get(colDeparture),
+	}
+	if row.routeName == "" {
+		fail(colRouteName, "required")
+	}
+
+	latStr, lonStr, orderStr := get(colStopLat), get(colStopLon), get(colStopOrder)
+	if row.stopName == "" && (latStr != "" || lonStr != "" || orderStr != "") {
+		fail(colStopName, "required when stop fields are set")
+	}
+	if row.stopName != "" {
+		var err error
+		// negated comparisons so that NaN is out of range too
+		if row.lat, err = strconv.ParseFloat(latStr, 64); err != nil || !(row.lat >= -90 && row.lat <= 90) {
+			fail(colStopLat, "must be a latitude between -90 and 90")
+		}
+		if row.lon, err = strconv.ParseFloat(lonStr, 64); err != nil || !(row.lon >= -180 && row.lon <= 180) {
+			fail(colStopLon, "must be a longitude between -180 and 180")
+		}
+		if orderStr != "" {
+			order, err := strconv.Atoi(orderStr)
+			if err != nil || order < 0 {
+				fail(colStopOrder, "must be a non-negative integer")
+			}
+			row.order = &order
+		}
+	}
+
+	freqStr := get(colFrequency)
+	if row.departure != "" || freqStr != "" {
+		if t, err := time.Parse(validation.DepartureLayout, row.departure); err != nil {
+			fail(colDeparture, "must be HH:MM")
+		} else {
+			row.departure = t.Format(validation.DepartureLayout)
+		}
+		freq, err := strconv.Atoi(freqStr)
+		if err != nil || freq <= 0 {
+			fail(colFrequency, "must be a positive integer")
+		}
+		row.frequency = freq
+	}
+	return row, errs
+}
+
+// applyCSVRows upserts routes, stops and schedules from validated rows and
+// returns the IDs of the routes touched
+func applyCSVRows(tx *gorm.DB, rows []csvRow, agencyID *uint, result *ImportResult) ([]uint, error) {
+	var scope uint
+	if agencyID != nil {
+		scope = *agencyID
+	}
+	routes := map[string]*models.Route{}
+	var routeIDs []uint
+	nextOrder := map[uint]int{}
+
+	for _, row := range rows {
+		route, ok := routes[row.routeName]
+		if !ok {
+			route = &models.Route{}
+			err := tx.Scopes(routeScope(scope)).Where("name = ?", row.routeName).First(route).Error
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				*route = models.Route{AgencyID: agencyID, Name: row.routeName, Description: row.routeDesc}
+				if err := tx.Create(route).Error; err != nil {
+					return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+				}
+				result.RoutesCreated++
+				result.changes = append(result.changes, importChange{models.AuditCreate, EntityRoute, route.ID, nil, *route})
+			case err != nil:
+				return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+			}
+
+			var maxOrder int
+			err = tx.Model(&models.Stop{}).Where("route_id = ?", route.ID).Select("COALESCE(MAX(order_index), 0)").Scan(&maxOrder).Error
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+			}
+			nextOrder[route.ID] = maxOrder + 1
+			routes[row.routeName] = route
+			routeIDs = append(routeIDs, route.ID)
+		}
+
+		if row.routeDesc != "" && route.Description != row.routeDesc {
+			before := *route
+			route.Description = row.routeDesc
+			if err := tx.Model(route).Update("description", row.routeDesc).Error; err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+			}
+			result.RoutesUpdated++
+			result.changes = append(result.changes, importChange{models.AuditUpdate, EntityRoute, route.ID, before, *route})
+		}
+
+		if row.stopName != "" {
+			if err := upsertCSVStop(tx, route.ID, row, nextOrder, result); err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+			}
+		}
+
+		if row.departure != "" {
+			var count int64
+			err := tx.Model(&models.Schedule{}).
+				Where("route_id = ? AND departure = ? AND frequency_min = ?", route.ID, row.departure, row.frequency).
+				Count(&count).Error
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+			}
+			if count == 0 {
+				sch := models.Schedule{RouteID: route.ID, Departure: row.departure, FrequencyMin: row.frequency}
+				if err := tx.Create(&sch).Error; err != nil {
+					return nil, fmt.Errorf("%s line %d: %w", row.sheet, row.line, err)
+				}
+				result.SchedulesCreated++
+				result.changes = append(result.changes, importChange{models.AuditCreate, EntitySchedule, sch.ID, nil, sch})
+			}
+		}
+	}
+	return routeIDs, nil
+}
+
+// upsertCSVStop creates the stop or updates its position and order
+func upsertCSVStop(tx *gorm.DB, routeID uint, row csvRow, nextOrder map[uint]int, result *ImportResult) error {
+	var stop models.Stop
+	err := tx.Where("route_id = ? AND name = ?", routeID, row.stopName).First(&stop).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		order := nextOrder[routeID]
+		if row.order != nil {
+			order = *row.order
+		}
+		if order >= nextOrder[routeID] {
+			nextOrder[routeID] = order + 1
+		}
+		stop = models.Stop{RouteID: routeID, Name: row.stopName, Latitude: row.lat, Longitude: row.lon, OrderIndex: order}
+		if err := tx.Create(&stop).Error; err != nil {
+			return err
+		}
+		result.StopsCreated++
+		result.changes = append(result.changes, importChange{models.AuditCreate, EntityStop, stop.ID, nil, stop})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	before := stop
+	stop.Latitude, stop.Longitude = row.lat, row.lon
+	if row.order != nil {
+		stop.OrderIndex = *row.order
+	}
+	if stop == before {
+		return nil
+	}
+	if err := tx.Save(&stop).Error; err != nil {
+		return err
+	}
+	result.StopsUpdated++
+	result.changes = append(result.changes, importChange{models.AuditUpdate, EntityStop, stop.ID, before, stop})
+	return nil
+}
+
+func isBlankRecord(record []string) bool {
+	for _, f := range record {
+		if strings.TrimSpace(f) != "" {
+			return false
+		}
+	}
+	return true
+}
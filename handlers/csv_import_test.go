@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"busapp/validation"
+)
+
+func FuzzParseSheet(f *testing.F) {
+	f.Add("route_name,stop_name,stop_lat,stop_lon,stop_order,departure,frequency_min\nLine 1,Central,6.45,3.39,1,06:00,15\n")
+	f.Add("route_name,route_desc\n\"Line, 2\",\"multi\nline\"\n")
+	f.Add("\ufeffRoute,Stop,Lat,Lon\nA,B,NaN,1\n")
+	f.Add("route_name,departure,frequency_min\nA,6:5,0\nA,25:00,-1\n\"unterminated\n")
+	f.Add("route_name,route_name\n")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		rows, count, errs := parseSheet(CSVSheet("fuzz", strings.NewReader(data)))
+		if len(rows) > count {
+			t.Fatalf("%d rows out of %d data lines", len(rows), count)
+		}
+		for _, e := range errs {
+			if e.Sheet != "fuzz" || e.Line < 1 || e.Message == "" {
+				t.Fatalf("malformed error %+v", e)
+			}
+		}
+		for _, r := range rows {
+			if r.routeName == "" {
+				t.Fatalf("line %d: row without route name", r.line)
+			}
+			if r.stopName != "" && !(r.lat >= -90 && r.lat <= 90 && r.lon >= -180 && r.lon <= 180) {
+				t.Fatalf("line %d: stop at %v,%v", r.line, r.lat, r.lon)
+			}
+			if r.order != nil && *r.order < 0 {
+				t.Fatalf("line %d: order %d", r.line, *r.order)
+			}
+			if r.departure != "" {
+				if _, err := time.Parse(validation.DepartureLayout, r.departure); err != nil || r.frequency <= 0 {
+					t.Fatalf("line %d: schedule %q every %d", r.line, r.departure, r.frequency)
+				}
+			}
+		}
+	})
+}
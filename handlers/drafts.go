@@ -0,0 +1,534 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"busapp/config"
+	"busapp/models"
+	"busapp/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+/*
+Draft & publish endpoints (admin):
+- POST   /admin/drafts            -> stage a change to a route, stop or schedule
+- GET    /admin/drafts            -> list staged changes
+- DELETE /admin/drafts/:id        -> discard a staged change
+- GET    /admin/drafts/preview    -> public route list as it would look once published
+- POST   /admin/drafts/publish    -> publish all staged changes as a new version
+                                     (optionally with a future effective_at)
+- GET    /admin/versions          -> list published versions
+- POST   /admin/versions/rollback -> go back to the previously published version
+
+Drafts and versions are kept per agency; platform admins pick the agency
+with ?agency_id=. The first publish also records a "baseline" version holding the network as it
+was before, so that it can be rolled back too.
+
+Published changes go through the services like any other write, so they are
+validated (strict mode rejects the whole publish) and audited one by one.
+*/
+
+// errPreviewRollback is returned from a transaction to discard it on purpose
+var errPreviewRollback = errors.New("preview rollback")
+
+var (
+	errNoDrafts          = errors.New("no staged changes")
+	errNoLiveVersion     = errors.New("no live version")
+	errNoPreviousVersion = errors.New("no previous version to roll back to")
+)
+
+type StageDraftPayload struct {
+	Entity   string          `json:"entity" binding:"required"`
+	Action   string          `json:"action" binding:"required"`
+	EntityID uint            `json:"entity_id"` // for update/delete
+	RouteID  uint            `json:"route_id"`  // for stop/schedule create
+	Data     json.RawMessage `json:"data"`
+}
+
+type PublishPayload struct {
+	Note        string     `json:"note"`
+	EffectiveAt *time.Time `json:"effective_at"` // RFC3339; empty = now
+}
+
+// draftChange describes the writes of drafts of agencyID by the current admin
+func draftChange(c *gin.Context, agencyID uint, strict bool) service.Change {
+	ch := service.Change{Actor: actorOf(c), Strict: strict}
+	ch.Actor.AgencyID = agencyID
+	return ch
+}
+
+// respondDraftError answers an error of publishing, previewing or rolling back
+func respondDraftError(c *gin.Context, err error, fallback string) {
+	var se *service.Error
+	switch {
+	case errors.Is(err, errNoDrafts), errors.Is(err, errNoLiveVersion), errors.Is(err, errNoPreviousVersion):
+		respondError(c, http.StatusConflict, err.Error())
+	case errors.As(err, &se):
+		// a staged change that no longer applies
+		respondError(c, http.StatusConflict, err.Error())
+	case respondValidationFailure(c, err):
+	default:
+		respondInternalError(c, err, fallback)
+	}
+}
+
+// StageDraftHandler - validates and stores a change without touching live data
+func StageDraftHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	var payload StageDraftPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	change := models.DraftChange{
+		AgencyID:  agencyID,
+		Entity:    payload.Entity,
+		EntityID:  payload.EntityID,
+		RouteID:   payload.RouteID,
+		Action:    payload.Action,
+		Data:      payload.Data,
+		CreatedBy: c.GetString(AdminUsernameContextKey),
+	}
+	if len(change.Data) == 0 {
+		change.Data = json.RawMessage("null")
+	}
+
+	// dry-run the change so bad drafts are rejected now rather than at publish
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := applyDraftChange(tx, change, draftChange(c, agencyID, strictValidation(c))); err != nil {
+			return err
+		}
+		return errPreviewRollback
+	})
+	if err != nil && !errors.Is(err, errPreviewRollback) {
+		respondWriteError(c, err, "failed to check change")
+		return
+	}
+
+	if err := db.Create(&change).Error; err != nil {
+		respondInternalError(c, err, "failed to stage change")
+		return
+	}
+	c.JSON(http.StatusCreated, change)
+}
+
+// ListDraftsHandler - returns staged changes in the order they will be applied
+func ListDraftsHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	var changes []models.DraftChange
+	if err := db.Where("agency_id = ?", agencyID).Order("id asc").Find(&changes).Error; err != nil {
+		respondInternalError(c, err, "failed to query drafts")
+		return
+	}
+	c.JSON(http.StatusOK, changes)
+}
+
+// DiscardDraftHandler - removes a staged change
+func DiscardDraftHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	res := db.Where("agency_id = ?", agencyID).Delete(&models.DraftChange{}, id)
+	if res.Error != nil {
+		respondInternalError(c, res.Error, "failed to discard draft")
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondError(c, http.StatusNotFound, "draft not found")
+		return
+	}
+	c.JSON(http.StatusOK, StatusResponse{Status: "discarded"})
+}
+
+// PreviewDraftsHandler - applies the drafts in a transaction that is rolled back
+func PreviewDraftsHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	var routes []models.Route
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := applyDrafts(tx, agencyID, draftChange(c, agencyID, false)); err != nil {
+			return err
+		}
+		var err error
+		if routes, err = loadNetwork(tx, agencyID); err != nil {
+			return err
+		}
+		return errPreviewRollback
+	})
+	if err != nil && !errors.Is(err, errPreviewRollback) {
+		respondDraftError(c, err, "failed to preview drafts")
+		return
+	}
+	c.JSON(http.StatusOK, routes)
+}
+
+// PublishDraftsHandler - publishes all drafts atomically as a new version.
+// With a future effective_at the version is scheduled and goes live when
+// ActivateDueVersions next runs after that time.
+func PublishDraftsHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	var payload PublishPayload
+	if err := c.ShouldBindJSON(&payload); err != nil && !errors.Is(err, io.EOF) {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	effective := now
+	if payload.EffectiveAt != nil && payload.EffectiveAt.After(now) {
+		effective = *payload.EffectiveAt
+	}
+
+	ch := draftChange(c, agencyID, strictValidation(c))
+	var version models.NetworkVersion
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var changes []models.DraftChange
+		if err := tx.Where("agency_id = ?", agencyID).Order("id asc").Find(&changes).Error; err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return errNoDrafts
+		}
+		if err := ensureBaselineVersion(tx, agencyID); err != nil {
+			return err
+		}
+
+		number, err := nextVersionNumber(tx, agencyID)
+		if err != nil {
+			return err
+		}
+		raw, _ := json.Marshal(changes)
+		version = models.NetworkVersion{
+			AgencyID:    agencyID,
+			Number:      number,
+			Status:      models.VersionScheduled,
+			Note:        payload.Note,
+			EffectiveAt: effective,
+			PublishedBy: c.GetString(AdminUsernameContextKey),
+			Changes:     raw,
+		}
+
+		if effective.After(now) {
+			// make sure the changes apply cleanly before scheduling them
+			err := tx.Transaction(func(sp *gorm.DB) error {
+				if err := applyChanges(sp, changes, ch); err != nil {
+					return err
+				}
+				return errPreviewRollback
+			})
+			if err != nil && !errors.Is(err, errPreviewRollback) {
+				return err
+			}
+			if err := tx.Create(&version).Error; err != nil {
+				return err
+			}
+		} else {
+			if err := tx.Create(&version).Error; err != nil {
+				return err
+			}
+			if err := activateVersion(tx, &version, ch); err != nil {
+				return err
+			}
+		}
+
+		return tx.Where("id IN ?", draftIDs(changes)).Delete(&models.DraftChange{}).Error
+	})
+	if err != nil {
+		respondDraftError(c, err, "failed to publish drafts")
+		return
+	}
+	c.JSON(http.StatusCreated, version)
+}
+
+// ListVersionsHandler - returns published versions, newest first (without snapshots)
+func ListVersionsHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	var versions []models.NetworkVersion
+	if err := db.Omit("snapshot").Where("agency_id = ?", agencyID).Order("number desc").Find(&versions).Error; err != nil {
+		respondInternalError(c, err, "failed to query versions")
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// RollbackVersionHandler - restores the version that was live before the current one
+func RollbackVersionHandler(c *gin.Context, db *gorm.DB) {
+	agencyID, ok := requestedAgency(c, db)
+	if !ok {
+		return
+	}
+	var restored models.NetworkVersion
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current models.NetworkVersion
+		err := tx.Where("agency_id = ? AND status = ?", agencyID, models.VersionLive).Order("number desc").First(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errNoLiveVersion
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.Where("agency_id = ? AND status = ? AND number < ?", agencyID, models.VersionSuperseded, current.Number).
+			Order("number desc").First(&restored).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errNoPreviousVersion
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := restoreNetwork(tx, draftChange(c, agencyID, strictValidation(c)), restored.Snapshot); err != nil {
+			return err
+		}
+		if err := tx.Model(&current).Update("status", models.VersionRolledBack).Error; err != nil {
+			return err
+		}
+		return tx.Model(&restored).Update("status", models.VersionLive).Error
+	})
+	if err != nil {
+		respondDraftError(c, err, "failed to roll back")
+		return
+	}
+	restored.Snapshot = nil
+	c.JSON(http.StatusOK, restored)
+}
+
+// ActivateDueVersions makes scheduled versions whose effective date has
+// passed live, oldest first, on behalf of their publishers. A version that
+// cannot be activated is marked failed and does not hold up the others; the
+// errors are returned together. Meant to be called periodically.
+func ActivateDueVersions(db *gorm.DB) error {
+	var due []models.NetworkVersion
+	if err := db.Where("status = ? AND effective_at <= ?", models.VersionScheduled, time.Now()).
+		Order("number asc").Find(&due).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for i := range due {
+		ch := service.Change{
+			Actor:  service.Actor{AgencyID: due[i].AgencyID, Name: due[i].PublishedBy},
+			Strict: config.Get().ValidationStrict,
+		}
+		err := db.Transaction(func(tx *gorm.DB) error { return activateVersion(tx, &due[i], ch) })
+		if err == nil {
+			continue
+		}
+		slog.Error("version activation failed", "agency_id", due[i].AgencyID, "version", due[i].Number, "err", err)
+		err = fmt.Errorf("activate version %d of agency %d: %w", due[i].Number, due[i].AgencyID, err)
+		if markErr := db.Model(&due[i]).Update("status", models.VersionFailed).Error; markErr != nil {
+			err = errors.Join(err, fmt.Errorf("mark version %d failed: %w", due[i].Number, markErr))
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// activateVersion applies the version's changes as ch, snapshots the result
+// and supersedes the previously live version
+func activateVersion(tx *gorm.DB, version *models.NetworkVersion, ch service.Change) error {
+	var changes []models.DraftChange
+	if err := json.Unmarshal(version.Changes, &changes); err != nil {
+		return err
+	}
+	if err := applyChanges(tx, changes, ch); err != nil {
+		return err
+	}
+
+	routes, err := loadNetwork(tx, version.AgencyID)
+	if err != nil {
+		return err
+	}
+	snap, _ := json.Marshal(routes)
+
+	if err := tx.Model(&models.NetworkVersion{}).Where("agency_id = ? AND status = ?", version.AgencyID, models.VersionLive).
+		Update("status", models.VersionSuperseded).Error; err != nil {
+		return err
+	}
+	version.Status = models.VersionLive
+	version.Snapshot = snap
+	return tx.Model(version).Updates(map[string]interface{}{"status": version.Status, "snapshot": snap}).Error
+}
+
+// ensureBaselineVersion records the agency's current network as version 1 if
+// nothing was published for it yet
+func ensureBaselineVersion(tx *gorm.DB, agencyID uint) error {
+	var count int64
+	if err := tx.Model(&models.NetworkVersion{}).Where("agency_id = ?", agencyID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	routes, err := loadNetwork(tx, agencyID)
+	if err != nil {
+		return err
+	}
+	snap, _ := json.Marshal(routes)
+	return tx.Create(&models.NetworkVersion{
+		AgencyID:    agencyID,
+		Number:      1,
+		Status:      models.VersionLive,
+		Note:        "baseline",
+		EffectiveAt: time.Now(),
+		Changes:     json.RawMessage("[]"),
+		Snapshot:    snap,
+	}).Error
+}
+
+func nextVersionNumber(tx *gorm.DB, agencyID uint) (int, error) {
+	var max int
+	err := tx.Model(&models.NetworkVersion{}).Where("agency_id = ?", agencyID).Select("COALESCE(MAX(number), 0)").Scan(&max).Error
+	return max + 1, err
+}
+
+func draftIDs(changes []models.DraftChange) []uint {
+	ids := make([]uint, len(changes))
+	for i, ch := range changes {
+		ids[i] = ch.ID
+	}
+	return ids
+}
+
+// loadNetwork returns the agency's routes with ordered stops and schedules
+func loadNetwork(tx *gorm.DB, agencyID uint) ([]models.Route, error) {
+	var routes []models.Route
+	err := tx.Scopes(routeScope(agencyID)).Preload("Stops", func(db *gorm.DB) *gorm.DB {
+		return db.Order("order_index asc")
+	}).Preload("Schedules").Order("id asc").Find(&routes).Error
+	return routes, err
+}
+
+// restoreNetwork replaces the routes, stops and schedules of the agency of
+// ch with a snapshot (see service.RouteService.ReplaceNetwork)
+func restoreNetwork(tx *gorm.DB, ch service.Change, snapshot json.RawMessage) error {
+	var routes []models.Route
+	if err := json.Unmarshal(snapshot, &routes); err != nil {
+		return err
+	}
+	return routeService(tx).ReplaceNetwork(ch, routes)
+}
+
+// applyDrafts applies every staged change of the agency in order
+func applyDrafts(tx *gorm.DB, agencyID uint, ch service.Change) error {
+	var changes []models.DraftChange
+	if err := tx.Where("agency_id = ?", agencyID).Order("id asc").Find(&changes).Error; err != nil {
+		return err
+	}
+	return applyChanges(tx, changes, ch)
+}
+
+func applyChanges(tx *gorm.DB, changes []models.DraftChange, ch service.Change) error {
+	for _, draft := range changes {
+		if err := applyDraftChange(tx, draft, ch); err != nil {
+			return fmt.Errorf("draft %d: %w", draft.ID, err)
+		}
+	}
+	return nil
+}
+
+// applyDraftChange performs a single staged change against tx as a write
+// of ch (see the service package): limited to the actor's agency, validated
+// and audited
+func applyDraftChange(tx *gorm.DB, draft models.DraftChange, ch service.Change) error {
+	routes, schedules := routeService(tx), scheduleService(tx)
+
+	switch draft.Entity + ":" + draft.Action {
+	case EntityRoute + ":" + models.AuditCreate:
+		var p CreateRoutePayload
+		if err := decodeDraftData(draft.Data, &p); err != nil {
+			return err
+		}
+		_, err := routes.Create(ch, p.NewRoute())
+		return err
+
+	case EntityRoute + ":" + models.AuditUpdate:
+		var p UpdateRoutePayload
+		if err := decodeDraftData(draft.Data, &p); err != nil {
+			return err
+		}
+		_, err := routes.Update(ch, draft.EntityID, p.Apply)
+		return err
+
+	case EntityRoute + ":" + models.AuditDelete:
+		return routes.Delete(ch, draft.EntityID)
+
+	case EntityStop + ":" + models.AuditCreate:
+		var p CreateStopPayload
+		if err := decodeDraftData(draft.Data, &p); err != nil {
+			return err
+		}
+		_, err := routes.AddStop(ch, p.NewStop(draft.RouteID), p.AfterStopID)
+		return err
+
+	case EntityStop + ":" + models.AuditUpdate:
+		var p UpdateStopPayload
+		if err := decodeDraftData(draft.Data, &p); err != nil {
+			return err
+		}
+		_, err := routes.UpdateStop(ch, draft.EntityID, p.Apply)
+		return err
+
+	case EntityStop + ":" + models.AuditDelete:
+		return routes.DeleteStop(ch, draft.EntityID)
+
+	case EntitySchedule + ":" + models.AuditCreate:
+		var p CreateScheduleBody
+		if err := decodeDraftData(draft.Data, &p); err != nil {
+			return err
+		}
+		_, err := schedules.Add(ch, p.NewSchedule(draft.RouteID))
+		return err
+
+	case EntitySchedule + ":" + models.AuditUpdate:
+		var p UpdateSchedulePayload
+		if err := decodeDraftData(draft.Data, &p); err != nil {
+			return err
+		}
+		_, err := schedules.Update(ch, draft.EntityID, p.Apply)
+		return err
+
+	case EntitySchedule + ":" + models.AuditDelete:
+		return schedules.Delete(ch, draft.EntityID)
+	}
+	return service.Invalid(fmt.Sprintf("unsupported change %s %s", draft.Action, draft.Entity))
+}
+
+// decodeDraftData unmarshals and validates a staged payload like ShouldBindJSON would
+func decodeDraftData(data json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return service.Invalid(err.Error())
+	}
+	if err := binding.Validator.ValidateStruct(v); err != nil {
+		return service.Invalid(err.Error())
+	}
+	return nil
+}
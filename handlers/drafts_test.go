@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"busapp/models"
+)
+
+func TestActivateDueVersionsGoesOnAfterAFailure(t *testing.T) {
+	gdb, _ := newGraphDB(t, 1) // route 1 in agency 1, route 2 in agency 2
+	version := func(agencyID uint, number int, change models.DraftChange) *models.NetworkVersion {
+		changes, _ := json.Marshal([]models.DraftChange{change})
+		v := &models.NetworkVersion{AgencyID: agencyID, Number: number, Status: models.VersionScheduled,
+			EffectiveAt: time.Now().Add(-time.Minute), PublishedBy: "tester", Changes: changes}
+		if err := gdb.Create(v).Error; err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// agency 2 cannot delete route 1, and its version comes first
+	broken := version(2, 1, models.DraftChange{Entity: EntityRoute, EntityID: 1, Action: models.AuditDelete})
+	valid := version(1, 2, models.DraftChange{Entity: EntityRoute, EntityID: 1, Action: models.AuditUpdate,
+		Data: json.RawMessage(`{"name": "Renamed"}`)})
+
+	if err := ActivateDueVersions(gdb); err == nil {
+		t.Fatal("no error for the broken version")
+	}
+	for v, want := range map[*models.NetworkVersion]string{broken: models.VersionFailed, valid: models.VersionLive} {
+		var got models.NetworkVersion
+		if err := gdb.First(&got, v.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != want {
+			t.Errorf("version %d of agency %d is %s, want %s", got.Number, got.AgencyID, got.Status, want)
+		}
+	}
+	var route models.Route
+	if err := gdb.First(&route, 1).Error; err != nil || route.Name != "Renamed" {
+		t.Errorf("route 1: %q, %v; want it renamed", route.Name, err)
+	}
+
+	// failed versions are not retried
+	if err := ActivateDueVersions(gdb); err != nil {
+		t.Errorf("second run: %v", err)
+	}
+}
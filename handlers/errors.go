@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Error responses.
+
+Under /api/v1 every error uses one envelope:
+
+	{"error": {"code": "not_found", "message": "route not found", "details": ..., "request_id": "..."}}
+
+The legacy (unversioned) paths keep their old {"error": "message"} body,
+with the issues of a validation failure next to it, until they are removed.
+*/
+
+// Context keys set by middleware.APIVersion and middleware.RequestID
+const (
+	APIVersionContextKey = "api_version"
+	RequestIDContextKey  = "request_id"
+)
+
+// APIVersionV1 is the current API version, served under /api/v1
+const APIVersionV1 = "v1"
+
+// Error codes
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodePayloadTooLarge  = "payload_too_large"
+	CodeValidationFailed = "validation_failed"
+	CodeRateLimited      = "rate_limited"
+	CodeInternal         = "internal_error"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+}
+
+// APIError is the body of a v1 error response
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// ErrorResponse wraps an APIError
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// apiV1 reports whether the request came in under /api/v1
+func apiV1(c *gin.Context) bool {
+	return c.GetString(APIVersionContextKey) == APIVersionV1
+}
+
+// errorBody builds the error body for the request's API version
+func errorBody(c *gin.Context, status int, message string, details interface{}) interface{} {
+	if !apiV1(c) {
+		body := gin.H{"error": message}
+		if d, ok := details.(ValidationDetails); ok {
+			body["issues"] = d.Issues
+		}
+		return body
+	}
+
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+		if status < http.StatusInternalServerError {
+			code = CodeBadRequest
+		}
+	}
+	return ErrorResponse{Error: APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: c.GetString(RequestIDContextKey),
+	}}
+}
+
+// respondError sends an error response; details is optional
+func respondError(c *gin.Context, status int, message string, details ...interface{}) {
+	var d interface{}
+	if len(details) > 0 {
+		d = details[0]
+	}
+	c.JSON(status, errorBody(c, status, message, d))
+}
+
+// respondInternalError sends a 500 with message. err stays out of the
+// response but is kept on the context for the request log.
+func respondInternalError(c *gin.Context, err error, message string) {
+	if err != nil {
+		_ = c.Error(err)
+	}
+	respondError(c, http.StatusInternalServerError, message)
+}
+
+// AbortWithError stops the handler chain with an error response (for middleware)
+func AbortWithError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, errorBody(c, status, message, nil))
+}
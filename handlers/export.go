@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"busapp/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+/*
+Export endpoint (admin):
+- GET /admin/export?format=csv|xlsx|gtfs|geojson[&route_id=][&entity=routes|stops|schedules]
+
+Produces one table per entity (routes, stops, schedules) using the import
+column names, so the output can be edited and uploaded back to
+/admin/upload-csv. csv returns a zip of three files (or a single CSV when
+entity is given), xlsx a workbook with one sheet per entity. gtfs and geojson
+are for other tools (see gtfs.go and geojson.go); a GTFS feed can be
+uploaded back as well.
+*/
+
+// ExportTable is one entity table: a header row followed by data rows
+type ExportTable struct {
+	Name string
+	Rows [][]string
+}
+
+// ExportRoutes loads the routes of an agency (0 = all), optionally limited to
+// one route, with their agency, ordered stops and schedules
+func ExportRoutes(db *gorm.DB, agencyID, routeID uint) ([]models.Route, error) {
+	q := db.Scopes(routeScope(agencyID)).Preload("Agency").Preload("Stops", func(db *gorm.DB) *gorm.DB {
+		return db.Order("order_index asc")
+	}).Preload("Schedules", func(db *gorm.DB) *gorm.DB {
+		return db.Order("departure asc")
+	}).Order("name asc")
+	if routeID != 0 {
+		q = q.Where("id = ?", routeID)
+	}
+
+	var routes []models.Route
+	if err := q.Find(&routes).Error; err != nil {
+		return nil, err
+	}
+	if routeID != 0 && len(routes) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return routes, nil
+}
+
+// ExportNetwork builds the routes, stops and schedules tables for an agency
+// (0 = all), optionally limited to one route
+func ExportNetwork(db *gorm.DB, agencyID, routeID uint) ([]ExportTable, error) {
+	routes, err := ExportRoutes(db, agencyID, routeID)
+	if err != nil {
+		return nil, err
+	}
+	return NetworkTables(routes), nil
+}
+
+// NetworkTables builds the routes, stops and schedules tables of routes
+func NetworkTables(routes []models.Route) []ExportTable {
+
+	routeRows := [][]string{{colRouteName, colRouteDesc}}
+	stopRows := [][]string{{colRouteName, colStopName, colStopLat, colStopLon, colStopOrder}}
+	scheduleRows := [][]string{{colRouteName, colDeparture, colFrequency}}
+	for _, r := range routes {
+		routeRows = append(routeRows, []string{r.Name, r.Description})
+		for _, s := range r.Stops {
+			stopRows = append(stopRows, []string{
+				r.Name,
+				s.Name,
+				strconv.FormatFloat(s.Latitude, 'f', -1, 64),
+				strconv.FormatFloat(s.Longitude, 'f', -1, 64),
+				strconv.Itoa(s.OrderIndex),
+			})
+		}
+		for _, sch := range r.Schedules {
+			scheduleRows = append(scheduleRows, []string{r.Name, sch.Departure, strconv.Itoa(sch.FrequencyMin)})
+		}
+	}
+
+	return []ExportTable{
+		{Name: "routes", Rows: routeRows},
+		{Name: "stops", Rows: stopRows},
+		{Name: "schedules", Rows: scheduleRows},
+	}
+}
+
+// ExportHandler - downloads the network as CSV (zip), xlsx, GTFS (zip) or GeoJSON
+func ExportHandler(c *gin.Context, db *gorm.DB) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" && format != "gtfs" && format != "geojson" {
+		respondError(c, http.StatusBadRequest, "format must be csv, xlsx, gtfs or geojson")
+		return
+	}
+
+	var routeID uint
+	if s := c.Query("route_id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid route_id")
+			return
+		}
+		routeID = uint(id)
+	}
+
+	routes, err := ExportRoutes(db, tenantID(c), routeID)
+	if err == gorm.ErrRecordNotFound {
+		respondError(c, http.StatusNotFound, "route not found")
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err, "failed to export")
+		return
+	}
+
+	base := "network"
+	if routeID != 0 {
+		base = fmt.Sprintf("route-%d", routeID)
+	}
+
+	switch format {
+	case "gtfs":
+		attachment(c, base+"-gtfs.zip", "application/zip")
+		if err := WriteGTFS(c.Writer, routes); err != nil {
+			c.Error(err)
+		}
+		return
+	case "geojson":
+		attachment(c, base+".geojson", "application/geo+json")
+		if err := WriteGeoJSON(c.Writer, routes); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+	tables := NetworkTables(routes)
+
+	if entity := c.Query("entity"); entity != "" {
+		if format != "csv" {
+			respondError(c, http.StatusBadRequest, "entity is only supported for csv")
+			return
+		}
+		for _, t := range tables {
+			if t.Name == entity {
+				attachment(c, base+"-"+t.Name+".csv", "text/csv")
+				if err := writeCSVTable(c.Writer, t); err != nil {
+					c.Error(err)
+				}
+				return
+			}
+		}
+		respondError(c, http.StatusBadRequest, "entity must be routes, stops or schedules")
+		return
+	}
+
+	if format == "xlsx" {
+		attachment(c, base+".xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		if err := WriteXLSX(c.Writer, tables); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+
+	attachment(c, base+".zip", "application/zip")
+	if err := WriteCSVZip(c.Writer, tables); err != nil {
+		c.Error(err)
+	}
+}
+
+func attachment(c *gin.Context, filename, contentType string) {
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+}
+
+func writeCSVTable(w io.Writer, t ExportTable) error {
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(t.Rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// WriteCSVZip writes one CSV file per table into a zip archive
+func WriteCSVZip(w io.Writer, tables []ExportTable) error {
+	zw := zip.NewWriter(w)
+	for _, t := range tables {
+		f, err := zw.Create(t.Name + ".csv")
+		if err != nil {
+			return err
+		}
+		if err := writeCSVTable(f, t); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// WriteXLSX writes one sheet per table into a workbook
+func WriteXLSX(w io.Writer, tables []ExportTable) error {
+	book := excelize.NewFile()
+	defer book.Close()
+
+	for i, t := range tables {
+		if i == 0 {
+			if err := book.SetSheetName("Sheet1", t.Name); err != nil {
+				return err
+			}
+		} else if _, err := book.NewSheet(t.Name); err != nil {
+			return err
+		}
+		for r, row := range t.Rows {
+			cells := make([]interface{}, len(row))
+			for j, v := range row {
+				cells[j] = v // keep everything as text so values round-trip exactly
+			}
+			cell, _ := excelize.CoordinatesToCellName(1, r+1)
+			if err := book.SetSheetRow(t.Name, cell, &cells); err != nil {
+				return err
+			}
+		}
+	}
+	return book.Write(w)
+}
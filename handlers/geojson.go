@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+
+	"busapp/models"
+)
+
+/*
+GeoJSON export (GET /admin/export?format=geojson, busapp export geojson):
+a FeatureCollection with a LineString through the stops of each route and a
+Point for every stop. Coordinates are [longitude, latitude] as GeoJSON
+requires; properties carry the IDs and names.
+*/
+
+// GeoJSONFeature is a GeoJSON feature
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONGeometry is a Point ([lon, lat]) or a LineString ([][lon, lat])
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// GeoJSONCollection is a GeoJSON FeatureCollection
+type GeoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// NetworkGeoJSON builds the feature collection of routes (see ExportRoutes)
+func NetworkGeoJSON(routes []models.Route) GeoJSONCollection {
+	fc := GeoJSONCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, r := range routes {
+		line := make([][2]float64, len(r.Stops))
+		for i, s := range r.Stops {
+			line[i] = [2]float64{s.Longitude, s.Latitude}
+		}
+		if len(line) >= 2 { // a LineString needs two positions
+			fc.Features = append(fc.Features, GeoJSONFeature{
+				Type:     "Feature",
+				Geometry: GeoJSONGeometry{Type: "LineString", Coordinates: line},
+				Properties: map[string]interface{}{
+					"kind": "route", "id": r.ID, "name": r.Name, "description": r.Description, "agency_id": r.AgencyID,
+				},
+			})
+		}
+		for i, s := range r.Stops {
+			fc.Features = append(fc.Features, GeoJSONFeature{
+				Type:     "Feature",
+				Geometry: GeoJSONGeometry{Type: "Point", Coordinates: line[i]},
+				Properties: map[string]interface{}{
+					"kind": "stop", "id": s.ID, "name": s.Name, "route_id": r.ID, "route_name": r.Name, "order_index": s.OrderIndex,
+				},
+			})
+		}
+	}
+	return fc
+}
+
+// WriteGeoJSON writes routes (see ExportRoutes) as a GeoJSON FeatureCollection
+func WriteGeoJSON(w io.Writer, routes []models.Route) error {
+	return json.NewEncoder(w).Encode(NetworkGeoJSON(routes))
+}
@@ -0,0 +1,595 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"busapp/config"
+	"busapp/metrics"
+	"busapp/models"
+	"busapp/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/location"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"gorm.io/gorm"
+)
+
+/*
+GraphQL endpoint:
+- POST /graphql  -> {"query", "operationName", "variables"}
+- GET  /graphql?query=&operationName=&variables=  (queries only)
+
+Queries (public): routes, route, stop, agencies and alerts. A route has its
+agency, stops, schedules, upcoming departures with stop ETAs, and active
+alerts, so an app gets everything for a screen in one round trip. Child
+lookups are batched per request (see graphql_loaders.go) and queries are
+limited in cost and depth (see graphql_cost.go).
+
+Mutations (create/update/delete of routes, stops, schedules and alerts) need
+the same bearer JWT as the /admin endpoints; they go through the same tenancy
+checks, validation and audit log. Errors carry extensions.code with the
+error codes of the REST API.
+*/
+
+// GraphQLRequest is a GraphQL POST body
+type GraphQLRequest struct {
+	Query         string                 `json:"query" binding:"required"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// CodeQueryTooComplex is the extensions.code of queries over the cost limits
+const CodeQueryTooComplex = "query_too_complex"
+
+// graphContext is the per-request state resolvers reach through the context
+type graphContext struct {
+	c       *gin.Context
+	db      *gorm.DB
+	loaders *graphLoaders
+	now     time.Time
+}
+
+type graphContextKey struct{}
+
+func graphCtx(p graphql.ResolveParams) *graphContext {
+	return p.Context.Value(graphContextKey{}).(*graphContext)
+}
+
+// graphError is a resolver error with a code (and details) in its extensions
+type graphError struct {
+	code    string
+	message string
+	details interface{}
+	cause   error // of an internal error, logged but not shown
+}
+
+func (e *graphError) Error() string { return e.message }
+
+func (e *graphError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.code}
+	if e.details != nil {
+		ext["details"] = e.details
+	}
+	return ext
+}
+
+// graphWriteError converts an error of the admin write functions; fallback
+// is the message for unexpected errors
+func graphWriteError(err error, fallback string) error {
+	var se *service.Error
+	if errors.As(err, &se) {
+		code, ok := statusCodes[statusOf[se.Kind]]
+		if !ok {
+			code = CodeBadRequest
+		}
+		return &graphError{code: code, message: se.Message}
+	}
+	if issues, ok := service.FailedIssues(err); ok {
+		return &graphError{code: CodeValidationFailed, message: "validation failed", details: ValidationDetails{Issues: issues}}
+	}
+	return &graphError{code: CodeInternal, message: fallback, cause: err}
+}
+
+// graphRequestError answers a request that could not be executed
+func graphRequestError(c *gin.Context, status int, e *graphError) {
+	c.JSON(status, GraphQLResponse{Errors: []gqlerrors.FormattedError{{
+		Message:    e.message,
+		Locations:  []location.SourceLocation{},
+		Extensions: e.Extensions(),
+	}}})
+}
+
+// GraphQLHandler - runs a GraphQL query or mutation
+func GraphQLHandler(c *gin.Context, db *gorm.DB) {
+	var req GraphQLRequest
+	if c.Request.Method == http.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if vars := c.Query("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				respondError(c, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+		if req.Query == "" {
+			respondError(c, http.StatusBadRequest, "query is required")
+			return
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(req.Query),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GraphQLResponse{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+	if res := graphql.ValidateDocument(&graphSchema, doc, nil); !res.IsValid {
+		c.JSON(http.StatusBadRequest, GraphQLResponse{Errors: res.Errors})
+		return
+	}
+
+	if c.Request.Method == http.MethodGet && hasMutation(doc, req.OperationName) {
+		graphRequestError(c, http.StatusMethodNotAllowed, &graphError{code: CodeBadRequest, message: "mutations must use POST"})
+		return
+	}
+
+	cost, depth, err := estimateCost(graphSchema, doc, req.OperationName, req.Variables)
+	if err != nil {
+		graphRequestError(c, http.StatusBadRequest, &graphError{code: CodeBadRequest, message: err.Error()})
+		return
+	}
+	if maxCost := graphMaxCost(); cost > maxCost || depth > graphMaxDepth {
+		graphRequestError(c, http.StatusBadRequest, &graphError{
+			code:    CodeQueryTooComplex,
+			message: fmt.Sprintf("query too complex (cost %d of max %d, depth %d of max %d)", cost, maxCost, depth, graphMaxDepth),
+			details: QueryCostDetails{Cost: cost, MaxCost: maxCost, Depth: depth, MaxDepth: graphMaxDepth},
+		})
+		return
+	}
+
+	now := time.Now()
+	ctx := context.WithValue(c.Request.Context(), graphContextKey{}, &graphContext{
+		c:       c,
+		db:      db,
+		loaders: newGraphLoaders(db, now),
+		now:     now,
+	})
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphSchema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+	// unexpected resolver errors go to the request log, as with respondInternalError
+	for _, e := range result.Errors {
+		var ge *graphError
+		switch {
+		case errors.As(e.OriginalError(), &ge):
+			if ge.cause != nil {
+				_ = c.Error(ge.cause)
+			}
+		case e.OriginalError() != nil:
+			_ = c.Error(e.OriginalError())
+		}
+	}
+	c.Header("X-GraphQL-Cost", strconv.Itoa(cost))
+	c.JSON(http.StatusOK, GraphQLResponse{Data: result.Data, Errors: result.Errors})
+}
+
+// hasMutation reports whether the operation to run is a mutation
+func hasMutation(doc *ast.Document, operationName string) bool {
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok && op.Operation == ast.OperationTypeMutation &&
+			(operationName == "" || (op.Name != nil && op.Name.Value == operationName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------- Schema ------------
+
+// argID reads a required ID argument
+func argID(args map[string]interface{}, name string) (uint, error) {
+	id, err := strconv.ParseUint(fmt.Sprint(args[name]), 10, 64)
+	if err != nil {
+		return 0, &graphError{code: CodeBadRequest, message: "invalid " + name}
+	}
+	return uint(id), nil
+}
+
+// optArgID reads an optional ID argument (nil when absent)
+func optArgID(args map[string]interface{}, name string) (*uint, error) {
+	if args[name] == nil {
+		return nil, nil
+	}
+	id, err := argID(args, name)
+	return &id, err
+}
+
+// intArg reads an Int argument, falling back to def when absent or not positive
+func intArg(args map[string]interface{}, name string, def, max int) int {
+	n, ok := args[name].(int)
+	if !ok || n <= 0 {
+		n = def
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+// fieldOf is a field read from the source object of type *T
+func fieldOf[T any](typ graphql.Output, get func(*T) interface{}) *graphql.Field {
+	return &graphql.Field{Type: typ, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(*T)), nil
+	}}
+}
+
+// pointers returns pointers to the elements of s
+func pointers[T any](s []T) []*T {
+	out := make([]*T, len(s))
+	for i := range s {
+		out[i] = &s[i]
+	}
+	return out
+}
+
+// graphDeparture is one upcoming bus of a schedule
+type graphDeparture struct {
+	Schedule *models.Schedule
+	At       time.Time
+	ETAs     []graphStopETA
+}
+
+type graphStopETA struct {
+	Stop *models.Stop
+	At   time.Time
+}
+
+const (
+	defaultGraphDepartures = 4
+	maxGraphDepartures     = 50
+)
+
+// upcomingDepartures merges the next departures of every schedule of a
+// route, soonest first
+func upcomingDepartures(stops []models.Stop, schedules []models.Schedule, now time.Time, limit int) []graphDeparture {
+	defer metrics.Since(metrics.ETAComputations, time.Now())
+	deps := []graphDeparture{}
+	for i := range schedules {
+		sch := &schedules[i]
+		_, next, err := service.Departures(*sch, now)
+		if err != nil {
+			continue // invalid departure, reported by the validation rules
+		}
+		for n := 0; n < limit; n++ {
+			deps = append(deps, graphDeparture{Schedule: sch, At: next})
+			if sch.FrequencyMin <= 0 {
+				break
+			}
+			next = next.Add(time.Duration(sch.FrequencyMin) * time.Minute)
+		}
+	}
+	sort.SliceStable(deps, func(i, j int) bool { return deps[i].At.Before(deps[j].At) })
+	if len(deps) > limit {
+		deps = deps[:limit]
+	}
+	for i := range deps {
+		for j, at := range service.StopArrivals(stops, deps[i].At, config.Get().AverageSpeedKmH) {
+			deps[i].ETAs = append(deps[i].ETAs, graphStopETA{Stop: &stops[j], At: at})
+		}
+	}
+	return deps
+}
+
+var graphSchema = newGraphSchema()
+
+func newGraphSchema() graphql.Schema {
+	clock := func(t time.Time) interface{} { return t.Format("15:04") }
+
+	severity := graphql.NewEnum(graphql.EnumConfig{
+		Name: "AlertSeverity",
+		Values: graphql.EnumValueConfigMap{
+			"INFO":    {Value: models.AlertInfo},
+			"WARNING": {Value: models.AlertWarning},
+			"SEVERE":  {Value: models.AlertSevere},
+		},
+	})
+
+	agency := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Agency",
+		Fields: graphql.Fields{
+			"id":       fieldOf(graphql.NewNonNull(graphql.ID), func(a *models.Agency) interface{} { return a.ID }),
+			"name":     fieldOf(graphql.NewNonNull(graphql.String), func(a *models.Agency) interface{} { return a.Name }),
+			"url":      fieldOf(graphql.String, func(a *models.Agency) interface{} { return a.URL }),
+			"timezone": fieldOf(graphql.String, func(a *models.Agency) interface{} { return a.Timezone }),
+			"phone":    fieldOf(graphql.String, func(a *models.Agency) interface{} { return a.Phone }),
+		},
+	})
+
+	var route *graphql.Object // defined last, the thunks below refer to it
+
+	stop := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stop",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":         fieldOf(graphql.NewNonNull(graphql.ID), func(s *models.Stop) interface{} { return s.ID }),
+				"name":       fieldOf(graphql.NewNonNull(graphql.String), func(s *models.Stop) interface{} { return s.Name }),
+				"latitude":   fieldOf(graphql.NewNonNull(graphql.Float), func(s *models.Stop) interface{} { return s.Latitude }),
+				"longitude":  fieldOf(graphql.NewNonNull(graphql.Float), func(s *models.Stop) interface{} { return s.Longitude }),
+				"orderIndex": fieldOf(graphql.NewNonNull(graphql.Int), func(s *models.Stop) interface{} { return s.OrderIndex }),
+				"route": {Type: route, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphCtx(p).loaders.routes.loadOne(p.Source.(*models.Stop).RouteID)
+				}},
+			}
+		}),
+	})
+
+	schedule := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Schedule",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":           fieldOf(graphql.NewNonNull(graphql.ID), func(s *models.Schedule) interface{} { return s.ID }),
+				"departure":    fieldOf(graphql.NewNonNull(graphql.String), func(s *models.Schedule) interface{} { return s.Departure }),
+				"frequencyMin": fieldOf(graphql.NewNonNull(graphql.Int), func(s *models.Schedule) interface{} { return s.FrequencyMin }),
+				"route": {Type: route, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphCtx(p).loaders.routes.loadOne(p.Source.(*models.Schedule).RouteID)
+				}},
+			}
+		}),
+	})
+
+	alert := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Alert",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":       fieldOf(graphql.NewNonNull(graphql.ID), func(a *models.Alert) interface{} { return a.ID }),
+				"severity": fieldOf(graphql.NewNonNull(severity), func(a *models.Alert) interface{} { return a.Severity }),
+				"title":    fieldOf(graphql.NewNonNull(graphql.String), func(a *models.Alert) interface{} { return a.Title }),
+				"message":  fieldOf(graphql.String, func(a *models.Alert) interface{} { return a.Message }),
+				"startsAt": fieldOf(graphql.DateTime, func(a *models.Alert) interface{} { return a.StartsAt }),
+				"endsAt":   fieldOf(graphql.DateTime, func(a *models.Alert) interface{} { return a.EndsAt }),
+				"route": {Type: route, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if id := p.Source.(*models.Alert).RouteID; id != nil {
+						return graphCtx(p).loaders.routes.loadOne(*id)
+					}
+					return nil, nil
+				}},
+				"agency": {Type: agency, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if id := p.Source.(*models.Alert).AgencyID; id != nil {
+						return graphCtx(p).loaders.agencies.loadOne(*id)
+					}
+					return nil, nil
+				}},
+			}
+		}),
+	})
+
+	stopETA := graphql.NewObject(graphql.ObjectConfig{
+		Name: "StopETA",
+		Fields: graphql.Fields{
+			"stop": fieldOf(graphql.NewNonNull(stop), func(e *graphStopETA) interface{} { return e.Stop }),
+			"eta":  fieldOf(graphql.NewNonNull(graphql.String), func(e *graphStopETA) interface{} { return clock(e.At) }),
+		},
+	})
+
+	departure := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Departure",
+		Fields: graphql.Fields{
+			"schedule":  fieldOf(graphql.NewNonNull(schedule), func(d *graphDeparture) interface{} { return d.Schedule }),
+			"departure": fieldOf(graphql.NewNonNull(graphql.String), func(d *graphDeparture) interface{} { return clock(d.At) }),
+			"etas": fieldOf(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(stopETA))), func(d *graphDeparture) interface{} {
+				return pointers(d.ETAs)
+			}),
+		},
+	})
+
+	route = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Route",
+		Fields: graphql.Fields{
+			"id":          fieldOf(graphql.NewNonNull(graphql.ID), func(r *models.Route) interface{} { return r.ID }),
+			"name":        fieldOf(graphql.NewNonNull(graphql.String), func(r *models.Route) interface{} { return r.Name }),
+			"description": fieldOf(graphql.String, func(r *models.Route) interface{} { return r.Description }),
+			"agency": {Type: agency, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if id := p.Source.(*models.Route).AgencyID; id != nil {
+					return graphCtx(p).loaders.agencies.loadOne(*id)
+				}
+				return nil, nil
+			}},
+			"stops": {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(stop))), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				stops, err := graphCtx(p).loaders.stops.load(p.Source.(*models.Route).ID)
+				return pointers(stops), err
+			}},
+			"schedules": {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(schedule))), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				schedules, err := graphCtx(p).loaders.schedules.load(p.Source.(*models.Route).ID)
+				return pointers(schedules), err
+			}},
+			"departures": {
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(departure))),
+				Description: "Next departures over all schedules, soonest first",
+				Args:        graphql.FieldConfigArgument{"limit": {Type: graphql.Int, DefaultValue: defaultGraphDepartures}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					gc := graphCtx(p)
+					id := p.Source.(*models.Route).ID
+					stops, err := gc.loaders.stops.load(id)
+					if err != nil {
+						return nil, err
+					}
+					schedules, err := gc.loaders.schedules.load(id)
+					if err != nil {
+						return nil, err
+					}
+					var agency *models.Agency
+					if agencyID := p.Source.(*models.Route).AgencyID; agencyID != nil {
+						if agency, err = gc.loaders.agencies.loadOne(*agencyID); err != nil {
+							return nil, err
+						}
+					}
+					now := gc.now.In(service.AgencyLocation(agency))
+					limit := intArg(p.Args, "limit", defaultGraphDepartures, maxGraphDepartures)
+					return pointers(upcomingDepartures(stops, schedules, now, limit)), nil
+				},
+			},
+			"alerts": {
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(alert))),
+				Description: "Active alerts for the route, its agency or the whole network",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					alerts, err := graphCtx(p).loaders.alerts.load(p.Source.(*models.Route).ID)
+					return pointers(alerts), err
+				},
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"routes": {
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(route))),
+				Args: graphql.FieldConfigArgument{
+					"limit":  {Type: graphql.Int, DefaultValue: defaultRouteListLimit},
+					"offset": {Type: graphql.Int, DefaultValue: 0},
+					"q":      {Type: graphql.String, Description: "name contains"},
+					"agency": {Type: graphql.ID},
+					"stop":   {Type: graphql.ID, Description: "routes serving this stop"},
+				},
+				Resolve: resolveRoutes,
+			},
+			"route": {
+				Type: route,
+				Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := argID(p.Args, "id")
+					if err != nil {
+						return nil, err
+					}
+					return graphCtx(p).loaders.routes.loadOne(id)
+				},
+			},
+			"stop": {
+				Type: stop,
+				Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := argID(p.Args, "id")
+					if err != nil {
+						return nil, err
+					}
+					var s models.Stop
+					err = graphCtx(p).db.First(&s, id).Error
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						return nil, nil
+					}
+					return &s, err
+				},
+			},
+			"agencies": {
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(agency))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var agencies []models.Agency
+					err := graphCtx(p).db.Order("id asc").Find(&agencies).Error
+					return pointers(agencies), err
+				},
+			},
+			"alerts": {
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(alert))),
+				Description: "Active alerts, optionally of one route (with agency-wide ones) or agency",
+				Args: graphql.FieldConfigArgument{
+					"route":  {Type: graphql.ID},
+					"agency": {Type: graphql.ID},
+				},
+				Resolve: resolveAlerts,
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: newGraphMutations(route, stop, schedule, alert, severity),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// resolveRoutes lists routes like GET /public/routes
+func resolveRoutes(p graphql.ResolveParams) (interface{}, error) {
+	gc := graphCtx(p)
+	q := routeListQuery{
+		Limit:  intArg(p.Args, "limit", defaultRouteListLimit, maxRouteListLimit),
+		Offset: intArg(p.Args, "offset", 0, 1<<31-1),
+		Order:  "routes.id asc",
+	}
+	q.Name, _ = p.Args["q"].(string)
+	for name, dst := range map[string]*uint{"agency": &q.AgencyID, "stop": &q.StopID} {
+		id, err := optArgID(p.Args, name)
+		if err != nil {
+			return nil, err
+		}
+		if id != nil {
+			*dst = *id
+		}
+	}
+
+	routes := []models.Route{}
+	if err := gc.db.Scopes(q.filter).Order(q.Order).Limit(q.Limit).Offset(q.Offset).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		gc.loaders.routes.add(r.ID, r)
+	}
+	gc.loaders.primeRoutes(routes)
+	return pointers(routes), nil
+}
+
+// resolveAlerts lists active alerts, hiding those of trashed routes
+func resolveAlerts(p graphql.ResolveParams) (interface{}, error) {
+	gc := graphCtx(p)
+	routeID, err := optArgID(p.Args, "route")
+	if err != nil {
+		return nil, err
+	}
+	agencyID, err := optArgID(p.Args, "agency")
+	if err != nil {
+		return nil, err
+	}
+
+	if routeID != nil {
+		alerts, err := gc.loaders.alerts.load(*routeID)
+		return pointers(alerts), err
+	}
+
+	q := gc.db.Scopes(activeAlerts(gc.now)).
+		Where("route_id IS NULL OR route_id IN (?)", gc.db.Model(&models.Route{}).Select("id"))
+	if agencyID != nil {
+		q = q.Where("agency_id = ?", *agencyID)
+	}
+	alerts := []models.Alert{}
+	if err := q.Order("id asc").Find(&alerts).Error; err != nil {
+		return nil, err
+	}
+	for _, a := range alerts {
+		if a.RouteID != nil {
+			gc.loaders.routes.prime(*a.RouteID)
+		}
+	}
+	return pointers(alerts), nil
+}
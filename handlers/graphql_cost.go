@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"busapp/config"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+/*
+GraphQL query limits.
+
+Before a query runs, its cost is estimated from the document: every object
+it returns counts 1 (scalar fields are free), and the selection under a list
+field counts once per item that list may return, i.e. its limit argument or
+graphListSize for unbounded lists. Queries costing more than the maximum
+(graphql_max_cost in the config, default 10000) or nesting deeper than graphMaxDepth are
+refused without touching the database.
+*/
+
+const (
+	graphMaxDepth = 10
+	graphListSize = 20 // assumed length of lists without a limit argument
+)
+
+// graphMaxCost returns the configured cost limit
+func graphMaxCost() int {
+	return config.Get().GraphQLMaxCost
+}
+
+// queryCost walks an operation of a validated document
+type queryCost struct {
+	schema    graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	vars      map[string]interface{}
+}
+
+// estimateCost returns the cost and depth of the operation that will run
+func estimateCost(schema graphql.Schema, doc *ast.Document, operationName string, vars map[string]interface{}) (cost, depth int, err error) {
+	q := queryCost{schema: schema, fragments: map[string]*ast.FragmentDefinition{}, vars: vars}
+	var op *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch d := def.(type) {
+		case *ast.FragmentDefinition:
+			q.fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			if operationName == "" || (d.Name != nil && d.Name.Value == operationName) {
+				op = d
+			}
+		}
+	}
+	if op == nil {
+		return 0, 0, fmt.Errorf("unknown operation %q", operationName)
+	}
+
+	root := schema.QueryType()
+	if op.Operation == ast.OperationTypeMutation {
+		root = schema.MutationType()
+	}
+	cost, depth = q.selectionSet(root, op.SelectionSet)
+	return cost, depth, nil
+}
+
+// selectionSet returns the cost and depth of the selections on an object type
+func (q queryCost) selectionSet(parent *graphql.Object, set *ast.SelectionSet) (cost, depth int) {
+	if parent == nil || set == nil {
+		return 0, 0
+	}
+	for _, sel := range set.Selections {
+		var c, d int
+		switch s := sel.(type) {
+		case *ast.Field:
+			c, d = q.field(parent, s)
+		case *ast.InlineFragment:
+			c, d = q.selectionSet(q.fragmentType(parent, s.TypeCondition), s.SelectionSet)
+		case *ast.FragmentSpread:
+			if f, ok := q.fragments[s.Name.Value]; ok {
+				c, d = q.selectionSet(q.fragmentType(parent, f.TypeCondition), f.SelectionSet)
+			}
+		}
+		cost += c
+		if d > depth {
+			depth = d
+		}
+	}
+	return cost, depth
+}
+
+// field returns the cost and depth of one field and its selection
+func (q queryCost) field(parent *graphql.Object, f *ast.Field) (cost, depth int) {
+	if strings.HasPrefix(f.Name.Value, "__") {
+		return 0, 1 // introspection is bounded by the schema
+	}
+	def, ok := parent.Fields()[f.Name.Value]
+	if !ok {
+		return 0, 1
+	}
+
+	items := 1
+	typ := graphql.Type(def.Type)
+	if nn, ok := typ.(*graphql.NonNull); ok {
+		typ = nn.OfType
+	}
+	if list, ok := typ.(*graphql.List); ok {
+		items = q.listSize(def, f)
+		typ = list.OfType
+		if nn, ok := typ.(*graphql.NonNull); ok {
+			typ = nn.OfType
+		}
+	}
+
+	obj, ok := typ.(*graphql.Object)
+	if !ok {
+		return 0, 1 // scalars and enums are free
+	}
+	childCost, childDepth := q.selectionSet(obj, f.SelectionSet)
+	return items * (1 + childCost), 1 + childDepth
+}
+
+// listSize is the limit argument of a list field, or graphListSize
+func (q queryCost) listSize(def *graphql.FieldDefinition, f *ast.Field) int {
+	for _, arg := range def.Args {
+		if arg.Name() != "limit" {
+			continue
+		}
+		for _, a := range f.Arguments {
+			if a.Name.Value == "limit" {
+				if n, ok := q.intValue(a.Value); ok && n > 0 {
+					return n
+				}
+			}
+		}
+		if n, ok := arg.DefaultValue.(int); ok {
+			return n
+		}
+	}
+	return graphListSize
+}
+
+// intValue reads an int literal or variable
+func (q queryCost) intValue(v ast.Value) (int, bool) {
+	switch v := v.(type) {
+	case *ast.IntValue:
+		n, err := strconv.Atoi(v.Value)
+		return n, err == nil
+	case *ast.Variable:
+		switch n := q.vars[v.Name.Value].(type) {
+		case int:
+			return n, true
+		case float64:
+			return int(n), true
+		}
+	}
+	return 0, false
+}
+
+// fragmentType is the object type a fragment applies to
+func (q queryCost) fragmentType(parent *graphql.Object, cond *ast.Named) *graphql.Object {
+	if cond == nil {
+		return parent
+	}
+	if obj, ok := q.schema.Type(cond.Name.Value).(*graphql.Object); ok {
+		return obj
+	}
+	return parent
+}
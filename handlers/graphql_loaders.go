@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"busapp/models"
+
+	"gorm.io/gorm"
+)
+
+/*
+GraphQL batching.
+
+Resolving stops for each of 50 routes one by one would cost 50 queries. The
+loaders below collect keys instead: whenever a resolver returns a list of
+routes or stops, the IDs are announced (prime), and the first child lookup
+fetches the children of every announced parent in a single IN query. Results
+are cached for the rest of the request, so a route reached twice (e.g. via
+stop.route) is loaded once.
+*/
+
+// batchLoader loads the values of many keys in one query, DataLoader style
+type batchLoader[T any] struct {
+	mu      sync.Mutex
+	fetch   func(ids []uint) (map[uint][]T, error)
+	pending map[uint]bool
+	loaded  map[uint][]T
+}
+
+func newBatchLoader[T any](fetch func(ids []uint) (map[uint][]T, error)) *batchLoader[T] {
+	return &batchLoader[T]{fetch: fetch, pending: map[uint]bool{}, loaded: map[uint][]T{}}
+}
+
+// prime announces keys that are likely to be loaded
+func (l *batchLoader[T]) prime(ids ...uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := l.loaded[id]; !ok {
+			l.pending[id] = true
+		}
+	}
+}
+
+// load returns the values of id, fetching every pending key with it
+func (l *batchLoader[T]) load(id uint) ([]T, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.loaded[id]; ok {
+		return v, nil
+	}
+
+	l.pending[id] = true
+	ids := make([]uint, 0, len(l.pending))
+	for k := range l.pending {
+		ids = append(ids, k)
+	}
+	found, err := l.fetch(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range ids {
+		l.loaded[k] = found[k]
+	}
+	l.pending = map[uint]bool{}
+	return l.loaded[id], nil
+}
+
+// add caches values already loaded for id
+func (l *batchLoader[T]) add(id uint, values ...T) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, id)
+	l.loaded[id] = values
+}
+
+// loadOne returns the single value of id (nil when missing)
+func (l *batchLoader[T]) loadOne(id uint) (*T, error) {
+	v, err := l.load(id)
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	return &v[0], nil
+}
+
+// graphLoaders are the loaders of one GraphQL request
+type graphLoaders struct {
+	routes    *batchLoader[models.Route]    // by ID
+	agencies  *batchLoader[models.Agency]   // by ID
+	stops     *batchLoader[models.Stop]     // by route ID, in order
+	schedules *batchLoader[models.Schedule] // by route ID, by departure
+	alerts    *batchLoader[models.Alert]    // active alerts by route ID, agency-wide ones included
+}
+
+func newGraphLoaders(db *gorm.DB, now time.Time) *graphLoaders {
+	l := &graphLoaders{
+		agencies: newBatchLoader(func(ids []uint) (map[uint][]models.Agency, error) {
+			var agencies []models.Agency
+			err := db.Where("id IN ?", ids).Find(&agencies).Error
+			found := map[uint][]models.Agency{}
+			for _, a := range agencies {
+				found[a.ID] = []models.Agency{a}
+			}
+			return found, err
+		}),
+		stops: newBatchLoader(func(ids []uint) (map[uint][]models.Stop, error) {
+			var stops []models.Stop
+			err := db.Where("route_id IN ?", ids).Order("route_id, order_index asc").Find(&stops).Error
+			found := map[uint][]models.Stop{}
+			for _, s := range stops {
+				found[s.RouteID] = append(found[s.RouteID], s)
+			}
+			return found, err
+		}),
+		schedules: newBatchLoader(func(ids []uint) (map[uint][]models.Schedule, error) {
+			var schedules []models.Schedule
+			err := db.Where("route_id IN ?", ids).Order("route_id, departure asc").Find(&schedules).Error
+			found := map[uint][]models.Schedule{}
+			for _, s := range schedules {
+				found[s.RouteID] = append(found[s.RouteID], s)
+			}
+			return found, err
+		}),
+		alerts: newBatchLoader(func(ids []uint) (map[uint][]models.Alert, error) {
+			return routeAlerts(db, ids, now)
+		}),
+	}
+	l.routes = newBatchLoader(func(ids []uint) (map[uint][]models.Route, error) {
+		var routes []models.Route
+		err := db.Where("id IN ?", ids).Find(&routes).Error
+		found := map[uint][]models.Route{}
+		for _, r := range routes {
+			found[r.ID] = []models.Route{r}
+		}
+		l.primeRoutes(routes)
+		return found, err
+	})
+	return l
+}
+
+// primeRoutes announces the children of routes a resolver returned
+func (l *graphLoaders) primeRoutes(routes []models.Route) {
+	ids := make([]uint, len(routes))
+	for i, r := range routes {
+		ids[i] = r.ID
+		if r.AgencyID != nil {
+			l.agencies.prime(*r.AgencyID)
+		}
+	}
+	l.stops.prime(ids...)
+	l.schedules.prime(ids...)
+	l.alerts.prime(ids...)
+}
+
+// activeAlerts limits alert queries to alerts in effect at now
+func activeAlerts(now time.Time) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("(starts_at IS NULL OR starts_at <= ?) AND (ends_at IS NULL OR ends_at > ?)", now, now)
+	}
+}
+
+// routeAlerts returns the active alerts of each route: its own, its
+// agency's and the network-wide ones
+func routeAlerts(db *gorm.DB, routeIDs []uint, now time.Time) (map[uint][]models.Alert, error) {
+	var routes []models.Route
+	if err := db.Select("id", "agency_id").Where("id IN ?", routeIDs).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+	var alerts []models.Alert
+	if err := db.Scopes(activeAlerts(now)).Where("route_id IN ? OR route_id IS NULL", routeIDs).
+		Order("id asc").Find(&alerts).Error; err != nil {
+		return nil, err
+	}
+
+	found := map[uint][]models.Alert{}
+	for _, r := range routes {
+		for _, a := range alerts {
+			switch {
+			case a.RouteID != nil:
+				if *a.RouteID != r.ID {
+					continue
+				}
+			case a.AgencyID != nil:
+				if r.AgencyID == nil || *a.AgencyID != *r.AgencyID {
+					continue
+				}
+			}
+			found[r.ID] = append(found[r.ID], a)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"time"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"gorm.io/gorm"
+)
+
+// GraphQL mutations. They reuse the admin write functions of
+// admin_handlers.go; alerts are only managed here (see service.AlertService).
+
+// AlertPayload creates an alert; RouteID or AgencyID pick what it covers
+type AlertPayload struct {
+	AgencyID *uint      `json:"agency_id,omitempty"` // platform admins only
+	RouteID  *uint      `json:"route_id,omitempty"`
+	Severity string     `json:"severity"`
+	Title    string     `json:"title"`
+	Message  string     `json:"message"`
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+// UpdateAlertPayload changes the non-nil fields of an alert
+type UpdateAlertPayload struct {
+	Severity *string    `json:"severity"`
+	Title    *string    `json:"title"`
+	Message  *string    `json:"message"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+// Apply copies the set fields onto the alert
+func (p UpdateAlertPayload) Apply(alert *models.Alert) {
+	if p.Severity != nil {
+		alert.Severity = *p.Severity
+	}
+	if p.Title != nil {
+		alert.Title = *p.Title
+	}
+	if p.Message != nil {
+		alert.Message = *p.Message
+	}
+	if p.StartsAt != nil {
+		alert.StartsAt = p.StartsAt
+	}
+	if p.EndsAt != nil {
+		alert.EndsAt = p.EndsAt
+	}
+}
+
+func alertService(db *gorm.DB) service.AlertService {
+	return service.NewAlertService(repository.New(db))
+}
+
+// createAlert adds an alert to a route of the admin's agency, or to the agency
+func createAlert(c *gin.Context, db *gorm.DB, payload AlertPayload) (models.Alert, error) {
+	return alertService(db).Create(changeOf(c), models.Alert{
+		AgencyID: payload.AgencyID,
+		RouteID:  payload.RouteID,
+		Severity: payload.Severity,
+		Title:    payload.Title,
+		Message:  payload.Message,
+		StartsAt: payload.StartsAt,
+		EndsAt:   payload.EndsAt,
+	})
+}
+
+// updateAlert changes the set fields of an alert
+func updateAlert(c *gin.Context, db *gorm.DB, id uint, payload UpdateAlertPayload) (models.Alert, error) {
+	return alertService(db).Update(changeOf(c), id, payload.Apply)
+}
+
+// deleteAlert removes an alert
+func deleteAlert(c *gin.Context, db *gorm.DB, id uint) error {
+	return alertService(db).Delete(changeOf(c), id)
+}
+
+// ----------- Input conversion ------------
+
+// GraphQL inputs arrive as maps; these helpers read their optional fields
+
+func optString(in map[string]interface{}, name string) *string {
+	if v, ok := in[name].(string); ok {
+		return &v
+	}
+	return nil
+}
+
+func optInt(in map[string]interface{}, name string) *int {
+	if v, ok := in[name].(int); ok {
+		return &v
+	}
+	return nil
+}
+
+func optFloat(in map[string]interface{}, name string) *float64 {
+	if v, ok := in[name].(float64); ok {
+		return &v
+	}
+	return nil
+}
+
+func optTime(in map[string]interface{}, name string) *time.Time {
+	if v, ok := in[name].(time.Time); ok {
+		return &v
+	}
+	return nil
+}
+
+func inputMap(args map[string]interface{}, name string) map[string]interface{} {
+	in, _ := args[name].(map[string]interface{})
+	return in
+}
+
+func stopInput(in map[string]interface{}) (CreateStopPayload, error) {
+	p := CreateStopPayload{
+		Name:      in["name"].(string),
+		Latitude:  in["latitude"].(float64),
+		Longitude: in["longitude"].(float64),
+	}
+	if n := optInt(in, "orderIndex"); n != nil {
+		p.OrderIndex = *n
+	}
+	after, err := optArgID(in, "afterStopId")
+	p.AfterStopID = after
+	return p, err
+}
+
+func scheduleInput(in map[string]interface{}) CreateScheduleBody {
+	return CreateScheduleBody{Departure: in["departure"].(string), FrequencyMin: in["frequencyMin"].(int)}
+}
+
+func routeInput(in map[string]interface{}) (CreateRoutePayload, error) {
+	agencyID, err := optArgID(in, "agencyId")
+	if err != nil {
+		return CreateRoutePayload{}, err
+	}
+	p := CreateRoutePayload{AgencyID: agencyID, Name: in["name"].(string)}
+	if d := optString(in, "description"); d != nil {
+		p.Description = *d
+	}
+	stops, _ := in["stops"].([]interface{})
+	for _, s := range stops {
+		stop, err := stopInput(s.(map[string]interface{}))
+		if err != nil {
+			return p, err
+		}
+		p.Stops = append(p.Stops, stop)
+	}
+	schedules, _ := in["schedules"].([]interface{})
+	for _, s := range schedules {
+		p.Schedules = append(p.Schedules, scheduleInput(s.(map[string]interface{})))
+	}
+	return p, nil
+}
+
+func alertInput(in map[string]interface{}) (AlertPayload, error) {
+	p := AlertPayload{
+		Title:    in["title"].(string),
+		StartsAt: optTime(in, "startsAt"),
+		EndsAt:   optTime(in, "endsAt"),
+	}
+	if s := optString(in, "severity"); s != nil {
+		p.Severity = *s
+	}
+	if m := optString(in, "message"); m != nil {
+		p.Message = *m
+	}
+	var err error
+	if p.RouteID, err = optArgID(in, "routeId"); err != nil {
+		return p, err
+	}
+	p.AgencyID, err = optArgID(in, "agencyId")
+	return p, err
+}
+
+// ----------- Schema ------------
+
+// adminResolver wraps a mutation: the caller must carry a valid admin JWT
+// (checked by middleware.OptionalAuth), and errors get a code
+func adminResolver(fallback string, resolve func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error)) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		gc := graphCtx(p)
+		if _, ok := gc.c.Get(AdminIDContextKey); !ok {
+			return nil, &graphError{code: CodeUnauthorized, message: "missing token"}
+		}
+		v, err := resolve(gc.c, gc.db, p.Args)
+		if err != nil {
+			if _, ok := err.(*graphError); ok {
+				return nil, err
+			}
+			return nil, graphWriteError(err, fallback)
+		}
+		return v, nil
+	}
+}
+
+func newGraphMutations(route, stop, schedule, alert *graphql.Object, severity *graphql.Enum) *graphql.Object {
+	nonNull := graphql.NewNonNull
+	id := &graphql.ArgumentConfig{Type: nonNull(graphql.ID)}
+	input := func(t graphql.Input) *graphql.ArgumentConfig { return &graphql.ArgumentConfig{Type: nonNull(t)} }
+
+	stopInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "StopInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":        {Type: nonNull(graphql.String)},
+			"latitude":    {Type: nonNull(graphql.Float)},
+			"longitude":   {Type: nonNull(graphql.Float)},
+			"orderIndex":  {Type: graphql.Int},
+			"afterStopId": {Type: graphql.ID, Description: "insert after this stop (0 = first) instead of using orderIndex"},
+		},
+	})
+	stopPatch := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "StopPatch",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":       {Type: graphql.String},
+			"latitude":   {Type: graphql.Float},
+			"longitude":  {Type: graphql.Float},
+			"orderIndex": {Type: graphql.Int},
+		},
+	})
+	scheduleInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "ScheduleInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"departure":    {Type: nonNull(graphql.String), Description: `"06:30"`},
+			"frequencyMin": {Type: nonNull(graphql.Int)},
+		},
+	})
+	schedulePatch := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "SchedulePatch",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"departure":    {Type: graphql.String},
+			"frequencyMin": {Type: graphql.Int},
+		},
+	})
+	routeInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "RouteInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"agencyId":    {Type: graphql.ID, Description: "platform admins only"},
+			"name":        {Type: nonNull(graphql.String)},
+			"description": {Type: graphql.String},
+			"stops":       {Type: graphql.NewList(nonNull(stopInputType))},
+			"schedules":   {Type: graphql.NewList(nonNull(scheduleInputType))},
+		},
+	})
+	routePatch := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "RoutePatch",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":        {Type: graphql.String},
+			"description": {Type: graphql.String},
+		},
+	})
+	alertInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AlertInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"routeId":  {Type: graphql.ID, Description: "leave out for an agency-wide alert"},
+			"agencyId": {Type: graphql.ID, Description: "platform admins only"},
+			"severity": {Type: severity, DefaultValue: models.AlertInfo},
+			"title":    {Type: nonNull(graphql.String)},
+			"message":  {Type: graphql.String},
+			"startsAt": {Type: graphql.DateTime},
+			"endsAt":   {Type: graphql.DateTime},
+		},
+	})
+	alertPatch := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AlertPatch",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"severity": {Type: severity},
+			"title":    {Type: graphql.String},
+			"message":  {Type: graphql.String},
+			"startsAt": {Type: graphql.DateTime},
+			"endsAt":   {Type: graphql.DateTime},
+		},
+	})
+
+	deleted := func(err error) (interface{}, error) { return err == nil, err }
+
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createRoute": {
+				Type: nonNull(route),
+				Args: graphql.FieldConfigArgument{"input": input(routeInputType)},
+				Resolve: adminResolver("failed to create route", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					payload, err := routeInput(inputMap(args, "input"))
+					if err != nil {
+						return nil, err
+					}
+					r, err := createRoute(c, db, payload)
+					return &r, err
+				}),
+			},
+			"updateRoute": {
+				Type: nonNull(route),
+				Args: graphql.FieldConfigArgument{"id": id, "input": input(routePatch)},
+				Resolve: adminResolver("failed to update route", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					routeID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					in := inputMap(args, "input")
+					r, err := updateRoute(c, db, routeID, UpdateRoutePayload{
+						Name:        optString(in, "name"),
+						Description: optString(in, "description"),
+					})
+					return &r, err
+				}),
+			},
+			"deleteRoute": {
+				Type: nonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{"id": id},
+				Resolve: adminResolver("failed to delete route", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					routeID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					return deleted(deleteRoute(c, db, routeID))
+				}),
+			},
+			"addStop": {
+				Type: nonNull(stop),
+				Args: graphql.FieldConfigArgument{"routeId": id, "input": input(stopInputType)},
+				Resolve: adminResolver("failed to create stop", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					routeID, err := argID(args, "routeId")
+					if err != nil {
+						return nil, err
+					}
+					payload, err := stopInput(inputMap(args, "input"))
+					if err != nil {
+						return nil, err
+					}
+					s, err := addStop(c, db, routeID, payload)
+					return &s, err
+				}),
+			},
+			"updateStop": {
+				Type: nonNull(stop),
+				Args: graphql.FieldConfigArgument{"id": id, "input": input(stopPatch)},
+				Resolve: adminResolver("failed to update stop", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					stopID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					in := inputMap(args, "input")
+					s, err := updateStop(c, db, stopID, UpdateStopPayload{
+						Name:       optString(in, "name"),
+						Latitude:   optFloat(in, "latitude"),
+						Longitude:  optFloat(in, "longitude"),
+						OrderIndex: optInt(in, "orderIndex"),
+					})
+					return &s, err
+				}),
+			},
+			"deleteStop": {
+				Type: nonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{"id": id},
+				Resolve: adminResolver("failed to delete stop", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					stopID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					return deleted(deleteStop(c, db, stopID))
+				}),
+			},
+			"addSchedule": {
+				Type: nonNull(schedule),
+				Args: graphql.FieldConfigArgument{"routeId": id, "input": input(scheduleInputType)},
+				Resolve: adminResolver("failed to create schedule", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					routeID, err := argID(args, "routeId")
+					if err != nil {
+						return nil, err
+					}
+					s, err := addSchedule(c, db, routeID, scheduleInput(inputMap(args, "input")))
+					return &s, err
+				}),
+			},
+			"updateSchedule": {
+				Type: nonNull(schedule),
+				Args: graphql.FieldConfigArgument{"id": id, "input": input(schedulePatch)},
+				Resolve: adminResolver("failed to update schedule", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					schID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					in := inputMap(args, "input")
+					s, err := updateSchedule(c, db, schID, UpdateSchedulePayload{
+						Departure:    optString(in, "departure"),
+						FrequencyMin: optInt(in, "frequencyMin"),
+					})
+					return &s, err
+				}),
+			},
+			"deleteSchedule": {
+				Type: nonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{"id": id},
+				Resolve: adminResolver("failed to delete schedule", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					schID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					return deleted(deleteSchedule(c, db, schID))
+				}),
+			},
+			"createAlert": {
+				Type: nonNull(alert),
+				Args: graphql.FieldConfigArgument{"input": input(alertInputType)},
+				Resolve: adminResolver("failed to create alert", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					payload, err := alertInput(inputMap(args, "input"))
+					if err != nil {
+						return nil, err
+					}
+					a, err := createAlert(c, db, payload)
+					return &a, err
+				}),
+			},
+			"updateAlert": {
+				Type: nonNull(alert),
+				Args: graphql.FieldConfigArgument{"id": id, "input": input(alertPatch)},
+				Resolve: adminResolver("failed to update alert", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					alertID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					in := inputMap(args, "input")
+					a, err := updateAlert(c, db, alertID, UpdateAlertPayload{
+						Severity: optString(in, "severity"),
+						Title:    optString(in, "title"),
+						Message:  optString(in, "message"),
+						StartsAt: optTime(in, "startsAt"),
+						EndsAt:   optTime(in, "endsAt"),
+					})
+					return &a, err
+				}),
+			},
+			"deleteAlert": {
+				Type: nonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{"id": id},
+				Resolve: adminResolver("failed to delete alert", func(c *gin.Context, db *gorm.DB, args map[string]interface{}) (interface{}, error) {
+					alertID, err := argID(args, "id")
+					if err != nil {
+						return nil, err
+					}
+					return deleted(deleteAlert(c, db, alertID))
+				}),
+			},
+		},
+	})
+}
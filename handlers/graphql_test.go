@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"busapp/config"
+	"busapp/db"
+	"busapp/migrations"
+	"busapp/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql/language/parser"
+	"gorm.io/gorm"
+)
+
+// newGraphDB returns a migrated SQLite database with agencies 1 and 2 and
+// routes routes per agency, each with two stops, a schedule and an alert.
+// *queries counts the SELECTs run on it.
+func newGraphDB(t *testing.T, routes int) (gdb *gorm.DB, queries *int) {
+	t.Helper()
+	gdb, err := db.InitDB(filepath.Join(t.TempDir(), "graphql.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlDB, err := gdb.DB(); err == nil {
+		t.Cleanup(func() { sqlDB.Close() })
+	}
+	if _, err := migrations.Up(gdb, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Lagos", "Paris"} {
+		agency := models.Agency{Name: name}
+		if err := gdb.Create(&agency).Error; err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < routes; i++ {
+			route := models.Route{
+				AgencyID: &agency.ID,
+				Name:     fmt.Sprintf("%s %d", name, i+1),
+				Stops: []models.Stop{
+					{Name: "A", Latitude: 6.45, Longitude: 3.39, OrderIndex: 1},
+					{Name: "B", Latitude: 6.46, Longitude: 3.40, OrderIndex: 2},
+				},
+				Schedules: []models.Schedule{{Departure: "06:00", FrequencyMin: 30}},
+			}
+			if err := gdb.Create(&route).Error; err != nil {
+				t.Fatal(err)
+			}
+			alert := models.Alert{AgencyID: &agency.ID, RouteID: &route.ID, Severity: models.AlertInfo, Title: "detour"}
+			if err := gdb.Create(&alert).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	queries = new(int)
+	err = gdb.Callback().Query().After("gorm:query").Register("test:count_queries", func(*gorm.DB) { *queries++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gdb, queries
+}
+
+// graphAdmin is the admin a query runs as: nil for anonymous requests
+type graphAdmin struct {
+	agencyID uint // 0 = platform admin
+}
+
+// runGraph runs query through GraphQLHandler
+func runGraph(t *testing.T, gdb *gorm.DB, admin *graphAdmin, query string) (int, GraphQLResponse) {
+	t.Helper()
+	body, _ := json.Marshal(GraphQLRequest{Query: query})
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/graphql", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	if admin != nil {
+		c.Set(AdminIDContextKey, uint(1))
+		c.Set(AdminUsernameContextKey, "tester")
+		if admin.agencyID != 0 {
+			c.Set(AgencyIDContextKey, admin.agencyID)
+		}
+	}
+	GraphQLHandler(c, gdb)
+
+	var resp GraphQLResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %s", w.Body)
+	}
+	return w.Code, resp
+}
+
+// errorCode is the code of the first error of resp ("" when there is none)
+func errorCode(resp GraphQLResponse) string {
+	if len(resp.Errors) == 0 {
+		return ""
+	}
+	code, _ := resp.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+func TestEstimateCost(t *testing.T) {
+	tests := []struct {
+		query       string
+		vars        map[string]interface{}
+		cost, depth int
+	}{
+		{query: `{routes(limit: 2){id name}}`, cost: 2, depth: 2},
+		{query: `{routes{id}}`, cost: defaultRouteListLimit, depth: 2},
+		{query: `{agencies{name}}`, cost: graphListSize, depth: 2}, // unbounded list
+		{query: `{routes(limit: 5){stops{name} agency{name}}}`, cost: 5 * (1 + graphListSize + 1), depth: 3},
+		{query: `query($n: Int){routes(limit: $n){id}}`, vars: map[string]interface{}{"n": 7.0}, cost: 7, depth: 2},
+		{query: `{route(id: 1){...r}} fragment r on Route {stops{id}}`, cost: 1 + graphListSize, depth: 3},
+		{query: `{route(id: 1){departures(limit: 3){etas{eta}}}}`, cost: 1 + 3*(1+graphListSize), depth: 4},
+		{query: `{__schema{types{name}}}`, cost: 0, depth: 1},
+		{query: `mutation{deleteRoute(id: 1)}`, cost: 0, depth: 1},
+	}
+	for _, tt := range tests {
+		doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		cost, depth, err := estimateCost(graphSchema, doc, "", tt.vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if cost != tt.cost || depth != tt.depth {
+			t.Errorf("%s: cost %d, depth %d, want %d and %d", tt.query, cost, depth, tt.cost, tt.depth)
+		}
+	}
+}
+
+func TestTooComplexQueriesAreRefused(t *testing.T) {
+	gdb, queries := newGraphDB(t, 1)
+
+	cfg := *config.Get()
+	cfg.GraphQLMaxCost = 1000
+	prev := config.Get()
+	config.Set(&cfg)
+	t.Cleanup(func() { config.Set(prev) })
+
+	tests := []struct {
+		name, query, message string
+	}{
+		{"cost", `{routes(limit: 100){stops{name}}}`, "cost 2100 of max 1000"},
+		{"depth", `{route(id: 1){stops{route{stops{route{stops{route{stops{route{stops{name}}}}}}}}}}}`, "depth 11 of max 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*queries = 0
+			status, resp := runGraph(t, gdb, nil, tt.query)
+			if status != http.StatusBadRequest || errorCode(resp) != CodeQueryTooComplex {
+				t.Fatalf("status %d, errors %v", status, resp.Errors)
+			}
+			if !strings.Contains(resp.Errors[0].Message, tt.message) {
+				t.Errorf("message %q, want %q in it", resp.Errors[0].Message, tt.message)
+			}
+			if details, _ := resp.Errors[0].Extensions["details"].(map[string]interface{}); details["max_cost"] != 1000.0 {
+				t.Errorf("details %v, want max_cost 1000", resp.Errors[0].Extensions["details"])
+			}
+			if *queries != 0 {
+				t.Errorf("%d queries ran for a refused request", *queries)
+			}
+		})
+	}
+}
+
+func TestGraphLoadersBatch(t *testing.T) {
+	gdb, queries := newGraphDB(t, 25)
+	query := `{routes(limit: %d){name agency{name} stops{name route{name}} schedules{departure} alerts{title route{name}}}}`
+
+	counts := map[int]int{}
+	for _, n := range []int{2, 50} {
+		*queries = 0
+		status, resp := runGraph(t, gdb, nil, fmt.Sprintf(query, n))
+		if status != http.StatusOK || len(resp.Errors) > 0 {
+			t.Fatalf("status %d, errors %v", status, resp.Errors)
+		}
+		routes, _ := resp.Data.(map[string]interface{})["routes"].([]interface{})
+		if len(routes) != n {
+			t.Fatalf("%d routes, want %d", len(routes), n)
+		}
+		counts[n] = *queries
+	}
+	// routes, agencies, stops, schedules, and alerts with their routes
+	if counts[50] != counts[2] || counts[50] > 6 {
+		t.Errorf("%d queries for 2 routes, %d for 50: want the same few", counts[2], counts[50])
+	}
+}
+
+func TestGraphMutationsStayInTheirAgency(t *testing.T) {
+	gdb, _ := newGraphDB(t, 1) // route 1 (stops 1-2, schedule 1, alert 1) in agency 1, route 2 (3-4, 2, 2) in agency 2
+	lagos, platform := &graphAdmin{agencyID: 1}, &graphAdmin{}
+
+	tests := []struct {
+		name  string
+		admin *graphAdmin
+		query string
+		code  string // of the error, "" for success
+		want  string // in the data
+	}{
+		{"anonymous", nil, `mutation{deleteRoute(id: 1)}`, CodeUnauthorized, ""},
+		{"update a route of another agency", lagos, `mutation{updateRoute(id: 2, input: {name: "hijacked"}){name}}`, CodeNotFound, ""},
+		{"delete a route of another agency", lagos, `mutation{deleteRoute(id: 2)}`, CodeNotFound, ""},
+		{"add a stop to another agency", lagos, `mutation{addStop(routeId: 2, input: {name: "X", latitude: 1, longitude: 1}){id}}`, CodeNotFound, ""},
+		{"update a stop of another agency", lagos, `mutation{updateStop(id: 3, input: {name: "hijacked"}){name}}`, CodeNotFound, ""},
+		{"delete a schedule of another agency", lagos, `mutation{deleteSchedule(id: 2)}`, CodeNotFound, ""},
+		{"alert a route of another agency", lagos, `mutation{createAlert(input: {routeId: 2, title: "x"}){id}}`, CodeNotFound, ""},
+		{"update an alert of another agency", lagos, `mutation{updateAlert(id: 2, input: {title: "hijacked"}){id}}`, CodeNotFound, ""},
+		{"delete an alert of another agency", lagos, `mutation{deleteAlert(id: 2)}`, CodeNotFound, ""},
+		{"create in another agency", lagos, `mutation{createRoute(input: {agencyId: 2, name: "Mine"}){agency{name}}}`, "", "Lagos"},
+		{"alert another agency", lagos, `mutation{createAlert(input: {agencyId: 2, title: "Mine"}){agency{name}}}`, "", "Lagos"},
+		{"update in the own agency", lagos, `mutation{updateRoute(id: 1, input: {name: "Renamed"}){name}}`, "", "Renamed"},
+		{"platform admins pick the agency", platform, `mutation{createRoute(input: {agencyId: 2, name: "Theirs"}){agency{name}}}`, "", "Paris"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, resp := runGraph(t, gdb, tt.admin, tt.query)
+			if status != http.StatusOK {
+				t.Fatalf("status %d, errors %v", status, resp.Errors)
+			}
+			if code := errorCode(resp); code != tt.code {
+				t.Fatalf("error code %q, want %q (errors %v)", code, tt.code, resp.Errors)
+			}
+			if data, _ := json.Marshal(resp.Data); !strings.Contains(string(data), tt.want) {
+				t.Errorf("data %s, want %q in it", data, tt.want)
+			}
+		})
+	}
+
+	// nothing of agency 2 changed
+	var route models.Route
+	if err := gdb.Preload("Stops").Preload("Schedules").First(&route, 2).Error; err != nil {
+		t.Fatal(err)
+	}
+	if route.Name != "Paris 1" || len(route.Stops) != 2 || route.Stops[0].Name != "A" || len(route.Schedules) != 1 {
+		t.Errorf("route 2 changed: %+v", route)
+	}
+	var alert models.Alert
+	if err := gdb.First(&alert, 2).Error; err != nil || alert.Title != "detour" {
+		t.Errorf("alert 2 changed: %+v, %v", alert, err)
+	}
+}
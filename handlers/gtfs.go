@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"busapp/config"
+	"busapp/models"
+	"busapp/service"
+)
+
+/*
+GTFS feeds (static schedule, https://gtfs.org/schedule/reference/).
+
+Export (GET /admin/export?format=gtfs, busapp export gtfs) writes agency,
+stops, routes, trips, stop_times, calendar and frequencies. Every schedule
+becomes one trip running daily, repeated every frequency_min minutes from its
+departure until midnight (frequencies.txt), with stop times estimated like the
+next-bus ETAs. Stops are per route here, so a stop_id is a stop of one route.
+
+Import (a GTFS zip posted to /admin/upload-csv, busapp import gtfs) maps each
+GTFS route to a route with the stops of its longest trip in the direction of
+its first trip. frequencies.txt entries become schedules as they are; plain
+trips are folded into one schedule starting at the earliest departure with the
+median gap between departures (1440 for a single trip). Calendars are ignored.
+The result goes through the CSV import, so matching and validation are the
+same and re-importing a feed changes nothing.
+*/
+
+// gtfsEndOfService is when exported frequency trips stop
+const gtfsEndOfService = "24:00:00"
+
+// gtfsTable is one file of a feed: header then rows
+type gtfsTable struct {
+	name string
+	rows [][]string
+}
+
+// WriteGTFS writes routes (see ExportRoutes) as a GTFS zip
+func WriteGTFS(w io.Writer, routes []models.Route) error {
+	agency := gtfsTable{name: "agency.txt", rows: [][]string{{"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_phone"}}}
+	stops := gtfsTable{name: "stops.txt", rows: [][]string{{"stop_id", "stop_name", "stop_lat", "stop_lon"}}}
+	gtfsRoutes := gtfsTable{name: "routes.txt", rows: [][]string{{"route_id", "agency_id", "route_short_name", "route_long_name", "route_desc", "route_type"}}}
+	trips := gtfsTable{name: "trips.txt", rows: [][]string{{"route_id", "service_id", "trip_id"}}}
+	stopTimes := gtfsTable{name: "stop_times.txt", rows: [][]string{{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"}}}
+	frequencies := gtfsTable{name: "frequencies.txt", rows: [][]string{{"trip_id", "start_time", "end_time", "headway_secs", "exact_times"}}}
+
+	today := time.Now()
+	calendar := gtfsTable{name: "calendar.txt", rows: [][]string{
+		{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"},
+		{"daily", "1", "1", "1", "1", "1", "1", "1", today.Format("20060102"), today.AddDate(1, 0, 0).Format("20060102")},
+	}}
+
+	agencies := map[string]bool{}
+	for _, r := range routes {
+		agencyID := "default"
+		if r.Agency != nil {
+			agencyID = strconv.FormatUint(uint64(r.Agency.ID), 10)
+		}
+		if !agencies[agencyID] {
+			agencies[agencyID] = true
+			if r.Agency != nil {
+				tz := r.Agency.Timezone
+				if tz == "" {
+					tz = config.Get().Location().String()
+				}
+				agency.rows = append(agency.rows, []string{agencyID, r.Agency.Name, r.Agency.URL, tz, r.Agency.Phone})
+			} else {
+				agency.rows = append(agency.rows, []string{agencyID, "busapp", "https://example.com", config.Get().Location().String(), ""})
+			}
+		}
+
+		routeID := strconv.FormatUint(uint64(r.ID), 10)
+		gtfsRoutes.rows = append(gtfsRoutes.rows, []string{routeID, agencyID, "", r.Name, r.Description, "3"}) // 3 = bus
+		for _, s := range r.Stops {
+			stops.rows = append(stops.rows, []string{
+				strconv.FormatUint(uint64(s.ID), 10),
+				s.Name,
+				strconv.FormatFloat(s.Latitude, 'f', -1, 64),
+				strconv.FormatFloat(s.Longitude, 'f', -1, 64),
+			})
+		}
+
+		for _, sch := range r.Schedules {
+			dep, err := time.Parse("15:04", sch.Departure)
+			if err != nil || sch.FrequencyMin <= 0 {
+				continue // invalid schedules are reported by the validation rules
+			}
+			tripID := fmt.Sprintf("%d-%d", r.ID, sch.ID)
+			trips.rows = append(trips.rows, []string{routeID, "daily", tripID})
+
+			midnight := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+			departure := midnight.Add(time.Duration(dep.Hour())*time.Hour + time.Duration(dep.Minute())*time.Minute)
+			for i, arrival := range service.StopArrivals(r.Stops, departure, config.Get().AverageSpeedKmH) {
+				t := gtfsTime(arrival.Sub(midnight))
+				stopTimes.rows = append(stopTimes.rows, []string{
+					tripID, t, t, strconv.FormatUint(uint64(r.Stops[i].ID), 10), strconv.Itoa(i + 1),
+				})
+			}
+			frequencies.rows = append(frequencies.rows, []string{
+				tripID, gtfsTime(departure.Sub(midnight)), gtfsEndOfService, strconv.Itoa(sch.FrequencyMin * 60), "1",
+			})
+		}
+	}
+
+	zw := zip.NewWriter(w)
+	for _, t := range []gtfsTable{agency, stops, gtfsRoutes, trips, stopTimes, calendar, frequencies} {
+		f, err := zw.Create(t.name)
+		if err != nil {
+			return err
+		}
+		cw := csv.NewWriter(f)
+		if err := cw.WriteAll(t.rows); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// gtfsTime formats a time since midnight as HH:MM:SS (hours may exceed 23)
+func gtfsTime(d time.Duration) string {
+	s := int(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// parseGTFSTime parses HH:MM:SS into seconds since midnight; HH may pass 24
+// for trips after midnight
+func parseGTFSTime(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || (i == 0 && n > 99) || (i > 0 && n > 59) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		v[i] = n
+	}
+	return v[0]*3600 + v[1]*60 + v[2], nil
+}
+
+// IsGTFS reports whether a zip archive looks like a GTFS feed
+func IsGTFS(archive *zip.Reader) bool {
+	for _, f := range archive.File {
+		if path.Base(f.Name) == "stop_times.txt" {
+			return true
+		}
+	}
+	return false
+}
+
+// gtfsFile is a parsed feed file: rows as column -> value, with line numbers
+type gtfsFile struct {
+	name  string
+	rows  []map[string]string
+	lines []int
+}
+
+func (f gtfsFile) at(i int) string {
+	return fmt.Sprintf("%s line %d", f.name, f.lines[i])
+}
+
+// readGTFSFile parses a feed file; a missing optional file is empty
+func readGTFSFile(archive *zip.Reader, name string, required ...string) (gtfsFile, error) {
+	file := gtfsFile{name: name}
+	var entry *zip.File
+	for _, f := range archive.File {
+		if path.Base(f.Name) == name {
+			entry = f
+		}
+	}
+	if entry == nil {
+		if len(required) > 0 {
+			return file, fmt.Errorf("%s is missing", name)
+		}
+		return file, nil
+	}
+
+	r, err := entry.Open()
+	if err != nil {
+		return file, fmt.Errorf("cannot read %s: %w", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxCSVUploadBytes))
+	if err != nil {
+		return file, fmt.Errorf("cannot read %s: %w", name, err)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return file, fmt.Errorf("%s: missing header", name)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	for _, col := range required {
+		found := false
+		for _, h := range header {
+			found = found || h == col
+		}
+		if !found {
+			return file, fmt.Errorf("%s: missing column %s", name, col)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return file, fmt.Errorf("%s: %w", name, err)
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		row := map[string]string{}
+		for i, h := range header {
+			if i < len(record) {
+				row[h] = strings.TrimSpace(record[i])
+			}
+		}
+		file.rows = append(file.rows, row)
+		file.lines = append(file.lines, line)
+	}
+	return file, nil
+}
+
+// linedSheet is an import sheet whose rows keep the line numbers of the feed
+// file they came from
+type linedSheet struct {
+	name    string
+	records [][]string
+	lines   []int
+}
+
+func (s *linedSheet) add(line int, record ...string) {
+	s.records = append(s.records, record)
+	s.lines = append(s.lines, line)
+}
+
+func (s *linedSheet) sheet() ImportSheet {
+	i := 0
+	return ImportSheet{Name: s.name, Read: func() ([]string, int, error) {
+		if i >= len(s.records) {
+			return nil, 0, io.EOF
+		}
+		i++
+		return s.records[i-1], s.lines[i-1], nil
+	}}
+}
+
+// ReadGTFS converts a GTFS feed into import sheets (see the mapping above)
+func ReadGTFS(archive *zip.Reader) ([]ImportSheet, error) {
+	stopsFile, err := readGTFSFile(archive, "stops.txt", "stop_id", "stop_lat", "stop_lon")
+	if err != nil {
+		return nil, err
+	}
+	routesFile, err := readGTFSFile(archive, "routes.txt", "route_id")
+	if err != nil {
+		return nil, err
+	}
+	tripsFile, err := readGTFSFile(archive, "trips.txt", "route_id", "trip_id")
+	if err != nil {
+		return nil, err
+	}
+	stopTimesFile, err := readGTFSFile(archive, "stop_times.txt", "trip_id", "stop_id", "stop_sequence")
+	if err != nil {
+		return nil, err
+	}
+	frequenciesFile, err := readGTFSFile(archive, "frequencies.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	stops := map[string]int{} // stop_id -> row
+	for i, s := range stopsFile.rows {
+		stops[s["stop_id"]] = i
+	}
+
+	// stop times by trip, in sequence order
+	type stopTime struct {
+		row      int
+		sequence int
+		depart   int // seconds, -1 when blank
+	}
+	tripStops := map[string][]stopTime{}
+	for i, st := range stopTimesFile.rows {
+		if _, ok := stops[st["stop_id"]]; !ok {
+			return nil, fmt.Errorf("%s: unknown stop_id %q", stopTimesFile.at(i), st["stop_id"])
+		}
+		seq, err := strconv.Atoi(st["stop_sequence"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid stop_sequence %q", stopTimesFile.at(i), st["stop_sequence"])
+		}
+		depart := -1
+		t := st["departure_time"]
+		if t == "" {
+			t = st["arrival_time"]
+		}
+		if t != "" {
+			if depart, err = parseGTFSTime(t); err != nil {
+				return nil, fmt.Errorf("%s: %v", stopTimesFile.at(i), err)
+			}
+		}
+		tripStops[st["trip_id"]] = append(tripStops[st["trip_id"]], stopTime{row: i, sequence: seq, depart: depart})
+	}
+	for _, sts := range tripStops {
+		sort.Slice(sts, func(a, b int) bool { return sts[a].sequence < sts[b].sequence })
+	}
+
+	frequencies := map[string][]int{} // trip_id -> rows
+	for i, f := range frequenciesFile.rows {
+		frequencies[f["trip_id"]] = append(frequencies[f["trip_id"]], i)
+	}
+
+	routeTrips := map[string][]int{} // route_id -> trip rows
+	for i, t := range tripsFile.rows {
+		routeTrips[t["route_id"]] = append(routeTrips[t["route_id"]], i)
+	}
+
+	header := []string{colRouteName, colRouteDesc, colStopName, colStopLat, colStopLon, colStopOrder, colDeparture, colFrequency}
+	routeSheet := &linedSheet{name: routesFile.name}
+	stopSheet := &linedSheet{name: stopTimesFile.name}
+	scheduleSheet := &linedSheet{name: tripsFile.name}
+	for _, s := range []*linedSheet{routeSheet, stopSheet, scheduleSheet} {
+		s.add(1, header...)
+	}
+
+	for i, r := range routesFile.rows {
+		name := r["route_long_name"]
+		if name == "" {
+			name = r["route_short_name"]
+		}
+		if name == "" {
+			name = r["route_id"]
+		}
+		routeSheet.add(routesFile.lines[i], name, r["route_desc"], "", "", "", "", "", "")
+
+		trips := routeTrips[r["route_id"]]
+		if len(trips) == 0 {
+			continue
+		}
+
+		// stop pattern: longest trip in the direction of the first one
+		direction := tripsFile.rows[trips[0]]["direction_id"]
+		var pattern []stopTime
+		var sameDirection []int
+		for _, t := range trips {
+			trip := tripsFile.rows[t]
+			if trip["direction_id"] != direction {
+				continue
+			}
+			sameDirection = append(sameDirection, t)
+			if sts := tripStops[trip["trip_id"]]; len(sts) > len(pattern) {
+				pattern = sts
+			}
+		}
+		for order, st := range pattern {
+			stop := stopsFile.rows[stops[stopTimesFile.rows[st.row]["stop_id"]]]
+			stopName := stop["stop_name"]
+			if stopName == "" {
+				stopName = stop["stop_id"]
+			}
+			stopSheet.add(stopTimesFile.lines[st.row], name, "", stopName, stop["stop_lat"], stop["stop_lon"], strconv.Itoa(order+1), "", "")
+		}
+
+		// schedules: frequency entries as they are, plain trips folded into one
+		var departures []int
+		firstLine := 0
+		for _, t := range sameDirection {
+			trip := tripsFile.rows[t]
+			if rows := frequencies[trip["trip_id"]]; len(rows) > 0 {
+				for _, f := range rows {
+					start, err := parseGTFSTime(frequenciesFile.rows[f]["start_time"])
+					if err != nil {
+						return nil, fmt.Errorf("%s: %v", frequenciesFile.at(f), err)
+					}
+					headway, err := strconv.Atoi(frequenciesFile.rows[f]["headway_secs"])
+					if err != nil || headway <= 0 {
+						return nil, fmt.Errorf("%s: invalid headway_secs %q", frequenciesFile.at(f), frequenciesFile.rows[f]["headway_secs"])
+					}
+					scheduleSheet.add(tripsFile.lines[t], name, "", "", "", "", "",
+						hhmm(start), strconv.Itoa(max(1, int(math.Round(float64(headway)/60)))))
+				}
+				continue
+			}
+			if sts := tripStops[trip["trip_id"]]; len(sts) > 0 && sts[0].depart >= 0 {
+				departures = append(departures, sts[0].depart)
+				if firstLine == 0 {
+					firstLine = tripsFile.lines[t]
+				}
+			}
+		}
+		if len(departures) > 0 {
+			scheduleSheet.add(firstLine, name, "", "", "", "", "", hhmm(minInt(departures)), strconv.Itoa(medianGapMinutes(departures)))
+		}
+	}
+
+	return []ImportSheet{routeSheet.sheet(), stopSheet.sheet(), scheduleSheet.sheet()}, nil
+}
+
+// hhmm formats seconds since midnight as "15:04", wrapping past midnight
+func hhmm(seconds int) string {
+	minutes := seconds / 60 % (24 * 60)
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+func minInt(v []int) int {
+	m := v[0]
+	for _, x := range v[1:] {
+		m = min(m, x)
+	}
+	return m
+}
+
+// medianGapMinutes is the median time between sorted departures (1440 for one)
+func medianGapMinutes(departures []int) int {
+	sorted := append([]int(nil), departures...)
+	sort.Ints(sorted)
+	var gaps []int
+	for i := 1; i < len(sorted); i++ {
+		if gap := sorted[i] - sorted[i-1]; gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return 24 * 60
+	}
+	sort.Ints(gaps)
+	return max(1, int(math.Round(float64(gaps[len(gaps)/2])/60)))
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func FuzzParseGTFSTime(f *testing.F) {
+	for _, s := range []string{"06:00:00", "25:30:15", " 7:05:09 ", "24:00", "12:60:00", "-1:00:00", "+1:+2:+3", "99999999999999999:00:00"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		seconds, err := parseGTFSTime(s)
+		if err != nil {
+			return
+		}
+		if seconds < 0 {
+			t.Fatalf("parseGTFSTime(%q) = %d", s, seconds)
+		}
+		// what parses must format back to the same time
+		formatted := gtfsTime(time.Duration(seconds) * time.Second)
+		if again, err := parseGTFSTime(formatted); err != nil || again != seconds {
+			t.Fatalf("parseGTFSTime(%q) = %d, formatted %q parses as %d, %v", s, seconds, formatted, again, err)
+		}
+	})
+}
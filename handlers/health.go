@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"busapp/migrations"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Probes for orchestrators and load balancers, outside the versioned API:
+- GET /healthz - liveness: the process answers
+- GET /readyz  - readiness: the database answers, its schema is current and
+                 the background jobs run; 503 naming the failed checks otherwise
+*/
+
+// ReadyCheck is a readiness condition; Check returns why it is not met
+type ReadyCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// readyTimeout bounds each readiness check
+const readyTimeout = 2 * time.Second
+
+// HealthzHandler - liveness probe
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, StatusResponse{Status: "ok"})
+}
+
+// ReadyzHandler - readiness probe: the database checks followed by extra
+func ReadyzHandler(c *gin.Context, db *gorm.DB, extra ...ReadyCheck) {
+	checks := append([]ReadyCheck{
+		{Name: "database", Check: func(ctx context.Context) error {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		}},
+		{Name: "migrations", Check: func(ctx context.Context) error {
+			return migrations.Check(db.WithContext(ctx))
+		}},
+	}, extra...)
+
+	resp := ReadinessResponse{Status: "ok", Checks: map[string]string{}}
+	status := http.StatusOK
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+		err := check.Check(ctx)
+		cancel()
+		if err != nil {
+			resp.Checks[check.Name] = err.Error()
+			resp.Status, status = "unavailable", http.StatusServiceUnavailable
+			continue
+		}
+		resp.Checks[check.Name] = "ok"
+	}
+	c.JSON(status, resp)
+}
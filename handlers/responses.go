@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"busapp/models"
+	"busapp/search"
+	"busapp/spatial"
+	"busapp/validation"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Response DTOs for bodies that are not a model or a list of models
+
+// StatusResponse acknowledges an action ("deleted", "reverted", ...)
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// MessageResponse carries a human-readable confirmation
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// TokenResponse is returned by a successful login
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
+// CreatedAPIKeyResponse holds a new key; Key is the plain key, shown only once
+type CreatedAPIKeyResponse struct {
+	Key    string        `json:"key"`
+	APIKey models.APIKey `json:"api_key"`
+}
+
+// APIKeyUsageResponse lists the request counts of a key
+type APIKeyUsageResponse struct {
+	APIKey models.APIKey        `json:"api_key"`
+	Usage  []models.APIKeyUsage `json:"usage"`
+}
+
+// ValidationReport is the result of validating the network
+type ValidationReport struct {
+	Valid    bool               `json:"valid"`
+	Errors   []validation.Issue `json:"errors"`
+	Warnings []validation.Issue `json:"warnings"`
+}
+
+// ValidationDetails are the details of a validation_failed error: the
+// issues that made a strict write fail
+type ValidationDetails struct {
+	Issues []validation.Issue `json:"issues"`
+}
+
+// QueryCostDetails are the details of a query_too_complex GraphQL error
+type QueryCostDetails struct {
+	Cost     int `json:"cost"`
+	MaxCost  int `json:"max_cost"`
+	Depth    int `json:"depth"`
+	MaxDepth int `json:"max_depth"`
+}
+
+// SearchResponse holds ranked search results
+type SearchResponse struct {
+	Query   string          `json:"query"`
+	Results []search.Result `json:"results"`
+}
+
+// StopsResponse holds stops found by location
+type StopsResponse struct {
+	Stops []spatial.Stop `json:"stops"`
+}
+
+// StopETA is the estimated arrival of a bus at a stop ("15:04")
+type StopETA struct {
+	Stop string `json:"stop"`
+	ETA  string `json:"eta"`
+}
+
+// BusTrip is one upcoming departure with its stop ETAs
+type BusTrip struct {
+	Departure string    `json:"departure"`
+	ETAs      []StopETA `json:"etas"`
+}
+
+// NextBusResponse describes the next departures of a route
+type NextBusResponse struct {
+	RouteID     uint           `json:"route_id"`
+	RouteName   string         `json:"route_name"`
+	Agency      *models.Agency `json:"agency"`
+	CurrentTime string         `json:"current_time"`
+	NextBus     string         `json:"next_bus"`
+	Frequency   string         `json:"frequency"`
+	Buses       []BusTrip      `json:"buses"`
+}
+
+// GraphQLResponse is the result of a GraphQL request
+type GraphQLResponse struct {
+	Data   interface{}                `json:"data,omitempty"`
+	Errors []gqlerrors.FormattedError `json:"errors,omitempty"`
+}
+
+// ReadinessResponse reports each readiness check: "ok" or why it failed
+type ReadinessResponse struct {
+	Status string            `json:"status"` // ok or unavailable
+	Checks map[string]string `json:"checks"`
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"busapp/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Route list parameters (GET /routes and GET /public/routes):
+- limit, offset  -> page size (default 50, max 500) and start
+- q              -> name contains (case-insensitive)
+- agency         -> agency ID
+- stop_id, stop  -> routes serving a stop, by ID or by name (contains)
+- sort           -> id, name or created_at; prefix with - for descending
+- include        -> comma list of stops, schedules, agency ("none" for bare routes)
+
+The body stays a JSON array. X-Total-Count carries the number of matching
+routes and a Link header with rel="next" points at the next page.
+*/
+
+const (
+	defaultRouteListLimit = 50
+	maxRouteListLimit     = 500
+)
+
+var routeSortColumns = map[string]string{
+	"id":         "routes.id",
+	"name":       "routes.name",
+	"created_at": "routes.created_at",
+}
+
+var routeIncludes = map[string]bool{"stops": true, "schedules": true, "agency": true}
+
+// routeListQuery holds the parsed list parameters
+type routeListQuery struct {
+	Limit    int
+	Offset   int
+	Name     string
+	AgencyID uint
+	StopID   uint
+	StopName string
+	Order    string
+	Include  []string
+}
+
+// parseRouteListQuery reads the list parameters; defaultInclude is used when
+// include is not given
+func parseRouteListQuery(c *gin.Context, defaultInclude []string) (routeListQuery, error) {
+	q := routeListQuery{
+		Limit:    defaultRouteListLimit,
+		Name:     strings.TrimSpace(c.Query("q")),
+		StopName: strings.TrimSpace(c.Query("stop")),
+		Order:    "routes.id asc",
+		Include:  defaultInclude,
+	}
+
+	var err error
+	uintParam := func(name string) uint {
+		s := c.Query(name)
+		if s == "" || err != nil {
+			return 0
+		}
+		n, perr := strconv.ParseUint(s, 10, 64)
+		if perr != nil {
+			err = fmt.Errorf("invalid %s", name)
+		}
+		return uint(n)
+	}
+	if limit := int(uintParam("limit")); limit > 0 {
+		q.Limit = limit
+	}
+	if q.Limit > maxRouteListLimit {
+		q.Limit = maxRouteListLimit
+	}
+	q.Offset = int(uintParam("offset"))
+	q.AgencyID = uintParam("agency")
+	q.StopID = uintParam("stop_id")
+	if err != nil {
+		return q, err
+	}
+
+	if sort := c.Query("sort"); sort != "" {
+		dir := "asc"
+		if strings.HasPrefix(sort, "-") {
+			sort, dir = sort[1:], "desc"
+		}
+		col, ok := routeSortColumns[sort]
+		if !ok {
+			return q, errors.New("sort must be id, name or created_at")
+		}
+		q.Order = col + " " + dir + ", routes.id " + dir
+	}
+
+	if include, ok := c.GetQuery("include"); ok {
+		q.Include = nil
+		for _, inc := range strings.Split(include, ",") {
+			inc = strings.TrimSpace(inc)
+			if inc == "" || inc == "none" {
+				continue
+			}
+			if !routeIncludes[inc] {
+				return q, errors.New("include must list stops, schedules or agency")
+			}
+			q.Include = append(q.Include, inc)
+		}
+	}
+	return q, nil
+}
+
+// filter applies the search and filter parameters to a route query
+func (q routeListQuery) filter(db *gorm.DB) *gorm.DB {
+	if q.Name != "" {
+		db = db.Where(`LOWER(routes.name) LIKE ? ESCAPE '\'`, containsPattern(q.Name))
+	}
+	if q.AgencyID != 0 {
+		db = db.Where("routes.agency_id = ?", q.AgencyID)
+	}
+	if q.StopID != 0 || q.StopName != "" {
+		stops := db.Session(&gorm.Session{NewDB: true}).Model(&models.Stop{}).Select("route_id")
+		if q.StopID != 0 {
+			stops = stops.Where("id = ?", q.StopID)
+		}
+		if q.StopName != "" {
+			stops = stops.Where(`LOWER(name) LIKE ? ESCAPE '\'`, containsPattern(q.StopName))
+		}
+		db = db.Where("routes.id IN (?)", stops)
+	}
+	return db
+}
+
+// likeEscaper escapes the LIKE wildcards, for patterns with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// containsPattern is the lowercase LIKE pattern matching s anywhere
+func containsPattern(s string) string {
+	return "%" + likeEscaper.Replace(strings.ToLower(s)) + "%"
+}
+
+// preload adds the requested associations
+func (q routeListQuery) preload(db *gorm.DB) *gorm.DB {
+	for _, inc := range q.Include {
+		switch inc {
+		case "stops":
+			db = db.Preload("Stops", func(db *gorm.DB) *gorm.DB {
+				return db.Order("order_index asc")
+			})
+		case "schedules":
+			db = db.Preload("Schedules", func(db *gorm.DB) *gorm.DB {
+				return db.Order("departure asc")
+			})
+		case "agency":
+			db = db.Preload("Agency")
+		}
+	}
+	return db
+}
+
+// listRoutes answers a route list request
+func listRoutes(c *gin.Context, db *gorm.DB, defaultInclude []string) {
+	q, err := parseRouteListQuery(c, defaultInclude)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	base := db.Model(&models.Route{}).Scopes(q.filter).Session(&gorm.Session{})
+
+	var total int64
+	if err := base.Count(&total).Error; err != nil {
+		respondInternalError(c, err, "failed to query routes")
+		return
+	}
+
+	routes := []models.Route{}
+	if err := base.Scopes(q.preload).Order(q.Order).Limit(q.Limit).Offset(q.Offset).Find(&routes).Error; err != nil {
+		respondInternalError(c, err, "failed to query routes")
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	if next := q.Offset + len(routes); int64(next) < total && len(routes) > 0 {
+		u := *c.Request.URL
+		params := u.Query()
+		params.Set("offset", strconv.Itoa(next))
+		params.Set("limit", strconv.Itoa(q.Limit))
+		u.RawQuery = params.Encode()
+		c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+	}
+	c.JSON(http.StatusOK, routes)
+}
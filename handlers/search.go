@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"busapp/search"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Search endpoint (public):
+- GET /public/search?q=[&type=route|stop][&agency=][&lat=&lon=][&limit=]
+
+Matches route names, descriptions and stop names with prefix matching and
+typo tolerance (see the search package). With lat/lon, results near the
+caller rank higher and carry distance_km (for routes, that of their closest
+stop within search.NearRadiusKm).
+*/
+
+// PublicSearchHandler - ranked search over routes and stops
+func PublicSearchHandler(c *gin.Context, db *gorm.DB) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		respondError(c, http.StatusBadRequest, "q is required")
+		return
+	}
+
+	opts := search.Options{Type: c.Query("type")}
+	if opts.Type != "" && opts.Type != search.TypeRoute && opts.Type != search.TypeStop {
+		respondError(c, http.StatusBadRequest, "type must be route or stop")
+		return
+	}
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > 100 {
+			respondError(c, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		opts.Limit = limit
+	}
+	if s := c.Query("agency"); s != "" {
+		agencyID, err := strconv.Atoi(s)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid agency")
+			return
+		}
+		opts.AgencyID = uint(agencyID)
+	}
+	if c.Query("lat") != "" || c.Query("lon") != "" {
+		lat, errLat := strconv.ParseFloat(c.Query("lat"), 64)
+		lon, errLon := strconv.ParseFloat(c.Query("lon"), 64)
+		if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			respondError(c, http.StatusBadRequest, "lat and lon must be valid coordinates")
+			return
+		}
+		opts.Near = &search.Point{Lat: lat, Lon: lon}
+	}
+
+	results, err := search.Search(db, q, opts)
+	if err != nil {
+		respondInternalError(c, err, "search failed")
+		return
+	}
+	c.JSON(http.StatusOK, SearchResponse{Query: q, Results: results})
+}
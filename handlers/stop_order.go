@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Stop ordering (admin):
+- PUT  /admin/routes/:id/stops/order -> {"stop_ids": [...]} renumbers the
+                                        route's stops 1..n in that order
+- POST /admin/routes/:id/stops       -> with "after_stop_id" inserts the stop
+                                        right after that stop (0 = first) and
+                                        shifts the following stops (see
+                                        repository.Stops.InsertAfter)
+*/
+
+type ReorderStopsPayload struct {
+	StopIDs []uint `json:"stop_ids" binding:"required"`
+}
+
+// ReorderStopsHandler - renumbers all stops of a route in one transaction
+func ReorderStopsHandler(c *gin.Context, db *gorm.DB) {
+	routeIDstr := c.Param("id")
+	routeID, _ := strconv.Atoi(routeIDstr)
+
+	var payload ReorderStopsPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stops, err := routeService(db).ReorderStops(changeOf(c), uint(routeID), payload.StopIDs)
+	if err != nil {
+		respondWriteError(c, err, "failed to reorder stops")
+		return
+	}
+	c.JSON(http.StatusOK, stops)
+}
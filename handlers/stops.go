@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"busapp/spatial"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Stop location endpoints (public):
+- GET /public/stops/nearby?lat=&lon=[&radius_km=][&agency=][&limit=] -> closest first, with distance_km
+- GET /public/stops?bbox=min_lon,min_lat,max_lon,max_lat[&agency=][&limit=] -> stops inside the box
+
+Both run in the database (on PostGIS when available, see the spatial package).
+*/
+
+// maxNearbyRadiusKm caps the radius of nearby queries
+const maxNearbyRadiusKm = 50
+
+// spatialOptions parses the agency and limit query parameters, answering 400 itself when it returns false
+func spatialOptions(c *gin.Context) (spatial.Options, bool) {
+	var opts spatial.Options
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > 200 {
+			respondError(c, http.StatusBadRequest, "limit must be between 1 and 200")
+			return opts, false
+		}
+		opts.Limit = limit
+	}
+	if s := c.Query("agency"); s != "" {
+		agencyID, err := strconv.Atoi(s)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid agency")
+			return opts, false
+		}
+		opts.AgencyID = uint(agencyID)
+	}
+	return opts, true
+}
+
+// PublicNearbyStopsHandler - stops around a point, closest first
+func PublicNearbyStopsHandler(c *gin.Context, db *gorm.DB) {
+	lat, errLat := strconv.ParseFloat(c.Query("lat"), 64)
+	lon, errLon := strconv.ParseFloat(c.Query("lon"), 64)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		respondError(c, http.StatusBadRequest, "lat and lon must be valid coordinates")
+		return
+	}
+	radius := 1.0
+	if s := c.Query("radius_km"); s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r <= 0 || r > maxNearbyRadiusKm {
+			respondError(c, http.StatusBadRequest, "radius_km must be between 0 and 50")
+			return
+		}
+		radius = r
+	}
+	opts, ok := spatialOptions(c)
+	if !ok {
+		return
+	}
+
+	stops, err := spatial.Nearby(db, spatial.Point{Lat: lat, Lon: lon}, radius, opts)
+	if err != nil {
+		respondInternalError(c, err, "failed to query stops")
+		return
+	}
+	c.JSON(http.StatusOK, StopsResponse{Stops: stops})
+}
+
+// PublicStopsInBBoxHandler - stops inside a bounding box
+func PublicStopsInBBoxHandler(c *gin.Context, db *gorm.DB) {
+	parts := strings.Split(c.Query("bbox"), ",")
+	var coords [4]float64
+	valid := len(parts) == 4
+	for i := 0; valid && i < 4; i++ {
+		var err error
+		coords[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		valid = err == nil
+	}
+	box := spatial.BBox{MinLon: coords[0], MinLat: coords[1], MaxLon: coords[2], MaxLat: coords[3]}
+	if !valid || box.MinLat > box.MaxLat || box.MinLat < -90 || box.MaxLat > 90 ||
+		box.MinLon < -180 || box.MinLon > 180 || box.MaxLon < -180 || box.MaxLon > 180 {
+		respondError(c, http.StatusBadRequest, "bbox must be min_lon,min_lat,max_lon,max_lat")
+		return
+	}
+	opts, ok := spatialOptions(c)
+	if !ok {
+		return
+	}
+
+	stops, err := spatial.InBBox(db, box, opts)
+	if err != nil {
+		respondInternalError(c, err, "failed to query stops")
+		return
+	}
+	c.JSON(http.StatusOK, StopsResponse{Stops: stops})
+}
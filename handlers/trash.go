@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"busapp/config"
+	"busapp/models"
+	"busapp/repository"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Trash endpoints (admin):
+- GET  /admin/trash[?entity=route|stop|schedule] -> soft-deleted entities
+- POST /admin/trash/:entity/:id/restore          -> bring one back
+
+Deleting a route, stop or schedule only marks it deleted. A route is trashed
+together with its stops and schedules (same deleted_at) and restored with
+them; a stop or schedule is only restored while its route is live. Trashed entities are purged for good after the retention period
+(trash_retention_days in the config, default 30).
+*/
+
+// TrashItem is one trashed entity. Data is the entity itself; for routes it
+// includes the stops and schedules deleted along with it.
+type TrashItem struct {
+	Entity    string      `json:"entity"`
+	ID        uint        `json:"id"`
+	RouteID   uint        `json:"route_id"`
+	DeletedAt time.Time   `json:"deleted_at"`
+	PurgeAt   time.Time   `json:"purge_at"`
+	Data      interface{} `json:"data"`
+}
+
+// TrashRetention returns the configured retention period
+func TrashRetention() time.Duration {
+	return config.Get().TrashRetention
+}
+
+// PurgeTrash permanently removes entities deleted longer than retention ago,
+// along with stops, schedules and alerts left without a route
+func PurgeTrash(db *gorm.DB, retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&models.Route{}).Error; err != nil {
+			return err
+		}
+		routes := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&models.Route{}).Select("id")
+		for _, m := range []interface{}{&models.Stop{}, &models.Schedule{}} {
+			if err := tx.Unscoped().Where("deleted_at < ? OR route_id NOT IN (?)", cutoff, routes).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("route_id IS NOT NULL AND route_id NOT IN (?)", routes).Delete(&models.Alert{}).Error
+	})
+}
+
+// ListTrashHandler - returns trashed entities, most recently deleted first
+func ListTrashHandler(c *gin.Context, db *gorm.DB) {
+	agencyID := tenantID(c)
+	entity := c.Query("entity")
+	if entity != "" && entity != EntityRoute && entity != EntityStop && entity != EntitySchedule {
+		respondError(c, http.StatusBadRequest, "entity must be route, stop or schedule")
+		return
+	}
+	retention := TrashRetention()
+
+	items := []TrashItem{}
+	add := func(entity string, id, routeID uint, deletedAt gorm.DeletedAt, data interface{}) {
+		items = append(items, TrashItem{
+			Entity:    entity,
+			ID:        id,
+			RouteID:   routeID,
+			DeletedAt: deletedAt.Time,
+			PurgeAt:   deletedAt.Time.Add(retention),
+			Data:      data,
+		})
+	}
+
+	if entity == "" || entity == EntityRoute {
+		var routes []models.Route
+		if err := db.Scopes(repository.TrashedRouteScope(agencyID)).Order("deleted_at desc").Find(&routes).Error; err != nil {
+			respondInternalError(c, err, "failed to query trash")
+			return
+		}
+		for i := range routes {
+			r := &routes[i]
+			trashedWith := db.Unscoped().Where("route_id = ? AND deleted_at = ?", r.ID, r.DeletedAt.Time).Session(&gorm.Session{})
+			if err := trashedWith.Order("order_index asc").Find(&r.Stops).Error; err != nil {
+				respondInternalError(c, err, "failed to query trash")
+				return
+			}
+			if err := trashedWith.Find(&r.Schedules).Error; err != nil {
+				respondInternalError(c, err, "failed to query trash")
+				return
+			}
+			add(EntityRoute, r.ID, r.ID, r.DeletedAt, r)
+		}
+	}
+	if entity == "" || entity == EntityStop {
+		var stops []models.Stop
+		if err := db.Scopes(repository.TrashedChildScope("stops", agencyID)).Order("deleted_at desc").Find(&stops).Error; err != nil {
+			respondInternalError(c, err, "failed to query trash")
+			return
+		}
+		for _, s := range stops {
+			add(EntityStop, s.ID, s.RouteID, s.DeletedAt, s)
+		}
+	}
+	if entity == "" || entity == EntitySchedule {
+		var schedules []models.Schedule
+		if err := db.Scopes(repository.TrashedChildScope("schedules", agencyID)).Order("deleted_at desc").Find(&schedules).Error; err != nil {
+			respondInternalError(c, err, "failed to query trash")
+			return
+		}
+		for _, s := range schedules {
+			add(EntitySchedule, s.ID, s.RouteID, s.DeletedAt, s)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	c.JSON(http.StatusOK, items)
+}
+
+// RestoreTrashHandler - brings a trashed route, stop or schedule back
+func RestoreTrashHandler(c *gin.Context, db *gorm.DB) {
+	idStr := c.Param("id")
+	id, _ := strconv.Atoi(idStr)
+
+	var restored interface{}
+	var err error
+	switch c.Param("entity") {
+	case EntityRoute:
+		restored, err = routeService(db).Restore(changeOf(c), uint(id))
+	case EntityStop:
+		restored, err = routeService(db).RestoreStop(changeOf(c), uint(id))
+	case EntitySchedule:
+		restored, err = scheduleService(db).Restore(changeOf(c), uint(id))
+	default:
+		respondError(c, http.StatusNotFound, "not found in trash")
+		return
+	}
+	if err != nil {
+		respondWriteError(c, err, "failed to restore")
+		return
+	}
+	c.JSON(http.StatusOK, restored)
+}
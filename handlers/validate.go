@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"busapp/config"
+	"busapp/repository"
+	"busapp/service"
+	"busapp/validation"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+Network validation:
+- GET /admin/validate[?route_id=] -> errors and warnings per entity
+
+The same rules (see the validation package) run after every admin write and
+import. Writes always go through, with X-Validation-Errors and
+X-Validation-Warnings headers counting the issues of the written entity,
+unless strict mode is on: then a write that leaves errors on the written
+entity is rolled back with 422. Strict mode is enabled with the
+validation_strict setting (see the config package), or per request with
+?strict=true; a request cannot turn the setting off.
+*/
+
+// strictValidation reports whether writes leaving validation errors are rejected
+func strictValidation(c *gin.Context) bool {
+	strict, _ := strconv.ParseBool(c.Query("strict"))
+	return config.Get().ValidationStrict || strict
+}
+
+// setValidationHeaders reports issue counts on a successful write
+func setValidationHeaders(c *gin.Context, issues []validation.Issue) {
+	errs := len(validation.Errors(issues))
+	c.Header("X-Validation-Errors", strconv.Itoa(errs))
+	c.Header("X-Validation-Warnings", strconv.Itoa(len(issues)-errs))
+}
+
+// respondValidationFailure sends 422 when err is a strict-mode rejection
+func respondValidationFailure(c *gin.Context, err error) bool {
+	issues, ok := service.FailedIssues(err)
+	if !ok {
+		return false
+	}
+	respondError(c, http.StatusUnprocessableEntity, "validation failed", ValidationDetails{Issues: issues})
+	return true
+}
+
+// ValidateNetworkHandler - runs every rule on the admin's network
+func ValidateNetworkHandler(c *gin.Context, db *gorm.DB) {
+	var routeIDs []uint
+	if s := c.Query("route_id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid route_id")
+			return
+		}
+		routeIDs = append(routeIDs, uint(id))
+	}
+
+	issues, err := service.ValidateRoutes(repository.New(db), tenantID(c), routeIDs...)
+	if err != nil {
+		respondInternalError(c, err, "failed to validate network")
+		return
+	}
+
+	errs := validation.Errors(issues)
+	warnings := make([]validation.Issue, 0, len(issues)-len(errs))
+	for _, i := range issues {
+		if i.Severity == validation.SeverityWarning {
+			warnings = append(warnings, i)
+		}
+	}
+	if errs == nil {
+		errs = []validation.Issue{}
+	}
+
+	c.JSON(http.StatusOK, ValidationReport{
+		Valid:    len(errs) == 0,
+		Errors:   errs,
+		Warnings: warnings,
+	})
+}
@@ -1,64 +1,222 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"busapp/config"
 	"busapp/db"
 	"busapp/handlers"
-	"busapp/middleware"
-	"busapp/seed"
+	"busapp/metrics"
+	"busapp/migrations"
+	"busapp/search"
+	"busapp/spatial"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
+// command is a busapp subcommand (see commands.go)
+type command struct {
+	name    string
+	args    string // positional arguments, for the usage text
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	// assigned here because the usage text lists the commands
+	commands = []command{
+		{"serve", "", "run the API server (default)", serveCommand},
+		{"migrate", "up [version] | down [steps] | status", "apply, revert or list schema migrations", migrateCommand},
+		{"seed", "", "insert sample data into an empty database", seedCommand},
+		{"create-admin", "-username NAME [-agency ID]", "add an admin (password from $ADMIN_PASSWORD or stdin)", createAdminCommand},
+		{"import", "csv|gtfs FILE -agency ID [-dry-run] [-strict]", "import a timetable (CSV, zip, xlsx) or a GTFS feed", importCommand},
+		{"export", "csv|xlsx|gtfs|geojson [-o FILE] [-agency ID] [-route ID]", "export the network (stdout by default)", exportCommand},
+		{"validate", "[-agency ID] [-route ID] [-json]", "run the validation rules, failing on errors", validateCommand},
+		{"backup", "FILE", "write a consistent copy of the database", backupCommand},
+	}
+}
+
+// errUsage makes main print the usage and exit with status 2
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: busapp [command] [arguments] [flags]\n\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", c.name, c.summary)
+		if c.args != "" {
+			fmt.Fprintf(os.Stderr, "  %-13s   %s\n", "", c.args)
+		}
+	}
+	fmt.Fprintln(os.Stderr, `
+Every command takes the config flags (-config, -db, -env, ...; see
+"busapp serve -h"). A new database needs "migrate up" (and optionally
+"seed") before "serve".`)
+}
+
 func main() {
-	// Init DB (creates sqlite file bus.db)
-	db, err := db.InitDB("bus.db")
-	if err != nil {
-		log.Fatalf("failed to init db: %v", err)
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	// Auto-migrate models & seed sample data
-	if err := seed.MigrateAndSeed(db); err != nil {
-		log.Fatalf("migrate/seed error: %v", err)
+	if name == "help" {
+		usage()
+		return
 	}
 
-	r := gin.Default()
-	r.Use(middleware.CorsMiddleware())
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := c.run(args)
+		switch {
+		case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+			usage()
+			os.Exit(2)
+		case err != nil:
+			log.Fatalf("%s: %v", name, err)
+		}
+		return
+	}
+	usage()
+	os.Exit(2)
+}
 
-	// Auth routes
-	r.POST("/auth/register", func(c *gin.Context) { handlers.RegisterHandler(c, db) })
-	r.POST("/auth/login", func(c *gin.Context) { handlers.LoginHandler(c, db) })
+// parseArgs parses flags anywhere among args and returns the positional ones
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
 
-	// Public endpoints
-	public := r.Group("/public")
-	public.GET("/routes", func(c *gin.Context) { handlers.PublicGetRoutesHandler(c, db) })
-	public.GET("/routes/:id", func(c *gin.Context) { handlers.PublicGetRouteByIDHandler(c, db) })
-	public.GET("/next-bus/:id", func(c *gin.Context) { handlers.PublicGetNextBusHandler(c, db) })
+// open loads the config and opens the database
+func open(flags *config.Flags) (*config.Config, *gorm.DB, error) {
+	// Load and validate settings (defaults < config file < env < flags)
+	cfg, err := flags.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Set(cfg)
 
-	public.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"status": "ok"}) })
+	// Init DB (SQLite file, bus.db by default, or a PostgreSQL DSN)
+	db, err := db.InitDB(cfg.DatabaseDSN)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to init db: %w", err)
+	}
+	if err := metrics.InstrumentDB(db); err != nil {
+		return nil, nil, fmt.Errorf("failed to init db: %w", err)
+	}
+	return cfg, db, nil
+}
 
-	// Admin (protected)
-	admin := r.Group("/admin")
-	admin.Use(middleware.AuthMiddleware()) // JWT required
+// openMigrated is open for commands that need the schema this build expects
+func openMigrated(flags *config.Flags) (*config.Config, *gorm.DB, error) {
+	cfg, db, err := open(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Refuse to run against a schema this build was not written for
+	if err := migrations.Check(db); err != nil {
+		return nil, nil, err
+	}
+	return cfg, db, nil
+}
 
-	admin.POST("/routes", func(c *gin.Context) { handlers.CreateRouteHandler(c, db) })
-	admin.PUT("/routes/:id", func(c *gin.Context) { handlers.UpdateRouteHandler(c, db) })
-	admin.DELETE("/routes/:id", func(c *gin.Context) { handlers.DeleteRouteHandler(c, db) })
+// serveCommand runs the API server
+func serveCommand(args []string) error {
+	fs, flags := newCommand("serve")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		return errUsage
+	}
+	cfg, db, err := openMigrated(flags)
+	if err != nil {
+		return err
+	}
+	if cfg.Production() {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	// JSON logs, one line per event; the log package and gin's debug output
+	// (route table, warnings) write through it too
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.Level()})))
+	gin.DebugPrintFunc = func(format string, values ...any) {
+		slog.Debug(strings.TrimSpace(fmt.Sprintf(strings.TrimPrefix(format, "[WARNING] "), values...)))
+	}
+	gin.DebugPrintRouteFunc = func(method, path, handler string, _ int) {
+		slog.Debug("route", "method", method, "path", path, "handler", handler)
+	}
+	if cfg.JWTSecret == config.DefaultJWTSecret {
+		slog.Warn("using the default JWT secret, set JWT_SECRET outside development")
+	}
 
-	admin.POST("/routes/:id/stops", func(c *gin.Context) { handlers.AddStopHandler(c, db) })
-	admin.PUT("/stops/:id", func(c *gin.Context) { handlers.UpdateStopHandler(c, db) })
-	admin.DELETE("/stops/:id", func(c *gin.Context) { handlers.DeleteStopHandler(c, db) })
+	// Optional indexes the migrations may have created (FTS5, PostGIS)
+	if err := search.Setup(db); err != nil {
+		return fmt.Errorf("search setup error: %w", err)
+	}
+	if err := spatial.Setup(db); err != nil {
+		return fmt.Errorf("spatial setup error: %w", err)
+	}
+
+	// SIGINT/SIGTERM start a graceful shutdown; a second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	jobs := newWorkers(ctx)
+	// Make scheduled timetable versions live once their effective date passes
+	jobs.every("version activation", time.Minute, func() error { return handlers.ActivateDueVersions(db) })
+	// Permanently remove entities that stayed in the trash past the retention period
+	jobs.every("trash purge", time.Hour, func() error { return handlers.PurgeTrash(db, handlers.TrashRetention()) })
+
+	srv, err := newServer(cfg, newRouter(db, cfg, handlers.ReadyCheck{Name: "workers", Check: jobs.check}))
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("server error: %w", err)
+	}
 
-	admin.POST("/routes/:id/schedules", func(c *gin.Context) { handlers.AddScheduleHandler(c, db) })
-	admin.PUT("/schedules/:id", func(c *gin.Context) { handlers.UpdateScheduleHandler(c, db) })
-	admin.DELETE("/schedules/:id", func(c *gin.Context) { handlers.DeleteScheduleHandler(c, db) })
-	r.GET("/routes", func(c *gin.Context) { handlers.GetRoutesHandler(c, db) })
-	r.GET("/routes/:id", func(c *gin.Context) { handlers.GetRouteByIDHandler(c, db) })
+	scheme := "http"
+	if srv.TLSConfig != nil {
+		scheme = "https"
+	}
+	slog.Info("server running", "addr", cfg.Addr, "scheme", scheme, "env", cfg.Env)
+	serveErr := serve(ctx, srv, ln, cfg.ShutdownTimeout)
+	stop()
 
-	log.Println("Server running on :8080")
-	log.Println("click http://localhost:8080/health to check STATUS")
-	log.Println("press Ctrl+C to stop")
-	if err := r.Run(":8080"); err != nil {
-		log.Fatalf("server error: %v", err)
+	// Let a running job finish, within the same grace period, then close the
+	// database so SQLite checkpoints its journal
+	waitCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	errs := []error{serveErr, jobs.wait(waitCtx)}
+	if sqlDB, err := db.DB(); err == nil {
+		errs = append(errs, sqlDB.Close())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("server error: %w", err)
 	}
+	slog.Info("server stopped")
+	return nil
 }
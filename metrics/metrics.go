@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+/*
+Prometheus metrics, served at /metrics:
+
+	busapp_http_request_duration_seconds{method,route,status}  histogram; _count is the request count
+	busapp_db_query_duration_seconds{operation,table}          histogram of GORM statements
+	busapp_eta_computation_duration_seconds                    histogram of next-bus estimates
+
+plus the Go runtime and process collectors. route is the route template
+(/api/v1/public/routes/:id), "unmatched" for 404s, so the label stays bounded.
+*/
+
+// Registry holds the server's collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests times requests (see middleware.Metrics)
+	HTTPRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "busapp",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve HTTP requests, by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// DBQueries times database statements (see InstrumentDB)
+	DBQueries = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "busapp",
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Time of database statements, by operation and table.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+
+	// ETAComputations times next-bus estimates, without loading the route
+	ETAComputations = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "busapp",
+		Subsystem: "eta",
+		Name:      "computation_duration_seconds",
+		Help:      "Time to estimate the next buses of a route.",
+		Buckets:   []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01},
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, DBQueries, ETAComputations,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Since observes the seconds elapsed since start, as in
+// defer metrics.Since(metrics.ETAComputations, time.Now())
+func Since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+const startKey = "metrics:start"
+
+// InstrumentDB times every statement run through db in DBQueries
+func InstrumentDB(db *gorm.DB) error {
+	start := func(tx *gorm.DB) { tx.InstanceSet(startKey, time.Now()) }
+	observe := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if t, ok := tx.InstanceGet(startKey); ok {
+				Since(DBQueries.WithLabelValues(operation, tx.Statement.Table), t.(time.Time))
+			}
+		}
+	}
+
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("*").Register("metrics:start_create", start),
+		cb.Create().After("*").Register("metrics:observe_create", observe("create")),
+		cb.Query().Before("*").Register("metrics:start_query", start),
+		cb.Query().After("*").Register("metrics:observe_query", observe("query")),
+		cb.Update().Before("*").Register("metrics:start_update", start),
+		cb.Update().After("*").Register("metrics:observe_update", observe("update")),
+		cb.Delete().Before("*").Register("metrics:start_delete", start),
+		cb.Delete().After("*").Register("metrics:observe_delete", observe("delete")),
+		cb.Row().Before("*").Register("metrics:start_row", start),
+		cb.Row().After("*").Register("metrics:observe_row", observe("row")),
+		cb.Raw().Before("*").Register("metrics:start_raw", start),
+		cb.Raw().After("*").Register("metrics:observe_raw", observe("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"busapp/handlers"
+	"busapp/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AnonymousRateLimit is the number of requests per minute allowed without an API key
+const AnonymousRateLimit = 60
+
+// KeyLookupRateLimit is the number of requests per minute an IP may make to
+// endpoints taking API keys, counted before the key is looked up so invalid
+// keys cannot be tried without limit
+const KeyLookupRateLimit = 600
+
+// APIKeyContextKey is where the identified key is stored in the gin context
+const APIKeyContextKey = "api_key"
+
+// APIKeyMiddleware identifies the consumer from the X-API-Key header or the
+// api_key query param and records usage (not of requests refused by a rate
+// limit). Requests without a key pass through anonymously; put a RateLimit
+// with KeyByIP at KeyLookupRateLimit before it, and one with KeyByAPIKey
+// after it to enforce quotas.
+func APIKeyMiddleware(db *gorm.DB, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		plain := c.GetHeader("X-API-Key")
+		if plain == "" {
+			plain = c.Query("api_key")
+		}
+
+		if plain == "" {
+			c.Next()
+			return
+		}
+
+		var key models.APIKey
+		if err := db.Where("key_hash = ?", handlers.HashAPIKey(plain)).First(&key).Error; err != nil || key.RevokedAt != nil {
+			handlers.AbortWithError(c, http.StatusUnauthorized, "invalid api key")
+			return
+		}
+		if !key.HasScope(scope) {
+			handlers.AbortWithError(c, http.StatusForbidden, "api key lacks scope "+scope)
+			return
+		}
+
+		c.Set(APIKeyContextKey, key)
+		c.Next()
+
+		if c.Writer.Status() == http.StatusTooManyRequests {
+			return
+		}
+		// the response is out; a failure only shows in the request log
+		if err := recordAPIKeyUsage(db, key, c.FullPath()); err != nil {
+			_ = c.Error(err)
+		}
+	}
+}
+
+// recordAPIKeyUsage bumps the per-day counter for the key and endpoint
+func recordAPIKeyUsage(db *gorm.DB, key models.APIKey, path string) error {
+	now := time.Now()
+	usage := models.APIKeyUsage{APIKeyID: key.ID, Day: now.Format("2006-01-02"), Path: path, Count: 1}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "api_key_id"}, {Name: "day"}, {Name: "path"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("api_key_usages.count + 1")}),
+	}).Create(&usage).Error
+	if err != nil {
+		return fmt.Errorf("record api key usage: %w", err)
+	}
+	return db.Model(&models.APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now).Error
+}
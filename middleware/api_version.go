@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"busapp/handlers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIVersion marks requests under a versioned prefix, so handlers answer
+// with that version's formats (e.g. the v1 error envelope)
+func APIVersion(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(handlers.APIVersionContextKey, version)
+		c.Next()
+	}
+}
+
+// Deprecated flags the legacy unversioned paths and points clients at the
+// same endpoint under successorPrefix
+func Deprecated(successorPrefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Writer.Header().Add("Link", "<"+successorPrefix+c.Request.URL.Path+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"busapp/handlers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logger writes one structured line per request with its ID, the admin who
+// made it, the route, status and latency. Errors the handlers kept on the
+// context (internal errors not shown to the client) are included.
+func Logger(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("request_id", c.GetString(handlers.RequestIDContextKey)),
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if id := c.GetUint(AdminIDContextKey); id != 0 {
+			attrs = append(attrs, slog.Uint64("admin_id", uint64(id)))
+		}
+		level := slog.LevelInfo
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.Any("errors", c.Errors.Errors()))
+			level = slog.LevelWarn
+		}
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recovery turns a panic in a handler into a 500, logging it with the
+// request ID and stack
+func Recovery(logger *slog.Logger) gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		logger.ErrorContext(c.Request.Context(), "panic",
+			slog.String("request_id", c.GetString(handlers.RequestIDContextKey)),
+			slog.String("route", c.FullPath()),
+			slog.Any("panic", recovered),
+			slog.String("stack", string(debug.Stack())),
+		)
+		handlers.AbortWithError(c, http.StatusInternalServerError, "internal error")
+	})
+}
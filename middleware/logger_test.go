@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loggedRouter serves /routes/:id behind RequestID, Logger and Recovery,
+// logging JSON into buf
+func loggedRouter(buf *bytes.Buffer, handler gin.HandlerFunc) *gin.Engine {
+	logger := slog.New(slog.NewJSONHandler(buf, nil))
+	r := gin.New()
+	r.Use(RequestID(), Logger(logger), Recovery(logger))
+	r.GET("/routes/:id", func(c *gin.Context) { c.Set(AdminIDContextKey, uint(7)) }, handler)
+	return r
+}
+
+func lastLine(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(lines[len(lines)-1], &entry); err != nil {
+		t.Fatalf("log line is not JSON: %s", buf)
+	}
+	return entry
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	r := loggedRouter(&buf, func(c *gin.Context) {
+		_ = c.Error(errors.New("disk on fire"))
+		c.String(http.StatusInternalServerError, "failed")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/routes/3", nil)
+	req.Header.Set(RequestIDHeader, "trace-42")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := lastLine(t, &buf)
+	want := map[string]interface{}{
+		"level": "ERROR", "msg": "request", "request_id": "trace-42", "method": "GET",
+		"route": "/routes/:id", "path": "/routes/3", "status": 500.0, "admin_id": 7.0,
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+	if errs, _ := entry["errors"].([]interface{}); len(errs) != 1 || errs[0] != "disk on fire" {
+		t.Errorf("errors = %v", entry["errors"])
+	}
+	if _, ok := entry["latency_ms"].(float64); !ok {
+		t.Errorf("no latency_ms in %v", entry)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	r := loggedRouter(&buf, func(c *gin.Context) { panic("boom") })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/routes/3", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", w.Code)
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	var panicked map[string]interface{}
+	if len(lines) != 2 || json.Unmarshal(lines[0], &panicked) != nil || panicked["panic"] != "boom" || panicked["stack"] == "" {
+		t.Fatalf("log: %s", buf.String())
+	}
+	if id := w.Header().Get(RequestIDHeader); panicked["request_id"] != id || lastLine(t, &buf)["request_id"] != id {
+		t.Errorf("request ID %q not on both lines: %s", id, buf.String())
+	}
+}
+
+func TestRequestIDReusesOnlySaneIDs(t *testing.T) {
+	r := gin.New()
+	r.Use(RequestID())
+	r.GET("/", func(c *gin.Context) {})
+
+	tests := []struct {
+		header string
+		reused bool
+	}{
+		{"3f2b8c1e-6a4d-4f0e-9b7a-2c5d8e1f0a3b", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"", false},
+		{"has space", false},
+		{"evil\",\"admin_id\":1", false},
+		{string(bytes.Repeat([]byte("a"), 65)), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, tt.header)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		got := w.Header().Get(RequestIDHeader)
+		if (got == tt.header) != tt.reused || got == "" {
+			t.Errorf("X-Request-ID %q answered with %q", tt.header, got)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"busapp/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics times every request by method, route template and status
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.Since(metrics.HTTPRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())), start)
+	}
+}
@@ -10,12 +10,25 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// CorsMiddleware adds CORS headers to responses
-func CorsMiddleware() gin.HandlerFunc {
+// CorsMiddleware adds CORS headers to responses. origins lists the allowed
+// origins; "*" allows any.
+func CorsMiddleware(origins []string) gin.HandlerFunc {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[strings.TrimRight(o, "/")] = true
+	}
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		if allowed["*"] {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Add("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); allowed[origin] {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key, X-Request-ID")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Validation-Errors, X-Validation-Warnings, X-Total-Count, Link, Deprecation, X-Request-ID")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -24,24 +37,64 @@ func CorsMiddleware() gin.HandlerFunc {
 	}
 }
 
+// Context keys set by AuthMiddleware from the JWT claims
+const (
+	AdminIDContextKey       = handlers.AdminIDContextKey
+	AdminUsernameContextKey = handlers.AdminUsernameContextKey
+	AgencyIDContextKey      = handlers.AgencyIDContextKey
+)
+
+// AuthMiddleware validates the bearer JWT and stores the admin identity in the context
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			handlers.AbortWithError(c, http.StatusUnauthorized, "missing token")
 			return
 		}
-
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(handlers.GetJWTSecret()), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+		if !authenticate(c, authHeader) {
 			return
 		}
+		c.Next()
+	}
+}
 
+// OptionalAuth is AuthMiddleware for endpoints that also serve anonymous
+// callers (e.g. /graphql, where only mutations need an admin): without an
+// Authorization header the request goes through unauthenticated, but a bad
+// token is still rejected.
+func OptionalAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authHeader := c.GetHeader("Authorization"); authHeader != "" && !authenticate(c, authHeader) {
+			return
+		}
 		c.Next()
 	}
 }
+
+// authenticate checks the bearer token and sets the identity context keys,
+// aborting with 401 when it returns false
+func authenticate(c *gin.Context, authHeader string) bool {
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return []byte(handlers.GetJWTSecret()), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})) // the alg handlers.GenerateJWT signs with
+
+	if err != nil || !token.Valid {
+		handlers.AbortWithError(c, http.StatusUnauthorized, "invalid or expired token")
+		return false
+	}
+
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if id, ok := claims["id"].(float64); ok {
+			c.Set(AdminIDContextKey, uint(id))
+		}
+		if username, ok := claims["username"].(string); ok {
+			c.Set(AdminUsernameContextKey, username)
+		}
+		if agencyID, ok := claims["agency_id"].(float64); ok && agencyID > 0 {
+			c.Set(AgencyIDContextKey, uint(agencyID))
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"busapp/config"
+	"busapp/handlers"
+	"busapp/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "a-test-secret-that-is-long-enough-for-prod"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.JWTSecret = testSecret
+	config.Set(cfg)
+}
+
+// claims as issued by handlers.GenerateJWT, expiring at exp
+func claims(exp time.Time) jwt.MapClaims {
+	return jwt.MapClaims{"id": 3, "username": "ops", "agency_id": 2, "exp": exp.Unix()}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, c jwt.MapClaims, key interface{}) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, c).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// authRouter serves GET /me behind mw, answering with the identity it set
+func authRouter(mw gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	r.GET("/me", mw, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"id":        c.GetUint(AdminIDContextKey),
+			"username":  c.GetString(AdminUsernameContextKey),
+			"agency_id": c.GetUint(AgencyIDContextKey),
+		})
+	})
+	return r
+}
+
+func call(r *gin.Engine, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := claims(time.Now().Add(time.Hour))
+	generated, err := handlers.GenerateJWT(models.Admin{ID: 3, Username: "ops", AgencyID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"valid", "Bearer " + sign(t, jwt.SigningMethodHS256, valid, []byte(testSecret)), http.StatusOK},
+		{"issued by login", "Bearer " + generated, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"malformed", "Bearer not.a.jwt", http.StatusUnauthorized},
+		{"expired", "Bearer " + sign(t, jwt.SigningMethodHS256, claims(time.Now().Add(-time.Minute)), []byte(testSecret)), http.StatusUnauthorized},
+		{"wrong signature", "Bearer " + sign(t, jwt.SigningMethodHS256, valid, []byte("another-secret")), http.StatusUnauthorized},
+		{"alg none", "Bearer " + sign(t, jwt.SigningMethodNone, valid, jwt.UnsafeAllowNoneSignatureType), http.StatusUnauthorized},
+		{"alg HS512 with the right secret", "Bearer " + sign(t, jwt.SigningMethodHS512, valid, []byte(testSecret)), http.StatusUnauthorized},
+		{"alg RS256", "Bearer " + sign(t, jwt.SigningMethodRS256, valid, rsaKey), http.StatusUnauthorized},
+	}
+	r := authRouter(AuthMiddleware())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call(r, tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK {
+				if want := `{"agency_id":2,"id":3,"username":"ops"}`; w.Body.String() != want {
+					t.Errorf("identity %s, want %s", w.Body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	r := authRouter(OptionalAuth())
+	if w := call(r, ""); w.Code != http.StatusOK || w.Body.String() != `{"agency_id":0,"id":0,"username":""}` {
+		t.Errorf("anonymous: %d %s", w.Code, w.Body)
+	}
+	expired := sign(t, jwt.SigningMethodHS256, claims(time.Now().Add(-time.Minute)), []byte(testSecret))
+	if w := call(r, "Bearer "+expired); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"busapp/handlers"
+	"busapp/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyFunc picks the bucket a request is counted against. It may return a
+// per-consumer request count that overrides the policy default (0 keeps it).
+type KeyFunc func(c *gin.Context) (key string, requests int)
+
+// RateLimitPolicy configures a token bucket per consumer:
+// Requests tokens are refilled every Per, up to Burst tokens.
+type RateLimitPolicy struct {
+	Requests int
+	Per      time.Duration
+	Burst    int // defaults to Requests
+	Key      KeyFunc
+}
+
+// KeyByIP counts requests per client IP
+func KeyByIP(c *gin.Context) (string, int) {
+	return "ip:" + c.ClientIP(), 0
+}
+
+// KeyByAPIKey counts requests per API key, using the key's own limit.
+// Anonymous callers fall back to their IP at AnonymousRateLimit.
+func KeyByAPIKey(c *gin.Context) (string, int) {
+	if v, ok := c.Get(APIKeyContextKey); ok {
+		key := v.(models.APIKey)
+		return "key:" + strconv.Itoa(int(key.ID)), key.RateLimit
+	}
+	return "ip:" + c.ClientIP(), AnonymousRateLimit
+}
+
+// KeyByAdmin counts requests per authenticated admin (needs AuthMiddleware first)
+func KeyByAdmin(c *gin.Context) (string, int) {
+	if id, ok := c.Get(AdminIDContextKey); ok {
+		return "admin:" + strconv.Itoa(int(id.(uint))), 0
+	}
+	return KeyByIP(c)
+}
+
+// RateLimit returns a token-bucket limiter for a route group. It sets the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers on every
+// response, and Retry-After when the request is rejected.
+func RateLimit(policy RateLimitPolicy) gin.HandlerFunc {
+	if policy.Key == nil {
+		policy.Key = KeyByIP
+	}
+	if policy.Per <= 0 {
+		policy.Per = time.Minute
+	}
+	store := &bucketStore{buckets: map[string]*bucket{}}
+
+	return func(c *gin.Context) {
+		key, requests := policy.Key(c)
+		burst := policy.Burst
+		if requests <= 0 {
+			requests = policy.Requests
+		} else if burst < requests {
+			burst = requests
+		}
+		if burst <= 0 {
+			burst = requests
+		}
+		if requests <= 0 {
+			c.Next()
+			return
+		}
+
+		rate := float64(requests) / policy.Per.Seconds() // tokens per second
+		allowed, remaining := store.take(key, rate, float64(burst), time.Now())
+
+		h := c.Writer.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(burst)-remaining)/rate))))
+
+		if !allowed {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil((1-remaining)/rate))))
+			handlers.AbortWithError(c, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// bucketStore holds one bucket per consumer; idle full buckets are swept
+type bucketStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// take refills the bucket for key and tries to consume one token.
+// It returns whether the request is allowed and the tokens left.
+func (s *bucketStore) take(key string, rate, burst float64, now time.Time) (bool, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > 10*time.Minute {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
+
+// sweep drops buckets that would be full again by now
+func (s *bucketStore) sweep(now time.Time) {
+	for k, b := range s.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(s.buckets, k)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,147 @@
+package migrations
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// initialSchema creates the tables as AutoMigrate used to build them on every
+// boot. Being AutoMigrate itself, it also adopts databases created that way.
+var initialSchema = Migration{
+	Version: 1,
+	Name:    "initial schema",
+	Up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(initialTables()...)
+	},
+	Down: func(tx *gorm.DB) error {
+		tables := initialTables()
+		for i := len(tables) - 1; i >= 0; i-- {
+			if err := tx.Migrator().DropTable(tables[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// initialTables are the models as of version 1, in creation order
+func initialTables() []interface{} {
+	type agency struct {
+		ID        uint   `gorm:"primaryKey"`
+		Name      string `gorm:"unique"`
+		URL       string
+		Timezone  string
+		Phone     string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+	type stop struct {
+		ID         uint `gorm:"primaryKey"`
+		RouteID    uint
+		Name       string
+		Latitude   float64 `gorm:"index:idx_stops_lat_lon"`
+		Longitude  float64 `gorm:"index:idx_stops_lat_lon"`
+		OrderIndex int
+		DeletedAt  gorm.DeletedAt `gorm:"index"`
+	}
+	type schedule struct {
+		ID           uint `gorm:"primaryKey"`
+		RouteID      uint
+		Departure    string
+		FrequencyMin int
+		DeletedAt    gorm.DeletedAt `gorm:"index"`
+	}
+	type route struct {
+		ID          uint  `gorm:"primaryKey"`
+		AgencyID    *uint `gorm:"index"`
+		Agency      *agency
+		Name        string
+		Description string
+		Stops       []stop     `gorm:"constraint:OnDelete:CASCADE"`
+		Schedules   []schedule `gorm:"constraint:OnDelete:CASCADE"`
+		CreatedAt   time.Time
+		UpdatedAt   time.Time
+		DeletedAt   gorm.DeletedAt `gorm:"index"`
+	}
+	type admin struct {
+		ID       uint   `gorm:"primaryKey"`
+		AgencyID uint   `gorm:"index"`
+		Username string `gorm:"unique"`
+		Password string
+	}
+	type apiKey struct {
+		ID         uint `gorm:"primaryKey"`
+		Name       string
+		Owner      string
+		Prefix     string `gorm:"index"`
+		KeyHash    string `gorm:"uniqueIndex"`
+		Scopes     string
+		RateLimit  int
+		LastUsedAt *time.Time
+		RevokedAt  *time.Time
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+	}
+	type apiKeyUsage struct {
+		ID       uint   `gorm:"primaryKey"`
+		APIKeyID uint   `gorm:"uniqueIndex:idx_usage_key_day_path"`
+		Day      string `gorm:"uniqueIndex:idx_usage_key_day_path"`
+		Path     string `gorm:"uniqueIndex:idx_usage_key_day_path"`
+		Count    int64
+	}
+	type auditEntry struct {
+		ID        uint   `gorm:"primaryKey"`
+		AgencyID  uint   `gorm:"index"`
+		ActorID   uint   `gorm:"index"`
+		ActorName string `gorm:"index"`
+		Action    string
+		Entity    string `gorm:"index:idx_audit_entity"`
+		EntityID  uint   `gorm:"index:idx_audit_entity"`
+		Before    json.RawMessage
+		After     json.RawMessage
+		Diff      json.RawMessage
+		IP        string
+		CreatedAt time.Time `gorm:"index"`
+	}
+	type draftChange struct {
+		ID        uint `gorm:"primaryKey"`
+		AgencyID  uint `gorm:"index"`
+		Entity    string
+		EntityID  uint
+		RouteID   uint
+		Action    string
+		Data      json.RawMessage
+		CreatedBy string
+		CreatedAt time.Time
+	}
+	type networkVersion struct {
+		ID          uint `gorm:"primaryKey"`
+		AgencyID    uint `gorm:"uniqueIndex:idx_version_agency_number"`
+		Number      int  `gorm:"uniqueIndex:idx_version_agency_number"`
+		Status      string
+		Note        string
+		EffectiveAt time.Time
+		PublishedBy string
+		Changes     json.RawMessage
+		Snapshot    json.RawMessage
+		CreatedAt   time.Time
+	}
+	type alert struct {
+		ID        uint  `gorm:"primaryKey"`
+		AgencyID  *uint `gorm:"index"`
+		RouteID   *uint `gorm:"index"`
+		Severity  string
+		Title     string
+		Message   string
+		StartsAt  *time.Time
+		EndsAt    *time.Time
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+
+	return []interface{}{&agency{}, &admin{}, &route{}, &stop{}, &schedule{},
+		&apiKey{}, &apiKeyUsage{}, &auditEntry{},
+		&draftChange{}, &networkVersion{}, &alert{}}
+}
@@ -0,0 +1,12 @@
+package migrations
+
+import "busapp/search"
+
+// searchIndex adds the FTS5 index behind /public/search (SQLite builds with
+// FTS5 only; elsewhere searches scan and this is a no-op)
+var searchIndex = Migration{
+	Version: 2,
+	Name:    "search index",
+	Up:      search.CreateIndex,
+	Down:    search.DropIndex,
+}
@@ -0,0 +1,12 @@
+package migrations
+
+import "busapp/spatial"
+
+// stopGeometry adds the PostGIS geometry column for nearby and bbox stop
+// queries (PostgreSQL with PostGIS only; elsewhere a no-op)
+var stopGeometry = Migration{
+	Version: 3,
+	Name:    "stop geometry",
+	Up:      spatial.CreateColumn,
+	Down:    spatial.DropColumn,
+}
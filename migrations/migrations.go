@@ -0,0 +1,205 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+Schema migrations.
+
+The schema is built by numbered migrations, each with an Up and a Down step,
+listed in order in all below. schema_migrations records which ones were
+applied; the highest applied number is the schema version. Every step runs in
+a transaction together with its schema_migrations row, so a failing step
+leaves the version unchanged.
+
+To change the schema, add a new file NNNN_name.go with the next number and
+append it to all. Never edit a migration that was released: databases that
+already ran it would not see the change. Migrations use their own frozen copies
+of the models rather than the models package, so later model changes do not
+rewrite history.
+
+The server refuses to start unless the schema is exactly at Latest (see
+Check); run `migrate up` after deploying a build with new migrations.
+*/
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// all is every migration, by version
+var all = []Migration{
+	initialSchema,
+	searchIndex,
+	stopGeometry,
+}
+
+// schemaMigration is a row of the version table
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Status is a migration and when it was applied (nil when pending)
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// ErrUnexpectedVersion is returned by Check when the schema does not match this build
+var ErrUnexpectedVersion = errors.New("unexpected schema version")
+
+// Latest is the version this build expects
+func Latest() int {
+	return all[len(all)-1].Version
+}
+
+// ensureTable creates schema_migrations when missing
+func ensureTable(db *gorm.DB) error {
+	return db.AutoMigrate(&schemaMigration{})
+}
+
+// applied returns the applied migrations by version
+func applied(db *gorm.DB) (map[int]schemaMigration, error) {
+	found := map[int]schemaMigration{}
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return found, nil
+	}
+	var rows []schemaMigration
+	if err := db.Order("version asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		found[r.Version] = r
+	}
+	return found, nil
+}
+
+// Current returns the schema version (0 for an empty database)
+func Current(db *gorm.DB) (int, error) {
+	done, err := applied(db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range done {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// Check returns ErrUnexpectedVersion unless every migration of this build,
+// and nothing newer, was applied
+func Check(db *gorm.DB) error {
+	done, err := applied(db)
+	if err != nil {
+		return err
+	}
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current > Latest():
+		return fmt.Errorf("%w: schema is at %d, newer than this build (%d)", ErrUnexpectedVersion, current, Latest())
+	case current < Latest():
+		return fmt.Errorf("%w: schema is at %d, this build needs %d (run migrate up)", ErrUnexpectedVersion, current, Latest())
+	}
+	for _, m := range all {
+		if _, ok := done[m.Version]; !ok {
+			return fmt.Errorf("%w: migration %d (%s) was never applied", ErrUnexpectedVersion, m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// Up applies pending migrations up to target (Latest when 0) and returns them
+func Up(db *gorm.DB, target int) ([]Migration, error) {
+	if target == 0 {
+		target = Latest()
+	}
+	if target < 0 || target > Latest() {
+		return nil, fmt.Errorf("no migration %d (latest is %d)", target, Latest())
+	}
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for _, m := range all {
+		if m.Version > target {
+			break
+		}
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d (%s) up: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns them
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for i := len(all) - 1; i >= 0 && len(ran) < steps; i-- {
+		m := all[i]
+		if _, ok := done[m.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d (%s) down: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// Statuses lists every migration of this build with its state
+func Statuses(db *gorm.DB) ([]Status, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Status, len(all))
+	for i, m := range all {
+		out[i] = Status{Version: m.Version, Name: m.Name}
+		if row, ok := done[m.Version]; ok {
+			out[i].AppliedAt = &row.AppliedAt
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package migrations
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"busapp/db"
+	"busapp/models"
+
+	"gorm.io/gorm"
+)
+
+// everyModel is every table the app reads and writes
+var everyModel = []interface{}{&models.Agency{}, &models.Admin{}, &models.Route{}, &models.Stop{}, &models.Schedule{},
+	&models.APIKey{}, &models.APIKeyUsage{}, &models.AuditEntry{},
+	&models.DraftChange{}, &models.NetworkVersion{}, &models.Alert{}}
+
+// forEachBackend runs fn on an empty SQLite database and, when
+// TEST_POSTGRES_DSN points at a scratch database, on PostgreSQL (emptied first)
+func forEachBackend(t *testing.T, fn func(t *testing.T, gdb *gorm.DB)) {
+	backends := map[string]string{
+		db.DriverSQLite:   filepath.Join(t.TempDir(), "test.db"),
+		db.DriverPostgres: os.Getenv("TEST_POSTGRES_DSN"),
+	}
+	for _, name := range []string{db.DriverSQLite, db.DriverPostgres} {
+		t.Run(name, func(t *testing.T) {
+			dsn := backends[name]
+			if dsn == "" {
+				if os.Getenv("CI") != "" {
+					t.Fatal("TEST_POSTGRES_DSN not set on CI, see .github/workflows/test.yml")
+				}
+				t.Skip("TEST_POSTGRES_DSN not set")
+			}
+			gdb, err := db.InitDB(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sqlDB, err := gdb.DB(); err == nil {
+				t.Cleanup(func() { sqlDB.Close() })
+			}
+			if _, err := Down(gdb, len(all)); err != nil {
+				t.Fatal(err)
+			}
+			if err := gdb.Migrator().DropTable(append(everyModel, &schemaMigration{})...); err != nil {
+				t.Fatal(err)
+			}
+			fn(t, gdb)
+		})
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, gdb *gorm.DB) {
+		if err := Check(gdb); !errors.Is(err, ErrUnexpectedVersion) {
+			t.Fatalf("Check on an empty database = %v, want ErrUnexpectedVersion", err)
+		}
+
+		ran, err := Up(gdb, 1)
+		if err != nil || len(ran) != 1 {
+			t.Fatalf("Up(1) ran %d, err %v", len(ran), err)
+		}
+		if v, _ := Current(gdb); v != 1 {
+			t.Fatalf("version after Up(1) = %d, want 1", v)
+		}
+		if err := Check(gdb); !errors.Is(err, ErrUnexpectedVersion) {
+			t.Fatalf("Check behind Latest = %v, want ErrUnexpectedVersion", err)
+		}
+
+		if _, err := Up(gdb, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(gdb); err != nil {
+			t.Fatalf("Check after Up = %v", err)
+		}
+		if ran, err := Up(gdb, 0); err != nil || len(ran) != 0 {
+			t.Fatalf("second Up ran %d, err %v", len(ran), err)
+		}
+		statuses, err := Statuses(gdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range statuses {
+			if s.AppliedAt == nil {
+				t.Errorf("migration %d is pending after Up", s.Version)
+			}
+		}
+
+		// the migrated schema has every column the models use
+		for _, m := range everyModel {
+			stmt := &gorm.Statement{DB: gdb}
+			if err := stmt.Parse(m); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range stmt.Schema.Fields {
+				if f.DBName != "" && !gdb.Migrator().HasColumn(m, f.DBName) {
+					t.Errorf("%s.%s is not created by any migration", stmt.Schema.Table, f.DBName)
+				}
+			}
+		}
+
+		ran, err = Down(gdb, len(all))
+		if err != nil || len(ran) != len(all) {
+			t.Fatalf("Down ran %d, err %v", len(ran), err)
+		}
+		for _, m := range everyModel {
+			if gdb.Migrator().HasTable(m) {
+				t.Errorf("%T still exists after Down", m)
+			}
+		}
+		if v, _ := Current(gdb); v != 0 {
+			t.Fatalf("version after Down = %d, want 0", v)
+		}
+	})
+}
+
+func TestAdoptAutoMigratedDatabase(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, gdb *gorm.DB) {
+		// as created by the server before migrations existed
+		if err := gdb.AutoMigrate(everyModel...); err != nil {
+			t.Fatal(err)
+		}
+		route := models.Route{Name: "Yaba–Ikeja", Stops: []models.Stop{{Name: "Yaba", OrderIndex: 1}}}
+		if err := gdb.Create(&route).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Up(gdb, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(gdb); err != nil {
+			t.Fatal(err)
+		}
+		var stops int64
+		gdb.Model(&models.Stop{}).Where("route_id = ?", route.ID).Count(&stops)
+		if stops != 1 {
+			t.Errorf("route has %d stops after migrating, want 1", stops)
+		}
+	})
+}
+
+func TestCheckRefusesNewerSchema(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, gdb *gorm.DB) {
+		if _, err := Up(gdb, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := gdb.Create(&schemaMigration{Version: Latest() + 1, Name: "from the future"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(gdb); !errors.Is(err, ErrUnexpectedVersion) {
+			t.Fatalf("Check = %v, want ErrUnexpectedVersion", err)
+		}
+		gdb.Delete(&schemaMigration{}, Latest()+1)
+	})
+}
+
+func TestVersionsAreSequential(t *testing.T) {
+	for i, m := range all {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == nil || m.Down == nil {
+			t.Errorf("migration %d needs both Up and Down", m.Version)
+		}
+	}
+}
@@ -1,37 +1,184 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"strings"
+	"time"
 
-// GORM models
+	"gorm.io/gorm"
+)
+
+// GORM models. The tables are created by the migrations package: a field or
+// tag change here needs a new migration too.
+
+// Agency is an operator (tenant) owning routes and admins
+type Agency struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"unique" json:"name"`
+	URL       string    `json:"url,omitempty"`
+	Timezone  string    `json:"timezone,omitempty"` // IANA name, e.g. "Africa/Lagos"
+	Phone     string    `json:"phone,omitempty"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
 
 type Route struct {
-	ID          uint       `gorm:"primaryKey" json:"id"`
-	Name        string     `json:"name"`
-	Description string     `json:"description,omitempty"`
-	Stops       []Stop     `gorm:"constraint:OnDelete:CASCADE" json:"stops"`
-	Schedules   []Schedule `gorm:"constraint:OnDelete:CASCADE" json:"schedules"`
-	CreatedAt   time.Time  `json:"-"`
-	UpdatedAt   time.Time  `json:"-"`
+	ID          uint           `gorm:"primaryKey" json:"id"`
+	AgencyID    *uint          `gorm:"index" json:"agency_id,omitempty"`
+	Agency      *Agency        `json:"agency,omitempty"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Stops       []Stop         `gorm:"constraint:OnDelete:CASCADE" json:"stops"`
+	Schedules   []Schedule     `gorm:"constraint:OnDelete:CASCADE" json:"schedules"`
+	CreatedAt   time.Time      `json:"-"`
+	UpdatedAt   time.Time      `json:"-"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"` // soft delete, see handlers/trash.go
 }
 
 type Stop struct {
-	ID         uint    `gorm:"primaryKey" json:"id"`
-	RouteID    uint    `json:"-"`
-	Name       string  `json:"name"`
-	Latitude   float64 `json:"latitude"`
-	Longitude  float64 `json:"longitude"`
-	OrderIndex int     `json:"order_index"`
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	RouteID    uint           `json:"-"`
+	Name       string         `json:"name"`
+	Latitude   float64        `gorm:"index:idx_stops_lat_lon" json:"latitude"` // see the spatial package
+	Longitude  float64        `gorm:"index:idx_stops_lat_lon" json:"longitude"`
+	OrderIndex int            `json:"order_index"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 type Schedule struct {
-	ID           uint   `gorm:"primaryKey" json:"id"`
-	RouteID      uint   `json:"-"`
-	Departure    string `json:"departure"`     // "06:30"
-	FrequencyMin int    `json:"frequency_min"` // e.g. 30
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	RouteID      uint           `json:"-"`
+	Departure    string         `json:"departure"`     // "06:30"
+	FrequencyMin int            `json:"frequency_min"` // e.g. 30
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Alert severities
+const (
+	AlertInfo    = "info"
+	AlertWarning = "warning"
+	AlertSevere  = "severe"
+)
+
+// Alert is a service notice for riders (detour, cancellation, ...). It covers
+// one route, or every route of its agency when RouteID is nil (the whole
+// network when AgencyID is nil too). Nil StartsAt/EndsAt leave it open-ended.
+type Alert struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	AgencyID  *uint      `gorm:"index" json:"agency_id,omitempty"`
+	RouteID   *uint      `gorm:"index" json:"route_id,omitempty"`
+	Severity  string     `json:"severity"`
+	Title     string     `json:"title"`
+	Message   string     `json:"message"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"-"`
 }
 
 type Admin struct {
 	ID       uint   `gorm:"primaryKey" json:"id"`
+	AgencyID uint   `gorm:"index" json:"agency_id"` // 0 = platform admin, sees every agency
 	Username string `gorm:"unique" json:"username"`
 	Password string `json:"-"` // never exposed in JSON
 }
+
+// APIKey identifies a third-party consumer of the public endpoints.
+// Only the SHA-256 hash of the key is stored; the plain key is shown once on creation.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Prefix     string     `gorm:"index" json:"prefix"` // first chars of the key, to recognise it in listings
+	KeyHash    string     `gorm:"uniqueIndex" json:"-"`
+	Scopes     string     `json:"scopes"`     // comma separated, e.g. "public:read"
+	RateLimit  int        `json:"rate_limit"` // requests per minute
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"-"`
+}
+
+// HasScope reports whether the key was granted the given scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if strings.TrimSpace(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyUsage counts requests per key, per day and per endpoint
+type APIKeyUsage struct {
+	ID       uint   `gorm:"primaryKey" json:"-"`
+	APIKeyID uint   `gorm:"uniqueIndex:idx_usage_key_day_path" json:"api_key_id"`
+	Day      string `gorm:"uniqueIndex:idx_usage_key_day_path" json:"day"` // "2006-01-02"
+	Path     string `gorm:"uniqueIndex:idx_usage_key_day_path" json:"path"`
+	Count    int64  `json:"count"`
+}
+
+// Audit actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRevert  = "revert"
+	AuditRestore = "restore" // brought back from the trash
+)
+
+// AuditEntry records one admin change. Before/After hold JSON snapshots of the
+// entity ("null" when it did not exist) and Diff the changed fields.
+type AuditEntry struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	AgencyID  uint            `gorm:"index" json:"agency_id"`
+	ActorID   uint            `gorm:"index" json:"actor_id"`
+	ActorName string          `gorm:"index" json:"actor_name"`
+	Action    string          `json:"action"`
+	Entity    string          `gorm:"index:idx_audit_entity" json:"entity"` // "route", "stop", "schedule"
+	EntityID  uint            `gorm:"index:idx_audit_entity" json:"entity_id"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Diff      json.RawMessage `json:"diff"`
+	IP        string          `json:"ip"`
+	CreatedAt time.Time       `gorm:"index" json:"created_at"`
+}
+
+// DraftChange is a staged change to the network, applied on publish.
+// Data holds the create/update payload for the entity.
+type DraftChange struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	AgencyID  uint            `gorm:"index" json:"agency_id"`
+	Entity    string          `json:"entity"`    // "route", "stop", "schedule"
+	EntityID  uint            `json:"entity_id"` // 0 for creates
+	RouteID   uint            `json:"route_id"`  // parent route for stop/schedule creates
+	Action    string          `json:"action"`    // AuditCreate, AuditUpdate or AuditDelete
+	Data      json.RawMessage `json:"data"`
+	CreatedBy string          `json:"created_by"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Network version statuses
+const (
+	VersionScheduled  = "scheduled"
+	VersionLive       = "live"
+	VersionSuperseded = "superseded"
+	VersionRolledBack = "rolled_back"
+	VersionFailed     = "failed" // could not be activated
+)
+
+// NetworkVersion is a numbered publication of an agency's network (AgencyID 0
+// covers the whole network). Changes holds the drafts that were published,
+// Snapshot the routes as they were once live.
+type NetworkVersion struct {
+	ID          uint            `gorm:"primaryKey" json:"-"`
+	AgencyID    uint            `gorm:"uniqueIndex:idx_version_agency_number" json:"agency_id"`
+	Number      int             `gorm:"uniqueIndex:idx_version_agency_number" json:"number"`
+	Status      string          `json:"status"`
+	Note        string          `json:"note,omitempty"`
+	EffectiveAt time.Time       `json:"effective_at"`
+	PublishedBy string          `json:"published_by"`
+	Changes     json.RawMessage `json:"changes"`
+	Snapshot    json.RawMessage `json:"snapshot,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
@@ -0,0 +1,432 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"busapp/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Repositories wrap the GORM queries of the network (routes, stops,
+// schedules, alerts), of agencies and API keys and of the audit log, so the service package works on interfaces
+// and never builds queries itself.
+//
+// Lookups take the agency of the caller: 0 means every agency, any other ID
+// limits routes to that agency and stops and schedules to its routes. Get
+// returns gorm.ErrRecordNotFound for missing (or out of agency) rows.
+
+var (
+	// ErrStopNotOnRoute is returned by Stops.InsertAfter for a stop of another route
+	ErrStopNotOnRoute = errors.New("stop is not on this route")
+	// ErrNotInTrash is returned by Restore for an entity that is not trashed
+	ErrNotInTrash = errors.New("not in trash")
+	// ErrRouteInTrash is returned by Restore for a stop or schedule of a trashed route
+	ErrRouteInTrash = errors.New("route is in trash")
+)
+
+// Routes stores routes
+type Routes interface {
+	Get(agencyID, id uint) (models.Route, error)
+	// Load returns routes with their agency, stops (in order) and schedules;
+	// every route of the agency when no ids are given
+	Load(agencyID uint, ids ...uint) ([]models.Route, error)
+	Create(route *models.Route) error
+	// Save updates a route, leaving its stops and schedules alone
+	Save(route *models.Route) error
+	// Trash soft-deletes a route with its stops and schedules
+	Trash(id uint) error
+	// Restore brings a trashed route back with the stops and schedules
+	// trashed along with it, and returns it with them
+	Restore(agencyID, id uint) (models.Route, error)
+	// Replace trashes every route of an agency (not 0) with its stops and
+	// schedules, then creates routes with their IDs. Rows holding these IDs,
+	// trashed or not, are removed for good first.
+	Replace(agencyID uint, routes []models.Route) error
+}
+
+// Stops stores stops
+type Stops interface {
+	Get(agencyID, id uint) (models.Stop, error)
+	Create(stop *models.Stop) error
+	// InsertAfter creates stop right after afterStopID (0 = first) on its
+	// route, returning the later stops as they were before being shifted
+	InsertAfter(stop *models.Stop, afterStopID uint) ([]models.Stop, error)
+	Save(stop *models.Stop) error
+	Delete(id uint) error
+	// Restore brings a trashed stop back while its route is live
+	Restore(agencyID, id uint) (models.Stop, error)
+}
+
+// Schedules stores schedules
+type Schedules interface {
+	Get(agencyID, id uint) (models.Schedule, error)
+	Create(sch *models.Schedule) error
+	Save(sch *models.Schedule) error
+	Delete(id uint) error
+	// Restore brings a trashed schedule back while its route is live
+	Restore(agencyID, id uint) (models.Schedule, error)
+}
+
+// Alerts stores alerts
+type Alerts interface {
+	Get(agencyID, id uint) (models.Alert, error)
+	Create(alert *models.Alert) error
+	Save(alert *models.Alert) error
+	Delete(id uint) error
+}
+
+// Agencies stores agencies
+type Agencies interface {
+	Get(id uint) (models.Agency, error)
+	Create(agency *models.Agency) error
+	Save(agency *models.Agency) error
+}
+
+// APIKeys stores API keys
+type APIKeys interface {
+	Get(id uint) (models.APIKey, error)
+	Create(key *models.APIKey) error
+	Save(key *models.APIKey) error
+}
+
+// AuditLog stores audit entries
+type AuditLog interface {
+	// Get returns an entry of the changes made in an agency
+	Get(agencyID, id uint) (models.AuditEntry, error)
+	Add(entry *models.AuditEntry) error
+}
+
+// Store gives access to every repository
+type Store interface {
+	Routes() Routes
+	Stops() Stops
+	Schedules() Schedules
+	Alerts() Alerts
+	Agencies() Agencies
+	APIKeys() APIKeys
+	Audit() AuditLog
+	// Transaction runs fn with a store whose repositories share one
+	// transaction, committed when fn returns nil
+	Transaction(fn func(tx Store) error) error
+}
+
+// New returns the store backed by db
+func New(db *gorm.DB) Store {
+	return gormStore{db: db}
+}
+
+// RouteScope limits route queries to an agency (0 = no limit)
+func RouteScope(agencyID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if agencyID == 0 {
+			return db
+		}
+		return db.Where("routes.agency_id = ?", agencyID)
+	}
+}
+
+// RouteChildScope limits stop/schedule queries to the routes of an agency (0 = no limit)
+func RouteChildScope(agencyID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if agencyID == 0 {
+			return db
+		}
+		routes := db.Session(&gorm.Session{NewDB: true}).Model(&models.Route{}).
+			Select("id").Where("agency_id = ?", agencyID)
+		return db.Where("route_id IN (?)", routes)
+	}
+}
+
+// TrashedRouteScope limits route queries to the trashed routes of an agency
+// (0 = every agency)
+func TrashedRouteScope(agencyID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped().Scopes(RouteScope(agencyID)).Where("routes.deleted_at IS NOT NULL")
+	}
+}
+
+// TrashedChildScope limits queries on table (stops or schedules) to the rows
+// of an agency that were trashed on their own, not along with their route
+func TrashedChildScope(table string, agencyID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Scopes(trashedChildren(table, agencyID)).
+			Where("NOT EXISTS (SELECT 1 FROM routes WHERE routes.id = " + table + ".route_id AND routes.deleted_at = " + table + ".deleted_at)")
+	}
+}
+
+// trashedChildren limits queries on table to the trashed rows of an agency,
+// whether their route is trashed or not
+func trashedChildren(table string, agencyID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Unscoped().Where(table + ".deleted_at IS NOT NULL")
+		if agencyID != 0 {
+			routes := db.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&models.Route{}).
+				Select("id").Where("agency_id = ?", agencyID)
+			db = db.Where(table+".route_id IN (?)", routes)
+		}
+		return db
+	}
+}
+
+// ----------- GORM ------------
+
+type gormStore struct{ db *gorm.DB }
+
+func (s gormStore) Routes() Routes       { return gormRoutes(s) }
+func (s gormStore) Stops() Stops         { return gormStops(s) }
+func (s gormStore) Schedules() Schedules { return gormSchedules(s) }
+func (s gormStore) Alerts() Alerts       { return gormAlerts(s) }
+func (s gormStore) Agencies() Agencies   { return gormAgencies(s) }
+func (s gormStore) APIKeys() APIKeys     { return gormAPIKeys(s) }
+func (s gormStore) Audit() AuditLog      { return gormAudit(s) }
+
+func (s gormStore) Transaction(fn func(tx Store) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error { return fn(gormStore{db: tx}) })
+}
+
+type gormRoutes gormStore
+
+func (r gormRoutes) Get(agencyID, id uint) (models.Route, error) {
+	var route models.Route
+	err := r.db.Scopes(RouteScope(agencyID)).First(&route, id).Error
+	return route, err
+}
+
+func (r gormRoutes) Load(agencyID uint, ids ...uint) ([]models.Route, error) {
+	q := r.db.Scopes(RouteScope(agencyID)).Preload("Agency").Preload("Stops", func(db *gorm.DB) *gorm.DB {
+		return db.Order("order_index asc")
+	}).Preload("Schedules").Order("id asc")
+	if len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+
+	var routes []models.Route
+	err := q.Find(&routes).Error
+	return routes, err
+}
+
+func (r gormRoutes) Create(route *models.Route) error { return r.db.Create(route).Error }
+func (r gormRoutes) Save(route *models.Route) error {
+	return r.db.Omit(clause.Associations).Save(route).Error
+}
+
+// Trash stamps the route, its stops and its schedules with the same deletion
+// time so they can be restored together
+func (r gormRoutes) Trash(id uint) error {
+	now := time.Now()
+	for _, m := range []interface{}{&models.Stop{}, &models.Schedule{}} {
+		if err := r.db.Model(m).Where("route_id = ?", id).Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+	}
+	return r.db.Model(&models.Route{}).Where("id = ?", id).Update("deleted_at", now).Error
+}
+
+func (r gormRoutes) Restore(agencyID, id uint) (models.Route, error) {
+	var route models.Route
+	if err := r.db.Scopes(TrashedRouteScope(agencyID)).First(&route, id).Error; err != nil {
+		return route, ErrNotInTrash
+	}
+	for _, m := range []interface{}{&models.Stop{}, &models.Schedule{}} {
+		if err := r.db.Unscoped().Model(m).Where("route_id = ? AND deleted_at = ?", id, route.DeletedAt.Time).
+			Update("deleted_at", nil).Error; err != nil {
+			return route, err
+		}
+	}
+	if err := r.db.Unscoped().Model(&route).Update("deleted_at", nil).Error; err != nil {
+		return route, err
+	}
+	err := r.db.Preload("Stops", func(db *gorm.DB) *gorm.DB {
+		return db.Order("order_index asc")
+	}).Preload("Schedules").First(&route, id).Error
+	return route, err
+}
+
+func (r gormRoutes) Replace(agencyID uint, routes []models.Route) error {
+	if agencyID == 0 {
+		return errors.New("replacing routes needs an agency") // RouteScope(0) is every agency
+	}
+	now := time.Now()
+	all := r.db.Session(&gorm.Session{AllowGlobalUpdate: true})
+	for _, m := range []interface{}{&models.Schedule{}, &models.Stop{}} {
+		if err := all.Scopes(RouteChildScope(agencyID)).Model(m).Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+	}
+	if err := all.Scopes(RouteScope(agencyID)).Model(&models.Route{}).Update("deleted_at", now).Error; err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+
+	var routeIDs, stopIDs, scheduleIDs []uint
+	for _, route := range routes {
+		routeIDs = append(routeIDs, route.ID)
+		for _, s := range route.Stops {
+			stopIDs = append(stopIDs, s.ID)
+		}
+		for _, s := range route.Schedules {
+			scheduleIDs = append(scheduleIDs, s.ID)
+		}
+	}
+	purge := []struct {
+		model interface{}
+		ids   []uint
+	}{{&models.Route{}, routeIDs}, {&models.Stop{}, stopIDs}, {&models.Schedule{}, scheduleIDs}}
+	for _, p := range purge {
+		if len(p.ids) == 0 {
+			continue
+		}
+		if err := r.db.Unscoped().Where("id IN ?", p.ids).Delete(p.model).Error; err != nil {
+			return err
+		}
+	}
+	return r.db.Create(&routes).Error
+}
+
+// restoreChild un-deletes the stop or schedule m of table, once its route
+// (read with routeID after loading m) is checked to be live
+func restoreChild(db *gorm.DB, table string, m interface{}, agencyID, id uint, routeID func() uint) error {
+	if err := db.Scopes(trashedChildren(table, agencyID)).First(m, id).Error; err != nil {
+		return ErrNotInTrash
+	}
+	if err := db.First(&models.Route{}, routeID()).Error; err != nil {
+		return ErrRouteInTrash
+	}
+	if err := db.Unscoped().Model(m).Update("deleted_at", nil).Error; err != nil {
+		return err
+	}
+	return db.First(m, id).Error
+}
+
+type gormStops gormStore
+
+func (r gormStops) Get(agencyID, id uint) (models.Stop, error) {
+	var stop models.Stop
+	err := r.db.Scopes(RouteChildScope(agencyID)).First(&stop, id).Error
+	return stop, err
+}
+
+func (r gormStops) Create(stop *models.Stop) error { return r.db.Create(stop).Error }
+func (r gormStops) Save(stop *models.Stop) error   { return r.db.Save(stop).Error }
+func (r gormStops) Delete(id uint) error           { return r.db.Delete(&models.Stop{}, id).Error }
+
+func (r gormStops) Restore(agencyID, id uint) (models.Stop, error) {
+	var stop models.Stop
+	err := restoreChild(r.db, "stops", &stop, agencyID, id, func() uint { return stop.RouteID })
+	return stop, err
+}
+
+func (r gormStops) InsertAfter(stop *models.Stop, afterStopID uint) ([]models.Stop, error) {
+	var stops []models.Stop
+	if err := r.db.Where("route_id = ?", stop.RouteID).Order("order_index asc, id asc").Find(&stops).Error; err != nil {
+		return nil, err
+	}
+
+	position := 1
+	if len(stops) > 0 {
+		position = stops[0].OrderIndex
+	}
+	if afterStopID != 0 {
+		found := false
+		for _, s := range stops {
+			if s.ID == afterStopID {
+				position, found = s.OrderIndex+1, true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrStopNotOnRoute
+		}
+	}
+
+	var shifted []models.Stop
+	for _, s := range stops {
+		if s.OrderIndex >= position {
+			shifted = append(shifted, s)
+		}
+	}
+	if len(shifted) > 0 {
+		if err := r.db.Model(&models.Stop{}).Where("route_id = ? AND order_index >= ?", stop.RouteID, position).
+			Update("order_index", gorm.Expr("order_index + 1")).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	stop.OrderIndex = position
+	return shifted, r.db.Create(stop).Error
+}
+
+type gormSchedules gormStore
+
+func (r gormSchedules) Get(agencyID, id uint) (models.Schedule, error) {
+	var sch models.Schedule
+	err := r.db.Scopes(RouteChildScope(agencyID)).First(&sch, id).Error
+	return sch, err
+}
+
+func (r gormSchedules) Create(sch *models.Schedule) error { return r.db.Create(sch).Error }
+func (r gormSchedules) Save(sch *models.Schedule) error   { return r.db.Save(sch).Error }
+func (r gormSchedules) Delete(id uint) error              { return r.db.Delete(&models.Schedule{}, id).Error }
+
+func (r gormSchedules) Restore(agencyID, id uint) (models.Schedule, error) {
+	var sch models.Schedule
+	err := restoreChild(r.db, "schedules", &sch, agencyID, id, func() uint { return sch.RouteID })
+	return sch, err
+}
+
+type gormAlerts gormStore
+
+func (r gormAlerts) Get(agencyID, id uint) (models.Alert, error) {
+	var alert models.Alert
+	q := r.db
+	if agencyID != 0 {
+		q = q.Where("agency_id = ?", agencyID)
+	}
+	err := q.First(&alert, id).Error
+	return alert, err
+}
+
+func (r gormAlerts) Create(alert *models.Alert) error { return r.db.Create(alert).Error }
+func (r gormAlerts) Save(alert *models.Alert) error   { return r.db.Save(alert).Error }
+func (r gormAlerts) Delete(id uint) error             { return r.db.Delete(&models.Alert{}, id).Error }
+
+type gormAgencies gormStore
+
+func (r gormAgencies) Get(id uint) (models.Agency, error) {
+	var agency models.Agency
+	err := r.db.First(&agency, id).Error
+	return agency, err
+}
+
+func (r gormAgencies) Create(agency *models.Agency) error { return r.db.Create(agency).Error }
+func (r gormAgencies) Save(agency *models.Agency) error   { return r.db.Save(agency).Error }
+
+type gormAPIKeys gormStore
+
+func (r gormAPIKeys) Get(id uint) (models.APIKey, error) {
+	var key models.APIKey
+	err := r.db.First(&key, id).Error
+	return key, err
+}
+
+func (r gormAPIKeys) Create(key *models.APIKey) error { return r.db.Create(key).Error }
+func (r gormAPIKeys) Save(key *models.APIKey) error   { return r.db.Save(key).Error }
+
+type gormAudit gormStore
+
+func (r gormAudit) Get(agencyID, id uint) (models.AuditEntry, error) {
+	var entry models.AuditEntry
+	q := r.db
+	if agencyID != 0 {
+		q = q.Where("agency_id = ?", agencyID)
+	}
+	err := q.First(&entry, id).Error
+	return entry, err
+}
+
+func (r gormAudit) Add(entry *models.AuditEntry) error { return r.db.Create(entry).Error }
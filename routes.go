@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"busapp/config"
+	"busapp/docs"
+	"busapp/handlers"
+	"busapp/metrics"
+	"busapp/middleware"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// routeMiddleware holds the middleware instances shared by every mount of the API
+type routeMiddleware struct {
+	authLimit   gin.HandlerFunc
+	ipLimit     gin.HandlerFunc
+	apiKey      gin.HandlerFunc
+	publicLimit gin.HandlerFunc
+	auth        gin.HandlerFunc
+	adminLimit  gin.HandlerFunc
+	graphAuth   gin.HandlerFunc
+}
+
+// newRouter builds the engine with every route mounted; ready are the
+// readiness checks besides the database's
+func newRouter(db *gorm.DB, cfg *config.Config, ready ...handlers.ReadyCheck) *gin.Engine {
+	r := gin.New()
+	r.Use(middleware.RequestID())
+	r.Use(middleware.Logger(slog.Default()), middleware.Recovery(slog.Default()))
+	r.Use(middleware.Metrics())
+	r.Use(middleware.CorsMiddleware(cfg.CORSOrigins))
+
+	// Shared by the versioned and legacy paths so both count against the same limits
+	mw := routeMiddleware{
+		authLimit:   middleware.RateLimit(middleware.RateLimitPolicy{Requests: 10, Per: time.Minute, Key: middleware.KeyByIP}),
+		ipLimit:     middleware.RateLimit(middleware.RateLimitPolicy{Requests: middleware.KeyLookupRateLimit, Per: time.Minute, Key: middleware.KeyByIP}),
+		apiKey:      middleware.APIKeyMiddleware(db, handlers.ScopePublicRead), // optional API key
+		publicLimit: middleware.RateLimit(middleware.RateLimitPolicy{Requests: middleware.AnonymousRateLimit, Per: time.Minute, Key: middleware.KeyByAPIKey}),
+		auth:        middleware.AuthMiddleware(), // JWT required
+		adminLimit:  middleware.RateLimit(middleware.RateLimitPolicy{Requests: 300, Per: time.Minute, Key: middleware.KeyByAdmin}),
+		graphAuth:   middleware.OptionalAuth(), // JWT for mutations only
+	}
+
+	registerRoutes(r.Group("/api/v1", middleware.APIVersion(handlers.APIVersionV1)), db, mw)
+
+	// Legacy unversioned paths, kept during the deprecation period
+	registerRoutes(r.Group("", middleware.Deprecated("/api/v1")), db, mw)
+	old := r.Group("", middleware.Deprecated("/api/v1/public")) // former duplicates of /public/routes
+	old.Use(mw.ipLimit, mw.apiKey, mw.publicLimit)
+	old.GET("/routes", func(c *gin.Context) { handlers.PublicGetRoutesHandler(c, db) })
+	old.GET("/routes/:id", func(c *gin.Context) { handlers.PublicGetRouteByIDHandler(c, db) })
+
+	// API documentation
+	r.GET("/openapi.json", docs.SpecHandler)
+	r.GET("/docs", docs.UIHandler)
+
+	// Probes and metrics for operations (see handlers/health.go, the metrics package)
+	r.GET("/healthz", handlers.HealthzHandler)
+	r.GET("/readyz", func(c *gin.Context) { handlers.ReadyzHandler(c, db, ready...) })
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	return r
+}
+
+// registerRoutes mounts the API on g (under /api/v1 and on the legacy paths)
+func registerRoutes(g *gin.RouterGroup, db *gorm.DB, mw routeMiddleware) {
+	// Auth routes
+	auth := g.Group("/auth")
+	auth.Use(mw.authLimit)
+	auth.POST("/register", mw.auth, func(c *gin.Context) { handlers.RegisterHandler(c, db) })
+	auth.POST("/login", func(c *gin.Context) { handlers.LoginHandler(c, db) })
+
+	// Public endpoints
+	public := g.Group("/public")
+	public.Use(mw.ipLimit, mw.apiKey, mw.publicLimit)
+	public.GET("/agencies", func(c *gin.Context) { handlers.PublicGetAgenciesHandler(c, db) })
+	public.GET("/routes", func(c *gin.Context) { handlers.PublicGetRoutesHandler(c, db) })
+	public.GET("/routes/:id", func(c *gin.Context) { handlers.PublicGetRouteByIDHandler(c, db) })
+	public.GET("/next-bus/:id", func(c *gin.Context) { handlers.PublicGetNextBusHandler(c, db) })
+	public.GET("/search", func(c *gin.Context) { handlers.PublicSearchHandler(c, db) })
+	public.GET("/stops", func(c *gin.Context) { handlers.PublicStopsInBBoxHandler(c, db) })
+	public.GET("/stops/nearby", func(c *gin.Context) { handlers.PublicNearbyStopsHandler(c, db) })
+
+	public.GET("/health", func(c *gin.Context) { c.JSON(http.StatusOK, handlers.StatusResponse{Status: "ok"}) })
+
+	// GraphQL: public queries, admin mutations (see handlers/graphql.go)
+	graph := g.Group("/graphql")
+	graph.Use(mw.ipLimit, mw.apiKey, mw.publicLimit, mw.graphAuth)
+	graph.GET("", func(c *gin.Context) { handlers.GraphQLHandler(c, db) })
+	graph.POST("", func(c *gin.Context) { handlers.GraphQLHandler(c, db) })
+
+	// Admin (protected)
+	admin := g.Group("/admin")
+	admin.Use(mw.auth, mw.adminLimit)
+
+	admin.POST("/agencies", func(c *gin.Context) { handlers.CreateAgencyHandler(c, db) })
+	admin.PUT("/agencies/:id", func(c *gin.Context) { handlers.UpdateAgencyHandler(c, db) })
+
+	admin.POST("/routes", func(c *gin.Context) { handlers.CreateRouteHandler(c, db) })
+	admin.PUT("/routes/:id", func(c *gin.Context) { handlers.UpdateRouteHandler(c, db) })
+	admin.DELETE("/routes/:id", func(c *gin.Context) { handlers.DeleteRouteHandler(c, db) })
+	admin.POST("/routes/:id/clone", func(c *gin.Context) { handlers.CloneRouteHandler(c, db) })
+
+	admin.POST("/routes/:id/stops", func(c *gin.Context) { handlers.AddStopHandler(c, db) })
+	admin.PUT("/routes/:id/stops/order", func(c *gin.Context) { handlers.ReorderStopsHandler(c, db) })
+	admin.PUT("/stops/:id", func(c *gin.Context) { handlers.UpdateStopHandler(c, db) })
+	admin.DELETE("/stops/:id", func(c *gin.Context) { handlers.DeleteStopHandler(c, db) })
+
+	admin.POST("/routes/:id/schedules", func(c *gin.Context) { handlers.AddScheduleHandler(c, db) })
+	admin.PUT("/schedules/:id", func(c *gin.Context) { handlers.UpdateScheduleHandler(c, db) })
+	admin.DELETE("/schedules/:id", func(c *gin.Context) { handlers.DeleteScheduleHandler(c, db) })
+
+	admin.POST("/upload-csv", func(c *gin.Context) { handlers.UploadCSVHandler(c, db) })
+	admin.GET("/export", func(c *gin.Context) { handlers.ExportHandler(c, db) })
+	admin.GET("/validate", func(c *gin.Context) { handlers.ValidateNetworkHandler(c, db) })
+
+	admin.POST("/drafts", func(c *gin.Context) { handlers.StageDraftHandler(c, db) })
+	admin.GET("/drafts", func(c *gin.Context) { handlers.ListDraftsHandler(c, db) })
+	admin.GET("/drafts/preview", func(c *gin.Context) { handlers.PreviewDraftsHandler(c, db) })
+	admin.POST("/drafts/publish", func(c *gin.Context) { handlers.PublishDraftsHandler(c, db) })
+	admin.DELETE("/drafts/:id", func(c *gin.Context) { handlers.DiscardDraftHandler(c, db) })
+	admin.GET("/versions", func(c *gin.Context) { handlers.ListVersionsHandler(c, db) })
+	admin.POST("/versions/rollback", func(c *gin.Context) { handlers.RollbackVersionHandler(c, db) })
+
+	admin.GET("/trash", func(c *gin.Context) { handlers.ListTrashHandler(c, db) })
+	admin.POST("/trash/:entity/:id/restore", func(c *gin.Context) { handlers.RestoreTrashHandler(c, db) })
+
+	admin.GET("/audit", func(c *gin.Context) { handlers.ListAuditHandler(c, db) })
+	admin.POST("/audit/:id/revert", func(c *gin.Context) { handlers.RevertAuditHandler(c, db) })
+
+	admin.POST("/api-keys", func(c *gin.Context) { handlers.CreateAPIKeyHandler(c, db) })
+	admin.GET("/api-keys", func(c *gin.Context) { handlers.ListAPIKeysHandler(c, db) })
+	admin.DELETE("/api-keys/:id", func(c *gin.Context) { handlers.RevokeAPIKeyHandler(c, db) })
+	admin.GET("/api-keys/:id/usage", func(c *gin.Context) { handlers.GetAPIKeyUsageHandler(c, db) })
+}
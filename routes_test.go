@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"busapp/config"
+	"busapp/docs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestOpenAPICoversRoutes fails when a route is registered without an entry in
+// the OpenAPI spec, or the spec documents a route that no longer exists
+func TestOpenAPICoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := newRouter(nil, config.Default())
+
+	registered := map[string]bool{}
+	for _, rt := range r.Routes() {
+		registered[rt.Method+" "+rt.Path] = true
+	}
+
+	for _, rt := range r.Routes() {
+		switch {
+		case rt.Path == "/openapi.json" || rt.Path == "/docs":
+		case rt.Path == "/healthz" || rt.Path == "/readyz" || rt.Path == "/metrics": // operations, not API
+		case strings.HasPrefix(rt.Path, "/api/v1/"):
+			if !docs.Documented(rt.Method, strings.TrimPrefix(rt.Path, "/api/v1")) {
+				t.Errorf("%s %s is not in the OpenAPI spec", rt.Method, rt.Path)
+			}
+		default:
+			// legacy paths must have a documented /api/v1 successor
+			if !registered[rt.Method+" /api/v1"+rt.Path] && !registered[rt.Method+" /api/v1/public"+rt.Path] {
+				t.Errorf("legacy %s %s has no /api/v1 equivalent", rt.Method, rt.Path)
+			}
+		}
+	}
+
+	for path, item := range docs.Spec().Paths {
+		for method := range item {
+			ginPath := "/api/v1" + strings.NewReplacer("{", ":", "}", "").Replace(path)
+			if !registered[strings.ToUpper(method)+" "+ginPath] {
+				t.Errorf("spec documents %s %s, which is not registered", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// TestLegacyRoutesAreLimited checks that the legacy /routes paths share the
+// limits and usage metering of /api/v1/public
+func TestLegacyRoutesAreLimited(t *testing.T) {
+	api := newTestAPI(t)
+	w := api.do(t, request{method: http.MethodPost, url: "/api/v1/admin/api-keys", token: api.token,
+		body: map[string]interface{}{"name": "legacy", "owner": "tests", "rate_limit": 1}})
+	key, keyID := jsonField(t, w, "key").(string), jsonField(t, w, "api_key.id").(float64)
+	get := func(url string) *httptest.ResponseRecorder {
+		return api.do(t, request{method: http.MethodGet, url: url, header: map[string]string{"X-API-Key": key}})
+	}
+
+	if w := get("/routes"); w.Code != http.StatusOK {
+		t.Fatalf("first call: %d", w.Code)
+	}
+	if w := get("/routes/1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second call: %d, want 429", w.Code)
+	}
+	if w := get("/api/v1/public/routes"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("versioned call after the legacy ones: %d, want 429", w.Code)
+	}
+	w = api.do(t, request{method: http.MethodGet, url: fmt.Sprintf("/api/v1/admin/api-keys/%.0f/usage", keyID), token: api.token})
+	if count := jsonField(t, w, "usage").([]interface{})[0].(map[string]interface{})["count"]; count != 1.0 {
+		t.Errorf("usage count %v, want 1", count)
+	}
+}
@@ -0,0 +1,140 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// stopWords are dropped from queries ("Maryland bus stop" -> "maryland")
+// unless the query has nothing else
+var stopWords = map[string]bool{
+	"bus": true, "stop": true, "busstop": true, "station": true, "route": true,
+	"the": true, "at": true, "to": true, "from": true, "of": true,
+}
+
+// Tokens lowercases s, strips accents and splits it into words
+func Tokens(s string) []string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(s)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// combining accent
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+// queryTokens returns the tokens of a query without stop words
+func queryTokens(q string) []string {
+	all := Tokens(q)
+	var tokens []string
+	for _, t := range all {
+		if !stopWords[t] {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == 0 {
+		return all
+	}
+	return tokens
+}
+
+// maxTypos is the edit distance tolerated for a query word of n letters
+func maxTypos(n int) int {
+	switch {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// tokenScore rates how well query word q matches text word w (0 = no match)
+func tokenScore(q, w string) float64 {
+	if q == w {
+		return 1
+	}
+	if len(q) >= 2 && strings.HasPrefix(w, q) {
+		return 0.9
+	}
+	typos := maxTypos(len([]rune(q)))
+	if typos == 0 {
+		return 0
+	}
+	if d := editDistance(q, w); d <= typos {
+		return 0.8 - 0.2*float64(d)
+	}
+	// a misspelled prefix: compare with the start of w
+	if wr := []rune(w); len(wr) > len([]rune(q)) {
+		if d := editDistance(q, string(wr[:len([]rune(q))])); d <= typos {
+			return 0.7 - 0.2*float64(d)
+		}
+	}
+	return 0
+}
+
+// textScore rates text against the query tokens: the average of the best
+// match of each query word, or 0 when fewer than half of them match
+func textScore(tokens []string, text string) float64 {
+	words := Tokens(text)
+	if len(tokens) == 0 || len(words) == 0 {
+		return 0
+	}
+
+	total, matched := 0.0, 0
+	for _, q := range tokens {
+		best := 0.0
+		for _, w := range words {
+			if s := tokenScore(q, w); s > best {
+				best = s
+			}
+		}
+		if best > 0 {
+			matched++
+		}
+		total += best
+	}
+	if matched*2 < len(tokens) {
+		return 0
+	}
+
+	score := total / float64(len(tokens))
+	// whole query at the start of the text ranks first
+	if strings.HasPrefix(strings.Join(words, " "), strings.Join(tokens, " ")) {
+		score += 0.1
+	}
+	return score
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment) distance
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	d := make([][]int, len(ar)+1)
+	for i := range d {
+		d[i] = make([]int, len(br)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ar[i-1] == br[j-2] && ar[i-2] == br[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ar)][len(br)]
+}
@@ -0,0 +1,49 @@
+package search
+
+import "testing"
+
+func TestTokenScore(t *testing.T) {
+	tests := []struct {
+		q, w string
+		want float64
+	}{
+		{"maryland", "maryland", 1},
+		{"mary", "maryland", 0.9},     // prefix
+		{"marylnd", "maryland", 0.6},  // one letter missing
+		{"mrayland", "maryland", 0.6}, // transposition
+		{"ikja", "ikeja", 0.6},
+		{"ikeja", "ikejas", 0.9},
+		{"ojulegba", "ojuelegba", 0.6},
+		{"ojuelgeba", "ojuelegba", 0.6},
+		{"ojlgba", "ojuelegba", 0}, // 3 typos for 6 letters
+		{"yba", "yaba", 0},         // short words get no typo
+		{"yaab", "yabatech", 0.5},  // misspelled prefix
+		{"x", "xylophone", 0},      // single letters are not prefixes
+	}
+	for _, tt := range tests {
+		if got := tokenScore(tt.q, tt.w); got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("tokenScore(%q, %q) = %v, want %v", tt.q, tt.w, got, tt.want)
+		}
+	}
+}
+
+func TestTextScore(t *testing.T) {
+	tests := []struct {
+		query, text string
+		want        float64
+	}{
+		{"Yaba", "Yaba–Ikeja", 1.1},            // at the start
+		{"ikeja", "Yaba–Ikeja", 1},             // elsewhere
+		{"Maryland bus stop", "Maryland", 1.1}, // stop words dropped
+		{"yaba ikeja", "Yaba – Ikeja Express", 1.1},
+		{"yaba lekki", "Yaba–Ikeja", 0.5}, // half the words
+		{"yaba lekki ajah", "Yaba–Ikeja", 0},
+		{"Éko", "Eko Hotel", 1.1}, // accents ignored
+		{"stop", "Bus Stop", 1},   // only stop words: kept
+	}
+	for _, tt := range tests {
+		if got := textScore(queryTokens(tt.query), tt.text); got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("textScore(%q, %q) = %v, want %v", tt.query, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"busapp/models"
+	"busapp/spatial"
+	"busapp/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Search over route names, descriptions and stop names.
+//
+// On SQLite builds with FTS5 (go build -tags sqlite_fts5) an FTS5 table kept
+// in sync by triggers (created by a schema migration) finds prefix matches. When FTS5 is missing, on other
+// databases, or when the index finds nothing (usually a typo), the live
+// routes and stops are scanned instead, narrowed in SQL to the names that
+// contain a piece of a query word (see namePatterns) or have accents. Both paths rank with
+// the same fuzzy scorer, so results only differ in which candidates are
+// considered.
+
+// Result types
+const (
+	TypeRoute = "route"
+	TypeStop  = "stop"
+)
+
+// Result is one ranked match
+type Result struct {
+	Type        string   `json:"type"`
+	ID          uint     `json:"id"`
+	RouteID     uint     `json:"route_id"`
+	RouteName   string   `json:"route_name"`
+	AgencyID    *uint    `json:"agency_id,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+	DistanceKm  *float64 `json:"distance_km,omitempty"` // with Near; of the closest stop for routes
+	Score       float64  `json:"score"`
+}
+
+// Point is a caller location used to bias the ranking
+type Point struct {
+	Lat, Lon float64
+}
+
+// NearRadiusKm bounds the stops looked up to place routes near a caller:
+// routes without a stop that close rank as if far away and have no distance
+const NearRadiusKm = 10
+
+// nearStopLimit bounds the stops loaded within NearRadiusKm, closest first
+const nearStopLimit = 2000
+
+// Options narrow and shape a search
+type Options struct {
+	Limit    int    // default 20
+	Type     string // TypeRoute, TypeStop or "" for both
+	AgencyID uint   // 0 = all agencies
+	Near     *Point // nearby stops and routes rank higher
+}
+
+// ftsEnabled is set by Setup when the FTS5 index is in place
+var ftsEnabled bool
+
+// FTSEnabled reports whether searches use the FTS5 index
+func FTSEnabled() bool { return ftsEnabled }
+
+var ftsSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS search_fts USING fts5(entity UNINDEXED, entity_id UNINDEXED, name, description, tokenize = 'unicode61 remove_diacritics 2')`,
+
+	`CREATE TRIGGER IF NOT EXISTS search_routes_ai AFTER INSERT ON routes WHEN new.deleted_at IS NULL BEGIN
+		INSERT INTO search_fts(entity, entity_id, name, description) VALUES ('route', new.id, new.name, new.description);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS search_routes_au AFTER UPDATE ON routes BEGIN
+		DELETE FROM search_fts WHERE entity = 'route' AND entity_id = old.id;
+		INSERT INTO search_fts(entity, entity_id, name, description) SELECT 'route', new.id, new.name, new.description WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS search_routes_ad AFTER DELETE ON routes BEGIN
+		DELETE FROM search_fts WHERE entity = 'route' AND entity_id = old.id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS search_stops_ai AFTER INSERT ON stops WHEN new.deleted_at IS NULL BEGIN
+		INSERT INTO search_fts(entity, entity_id, name, description) VALUES ('stop', new.id, new.name, '');
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS search_stops_au AFTER UPDATE ON stops BEGIN
+		DELETE FROM search_fts WHERE entity = 'stop' AND entity_id = old.id;
+		INSERT INTO search_fts(entity, entity_id, name, description) SELECT 'stop', new.id, new.name, '' WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS search_stops_ad AFTER DELETE ON stops BEGIN
+		DELETE FROM search_fts WHERE entity = 'stop' AND entity_id = old.id;
+	END`,
+
+	// index the rows that exist already
+	`DELETE FROM search_fts`,
+	`INSERT INTO search_fts(entity, entity_id, name, description) SELECT 'route', id, name, description FROM routes WHERE deleted_at IS NULL`,
+	`INSERT INTO search_fts(entity, entity_id, name, description) SELECT 'stop', id, name, '' FROM stops WHERE deleted_at IS NULL`,
+}
+
+var ftsDrop = []string{
+	`DROP TRIGGER IF EXISTS search_routes_ai`,
+	`DROP TRIGGER IF EXISTS search_routes_au`,
+	`DROP TRIGGER IF EXISTS search_routes_ad`,
+	`DROP TRIGGER IF EXISTS search_stops_ai`,
+	`DROP TRIGGER IF EXISTS search_stops_au`,
+	`DROP TRIGGER IF EXISTS search_stops_ad`,
+	`DROP TABLE IF EXISTS search_fts`,
+}
+
+// hasFTS5 reports whether the database is SQLite built with FTS5
+func hasFTS5(db *gorm.DB) bool {
+	if db.Dialector.Name() != "sqlite" {
+		return false
+	}
+	var n int
+	err := db.Raw("SELECT COUNT(*) FROM pragma_compile_options WHERE compile_options = 'ENABLE_FTS5'").Scan(&n).Error
+	return err == nil && n > 0
+}
+
+// CreateIndex creates the FTS5 index and its triggers when the database
+// supports it (a schema migration). Without FTS5 searches fall back to
+// scanning, so a missing module is not an error.
+func CreateIndex(db *gorm.DB) error {
+	if !hasFTS5(db) {
+		return nil
+	}
+	for _, stmt := range ftsSchema {
+		if err := db.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// DropIndex removes what CreateIndex created
+func DropIndex(db *gorm.DB) error {
+	if db.Dialector.Name() != "sqlite" {
+		return nil
+	}
+	for _, stmt := range ftsDrop {
+		if err := db.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// Setup turns the FTS5 index on when the schema has it and this build can
+// read it
+func Setup(db *gorm.DB) error {
+	ftsEnabled = false
+	if !hasFTS5(db) {
+		return nil
+	}
+	var n int
+	if err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'search_fts'").Scan(&n).Error; err != nil {
+		return err
+	}
+	ftsEnabled = n > 0
+	return nil
+}
+
+// Search finds routes and stops matching q, best first
+func Search(db *gorm.DB, q string, opts Options) ([]Result, error) {
+	tokens := queryTokens(q)
+	if len(tokens) == 0 {
+		return []Result{}, nil
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 20
+	}
+
+	var routeIDs, stopIDs []uint
+	filtered := false
+	if ftsEnabled {
+		var err error
+		routeIDs, stopIDs, err = ftsCandidates(db, tokens)
+		if err != nil {
+			return nil, err
+		}
+		filtered = len(routeIDs)+len(stopIDs) > 0
+	}
+
+	routes, stops, err := loadCandidates(db, opts, tokens, filtered, routeIDs, stopIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	nearest := map[uint]float64{} // route ID -> distance of its closest stop
+	if opts.Near != nil {
+		near, err := spatial.Nearby(db, spatial.Point{Lat: opts.Near.Lat, Lon: opts.Near.Lon}, NearRadiusKm,
+			spatial.Options{AgencyID: opts.AgencyID, Limit: nearStopLimit})
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range near { // closest first
+			if _, ok := nearest[s.RouteID]; !ok {
+				nearest[s.RouteID] = *s.DistanceKm
+			}
+		}
+	}
+
+	byID := map[uint]models.Route{}
+	for _, r := range routes {
+		byID[r.ID] = r
+		if opts.Type == TypeStop || (filtered && !contains(routeIDs, r.ID)) {
+			continue
+		}
+		score := max(textScore(tokens, r.Name), 0.5*textScore(tokens, r.Description))
+		if score == 0 {
+			continue
+		}
+		res := Result{Type: TypeRoute, ID: r.ID, RouteID: r.ID, RouteName: r.Name, AgencyID: r.AgencyID,
+			Name: r.Name, Description: r.Description, Score: score}
+		if d, ok := nearest[r.ID]; ok {
+			res.DistanceKm = &d
+		} else if opts.Near != nil {
+			res.Score *= 0.5 // no stop nearby: as far as it gets
+		}
+		results = append(results, res)
+	}
+
+	if opts.Type != TypeRoute {
+		for _, s := range stops {
+			route, ok := byID[s.RouteID]
+			if !ok {
+				continue
+			}
+			score := textScore(tokens, s.Name)
+			if score == 0 {
+				continue
+			}
+			s := s
+			res := Result{Type: TypeStop, ID: s.ID, RouteID: s.RouteID, RouteName: route.Name, AgencyID: route.AgencyID,
+				Name: s.Name, Latitude: &s.Latitude, Longitude: &s.Longitude, Score: score}
+			if opts.Near != nil {
+				d := utils.Haversine(opts.Near.Lat, opts.Near.Lon, s.Latitude, s.Longitude)
+				res.DistanceKm = &d
+			}
+			results = append(results, res)
+		}
+	}
+
+	for i := range results {
+		if d := results[i].DistanceKm; d != nil {
+			// halve the score of matches about 2 km away, less for closer ones
+			results[i].Score *= 0.5 + 0.5/(1+*d/2)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	if len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	return results, nil
+}
+
+// ftsCandidates returns routes and stops with a word starting with a query token
+func ftsCandidates(db *gorm.DB, tokens []string) (routeIDs, stopIDs []uint, err error) {
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = `"` + t + `"*`
+	}
+
+	var hits []struct {
+		Entity   string
+		EntityID uint
+	}
+	err = db.Raw("SELECT entity, entity_id FROM search_fts WHERE search_fts MATCH ? ORDER BY rank LIMIT 500",
+		strings.Join(terms, " OR ")).Scan(&hits).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, h := range hits {
+		if h.Entity == TypeRoute {
+			routeIDs = append(routeIDs, h.EntityID)
+		} else {
+			stopIDs = append(stopIDs, h.EntityID)
+		}
+	}
+	return routeIDs, stopIDs, nil
+}
+
+// loadCandidates loads the live routes and stops of opts.AgencyID to score.
+// With filtered only the given stops are loaded, plus every route involved;
+// otherwise the names that may match tokens, plus the routes of their stops.
+func loadCandidates(db *gorm.DB, opts Options, tokens []string, filtered bool, routeIDs, stopIDs []uint) ([]models.Route, []models.Stop, error) {
+	var patterns []string
+	if !filtered {
+		patterns = namePatterns(tokens)
+	}
+
+	var stops []models.Stop
+	if opts.Type != TypeRoute && (!filtered || len(stopIDs) > 0) {
+		q := db.Model(&models.Stop{}).Select("stops.*").
+			Joins("JOIN routes ON routes.id = stops.route_id AND routes.deleted_at IS NULL")
+		if opts.AgencyID != 0 {
+			q = q.Where("routes.agency_id = ?", opts.AgencyID)
+		}
+		if filtered {
+			q = q.Where("stops.id IN ?", stopIDs)
+		} else if patterns != nil {
+			q = q.Where(nameCondition(db, patterns, "stops.name"))
+		}
+		if err := q.Find(&stops).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	stopRoutes := make([]uint, len(stops))
+	for i, s := range stops {
+		stopRoutes[i] = s.RouteID
+	}
+
+	q := db.Model(&models.Route{})
+	if opts.AgencyID != 0 {
+		q = q.Where("agency_id = ?", opts.AgencyID)
+	}
+	switch {
+	case filtered:
+		q = q.Where("id IN ?", append(append([]uint{}, routeIDs...), stopRoutes...))
+	case patterns != nil && len(stopRoutes) > 0:
+		q = q.Where(clause.Or(nameCondition(db, patterns, "name", "description"), clause.Expr{SQL: "id IN ?", Vars: []interface{}{stopRoutes}}))
+	case patterns != nil:
+		q = q.Where(nameCondition(db, patterns, "name", "description"))
+	}
+	var routes []models.Route
+	if err := q.Find(&routes).Error; err != nil {
+		return nil, nil, err
+	}
+	return routes, stops, nil
+}
+
+// likeEscaper escapes the LIKE wildcards, for patterns with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// namePatterns returns lowercase LIKE patterns, one of which is in every
+// text that textScore can match with tokens: each word is cut into twice
+// as many pieces as the typos it tolerates, plus one, so that one piece
+// is left intact (a transposition can break two)
+func namePatterns(tokens []string) []string {
+	var patterns []string
+	for _, t := range tokens {
+		word := []rune(t)
+		n := min(2*maxTypos(len(word))+1, len(word))
+		for i := 0; i < n; i++ {
+			piece := string(word[i*len(word)/n : (i+1)*len(word)/n])
+			patterns = append(patterns, "%"+likeEscaper.Replace(piece)+"%")
+		}
+	}
+	return patterns
+}
+
+// nameCondition is the condition that one of columns contains one of
+// patterns or has letters beyond ASCII, which are always scored: LIKE does
+// not see through accents ("Châtelet" for "chat")
+func nameCondition(db *gorm.DB, patterns []string, columns ...string) clause.Expression {
+	var exprs []clause.Expression
+	for _, col := range columns {
+		for _, p := range patterns {
+			exprs = append(exprs, clause.Expr{SQL: "LOWER(" + col + `) LIKE ? ESCAPE '\'`, Vars: []interface{}{p}})
+		}
+		if db.Dialector.Name() == "postgres" {
+			exprs = append(exprs, clause.Expr{SQL: col + " ~ '[^[:ascii:]]'"})
+		} else {
+			exprs = append(exprs, clause.Expr{SQL: col + " GLOB ?", Vars: []interface{}{"*[^\x01-\x7f]*"}})
+		}
+	}
+	return clause.Or(exprs...)
+}
+
+func contains(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
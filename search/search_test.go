@@ -0,0 +1,156 @@
+package search
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"busapp/db"
+	"busapp/models"
+
+	"gorm.io/gorm"
+)
+
+// newSearchDB returns a SQLite database with routes in Lagos, one in Paris
+// and a deleted one
+func newSearchDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	gdb, err := db.InitDB(filepath.Join(t.TempDir(), "search.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlDB, err := gdb.DB(); err == nil {
+		t.Cleanup(func() { sqlDB.Close() })
+	}
+	if err := gdb.AutoMigrate(&models.Agency{}, &models.Route{}, &models.Stop{}, &models.Schedule{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateIndex(gdb); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(gdb); err != nil {
+		t.Fatal(err)
+	}
+
+	lagos, paris := models.Agency{Name: "Lagos"}, models.Agency{Name: "Paris"}
+	if err := gdb.Create([]*models.Agency{&lagos, &paris}).Error; err != nil {
+		t.Fatal(err)
+	}
+	routes := []models.Route{
+		{Name: "Yaba–Ikeja", Description: "via Maryland", AgencyID: &lagos.ID, Stops: []models.Stop{
+			{Name: "Yaba", Latitude: 6.5086, Longitude: 3.3747, OrderIndex: 1},
+			{Name: "Maryland", Latitude: 6.5480, Longitude: 3.3632, OrderIndex: 2},
+			{Name: "Ikeja", Latitude: 6.6014, Longitude: 3.3515, OrderIndex: 3},
+		}},
+		{Name: "Central Line", AgencyID: &lagos.ID, Stops: []models.Stop{
+			{Name: "Marina", Latitude: 6.4500, Longitude: 3.3900, OrderIndex: 1},
+		}},
+		{Name: "Central Avenue", AgencyID: &paris.ID, Stops: []models.Stop{
+			{Name: "Châtelet", Latitude: 48.8584, Longitude: 2.3470, OrderIndex: 1},
+		}},
+		{Name: "Closed Central", AgencyID: &lagos.ID},
+	}
+	if err := gdb.Create(&routes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Delete(&routes[3]).Error; err != nil {
+		t.Fatal(err)
+	}
+	return gdb
+}
+
+func TestSearch(t *testing.T) {
+	gdb := newSearchDB(t)
+	yaba := &Point{Lat: 6.5086, Lon: 3.3747}
+
+	tests := []struct {
+		name  string
+		q     string
+		opts  Options
+		want  []string // names, best first
+		check func(t *testing.T, results []Result)
+	}{
+		{name: "stop name", q: "Maryland", want: []string{"Maryland", "Yaba–Ikeja"}}, // the route by its description
+		{name: "typo", q: "Marylnd", want: []string{"Maryland", "Yaba–Ikeja"}},
+		{name: "accent", q: "chatelet", want: []string{"Châtelet"}},
+		{name: "prefix", q: "ike", want: []string{"Ikeja", "Yaba–Ikeja"}},
+		{name: "stop words", q: "Ikeja bus stop", want: []string{"Ikeja", "Yaba–Ikeja"}},
+		{name: "no match", q: "Lekki", want: []string{}},
+		{name: "routes only", q: "Maryland", opts: Options{Type: TypeRoute}, want: []string{"Yaba–Ikeja"}},
+		{name: "by name without a location", q: "central", want: []string{"Central Avenue", "Central Line"}},
+		{name: "near ranks first", q: "central", opts: Options{Near: yaba}, want: []string{"Central Line", "Central Avenue"},
+			check: func(t *testing.T, results []Result) {
+				if d := results[0].DistanceKm; d == nil {
+					t.Error("Central Line has no distance")
+				} else if *d < 6.5 || *d > 7 {
+					t.Errorf("Central Line is %.1f km away, want about 6.7", *d)
+				}
+				if d := results[1].DistanceKm; d != nil {
+					t.Errorf("Central Avenue has a distance (%v km) beyond NearRadiusKm", *d)
+				}
+			}},
+		{name: "agency", q: "central", opts: Options{AgencyID: 2}, want: []string{"Central Avenue"}},
+		{name: "limit", q: "central", opts: Options{Limit: 1}, want: []string{"Central Avenue"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := Search(gdb, tt.q, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(results))
+			for i, r := range results {
+				got[i] = r.Name
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %q, want %q", got, tt.want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, results)
+			}
+		})
+	}
+}
+
+func TestScanLoadsOnlyLikelyCandidates(t *testing.T) {
+	gdb := newSearchDB(t)
+	names := func(routes []models.Route, stops []models.Stop) []string {
+		var got []string
+		for _, r := range routes {
+			got = append(got, r.Name)
+		}
+		for _, s := range stops {
+			got = append(got, s.Name)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name string
+		q    string
+		opts Options
+		want []string // routes, then stops; names beyond ASCII ("Yaba–Ikeja" by its dash) are always loaded
+	}{
+		{name: "by name", q: "ike", want: []string{"Yaba–Ikeja", "Central Avenue", "Ikeja", "Châtelet"}},
+		{name: "routes of the stops", q: "mar", want: []string{"Yaba–Ikeja", "Central Line", "Central Avenue", "Maryland", "Marina", "Châtelet"}},
+		{name: "accents are always scored", q: "cha", want: []string{"Yaba–Ikeja", "Central Avenue", "Châtelet"}},
+		{name: "agency", q: "central", opts: Options{AgencyID: 2}, want: []string{"Central Avenue", "Châtelet"}},
+		{name: "stops of the agency", q: "cha", opts: Options{AgencyID: 1}, want: []string{"Yaba–Ikeja"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, stops, err := loadCandidates(gdb, tt.opts, queryTokens(tt.q), false, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(routes, stops); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("loaded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,19 +1,16 @@
 package seed
 
 import (
+	"fmt"
+
 	"busapp/handlers"
 	"busapp/models"
 
 	"gorm.io/gorm"
 )
 
-// MigrateAndSeed runs migrations and inserts sample data if empty
-func MigrateAndSeed(db *gorm.DB) error {
-	// Migrate
-	if err := db.AutoMigrate(&models.Admin{}, &models.Route{}, &models.Stop{}, &models.Schedule{}); err != nil {
-		return err
-	}
-
+// Seed inserts sample data into an empty, migrated database
+func Seed(db *gorm.DB) error {
 	// Seed only if routes table empty
 	var count int64
 	if err := db.Model(&models.Route{}).Count(&count).Error; err != nil {
@@ -24,13 +21,24 @@ func MigrateAndSeed(db *gorm.DB) error {
 	}
 
 	var adminCount int64
-	db.Model(&models.Admin{}).Count(&adminCount)
+	if err := db.Model(&models.Admin{}).Count(&adminCount).Error; err != nil {
+		return err
+	}
 	if adminCount == 0 {
-		db.Create(&models.Admin{Username: "admin", Password: handlers.HashPassword("admin123")})
+		if err := db.Create(&models.Admin{Username: "admin", Password: handlers.HashPassword("admin123")}).Error; err != nil {
+			return fmt.Errorf("create admin: %w", err)
+		}
+	}
+
+	// Example agency owning the sample route
+	agency := models.Agency{Name: "Lagos Bus Services", URL: "https://example.com", Timezone: "Africa/Lagos"}
+	if err := db.FirstOrCreate(&agency, models.Agency{Name: agency.Name}).Error; err != nil {
+		return err
 	}
 
 	// Example route: "Yaba–Ikeja"
 	route := models.Route{
+		AgencyID:    &agency.ID,
 		Name:        "Yaba–Ikeja",
 		Description: "Sample route via Ojuelegba and Maryland",
 		Stops: []models.Stop{
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"busapp/config"
+)
+
+// HTTP server lifecycle: timeouts and optional TLS from the config, and a
+// graceful shutdown that lets in-flight requests and background jobs finish.
+
+// newServer returns the server for handler, with HTTPS when the config has a
+// certificate
+func newServer(cfg *config.Config, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.TLSCertFile != "" {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+	return srv, nil
+}
+
+// serve runs srv on ln until ctx is done, then shuts it down: listeners close
+// at once and in-flight requests get up to timeout to complete before their
+// connections are closed
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, waiting for in-flight requests", "timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("requests still running after %s: %w", timeout, err)
+	}
+	return nil
+}
+
+// workers runs periodic background jobs until its context is done
+type workers struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	mu    sync.Mutex
+	beats map[string]*heartbeat
+}
+
+// heartbeat tracks that a job keeps running on time
+type heartbeat struct {
+	interval time.Duration
+	last     time.Time // end of the last run, or the start of the job
+}
+
+func newWorkers(ctx context.Context) *workers {
+	return &workers{ctx: ctx, beats: map[string]*heartbeat{}}
+}
+
+// every runs job each interval, logging its errors
+func (w *workers) every(name string, interval time.Duration, job func() error) {
+	beat := &heartbeat{interval: interval, last: time.Now()}
+	w.mu.Lock()
+	w.beats[name] = beat
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := job(); err != nil {
+					slog.Error("background job failed", "job", name, "err", err)
+				}
+				w.mu.Lock()
+				beat.last = time.Now()
+				w.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// check is the readiness check of the jobs: it fails when one has not
+// finished a run for two of its intervals (stuck on a lock, say)
+func (w *workers) check(context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var stalled []string
+	for name, beat := range w.beats {
+		if time.Since(beat.last) > 2*beat.interval {
+			stalled = append(stalled, name)
+		}
+	}
+	if len(stalled) > 0 {
+		sort.Strings(stalled)
+		return fmt.Errorf("stalled: %s", strings.Join(stalled, ", "))
+	}
+	return nil
+}
+
+// wait blocks until the jobs running when the context ended have finished,
+// or ctx is done
+func (w *workers) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("background jobs still running")
+	}
+}
+
+// certReloader serves a TLS certificate from files and reloads it when they
+// change, so a renewed certificate is used without restarting
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // of the files when cert was loaded
+	failed  time.Time // of files that did not load, not retried until they change
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified is the latest modification time of the two files
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate is the tls.Config hook. While the files are being replaced
+// (or are invalid) it keeps serving the certificate loaded last.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if modTime, err := r.modified(); err == nil && !modTime.Equal(r.modTime) && !modTime.Equal(r.failed) {
+		if err := r.load(); err != nil {
+			r.failed = modTime
+			slog.Error("keeping the current TLS certificate", "err", err)
+		} else {
+			slog.Info("reloaded the TLS certificate", "file", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
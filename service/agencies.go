@@ -0,0 +1,105 @@
+package service
+
+import (
+	"time"
+
+	"busapp/models"
+	"busapp/repository"
+)
+
+// AgencyService manages agencies. It is platform-wide: callers only let
+// platform admins use it.
+type AgencyService interface {
+	// Create creates an agency
+	Create(ch Change, agency models.Agency) (models.Agency, error)
+	// Update applies changes to an agency
+	Update(ch Change, id uint, apply func(*models.Agency)) (models.Agency, error)
+}
+
+// NewAgencyService returns the AgencyService working on store
+func NewAgencyService(store repository.Store) AgencyService {
+	return &agencyService{store: store}
+}
+
+type agencyService struct {
+	store repository.Store
+}
+
+func (s *agencyService) Create(ch Change, agency models.Agency) (models.Agency, error) {
+	err := s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.Agencies().Create(&agency); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditCreate, EntityAgency, agency.ID, nil, agency)
+	})
+	return agency, err
+}
+
+func (s *agencyService) Update(ch Change, id uint, apply func(*models.Agency)) (models.Agency, error) {
+	agency, err := s.store.Agencies().Get(id)
+	if err != nil {
+		return agency, lookupError(err, "agency")
+	}
+	before := agency
+
+	apply(&agency)
+
+	err = s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.Agencies().Save(&agency); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditUpdate, EntityAgency, agency.ID, before, agency)
+	})
+	return agency, err
+}
+
+// APIKeyService manages the keys of the public API, platform-wide like
+// AgencyService. Keys are generated and hashed by the caller; only the hash
+// is stored, and it is left out of the audit log.
+type APIKeyService interface {
+	// Create stores a key
+	Create(ch Change, key models.APIKey) (models.APIKey, error)
+	// Revoke revokes a key, keeping its usage history; revoking it again
+	// changes nothing
+	Revoke(ch Change, id uint) (models.APIKey, error)
+}
+
+// NewAPIKeyService returns the APIKeyService working on store
+func NewAPIKeyService(store repository.Store) APIKeyService {
+	return &apiKeyService{store: store}
+}
+
+type apiKeyService struct {
+	store repository.Store
+}
+
+func (s *apiKeyService) Create(ch Change, key models.APIKey) (models.APIKey, error) {
+	err := s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.APIKeys().Create(&key); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditCreate, EntityAPIKey, key.ID, nil, key)
+	})
+	return key, err
+}
+
+func (s *apiKeyService) Revoke(ch Change, id uint) (models.APIKey, error) {
+	key, err := s.store.APIKeys().Get(id)
+	if err != nil {
+		return key, lookupError(err, "api key")
+	}
+	if key.RevokedAt != nil {
+		return key, nil
+	}
+	before := key
+
+	now := time.Now()
+	key.RevokedAt = &now
+	err = s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.APIKeys().Save(&key); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditUpdate, EntityAPIKey, key.ID, before, key)
+	})
+	return key, err
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"busapp/models"
+	"busapp/repository"
+)
+
+// AlertService manages the alerts of routes and agencies. Alerts are not
+// part of the validated network, so their writes are only audited.
+type AlertService interface {
+	// Create adds an alert to a route of the actor's agency, or to the
+	// agency (to alert.AgencyID, the whole network when nil, for platform
+	// actors)
+	Create(ch Change, alert models.Alert) (models.Alert, error)
+	// Update applies changes to an alert
+	Update(ch Change, id uint, apply func(*models.Alert)) (models.Alert, error)
+	// Delete removes an alert
+	Delete(ch Change, id uint) error
+}
+
+// NewAlertService returns the AlertService working on store
+func NewAlertService(store repository.Store) AlertService {
+	return &alertService{store: store}
+}
+
+type alertService struct {
+	store repository.Store
+}
+
+func (s *alertService) Create(ch Change, alert models.Alert) (models.Alert, error) {
+	if id := ch.Actor.AgencyID; id != 0 {
+		alert.AgencyID = &id
+	}
+	if alert.Severity == "" {
+		alert.Severity = models.AlertInfo
+	}
+	if alert.RouteID != nil {
+		route, err := s.store.Routes().Get(ch.Actor.AgencyID, *alert.RouteID)
+		if err != nil {
+			return alert, lookupError(err, "route")
+		}
+		alert.AgencyID = route.AgencyID
+	}
+	if err := checkAlertWindow(alert); err != nil {
+		return alert, err
+	}
+
+	err := s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.Alerts().Create(&alert); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditCreate, EntityAlert, alert.ID, nil, alert)
+	})
+	return alert, err
+}
+
+func (s *alertService) Update(ch Change, id uint, apply func(*models.Alert)) (models.Alert, error) {
+	alert, err := s.store.Alerts().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return alert, lookupError(err, "alert")
+	}
+	before := alert
+
+	apply(&alert)
+	if err := checkAlertWindow(alert); err != nil {
+		return alert, err
+	}
+
+	err = s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.Alerts().Save(&alert); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditUpdate, EntityAlert, alert.ID, before, alert)
+	})
+	return alert, err
+}
+
+func (s *alertService) Delete(ch Change, id uint) error {
+	alert, err := s.store.Alerts().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return lookupError(err, "alert")
+	}
+	return s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.Alerts().Delete(alert.ID); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditDelete, EntityAlert, alert.ID, alert, nil)
+	})
+}
+
+// checkAlertWindow rejects alerts ending before they start
+func checkAlertWindow(alert models.Alert) error {
+	if alert.StartsAt != nil && alert.EndsAt != nil && !alert.EndsAt.After(*alert.StartsAt) {
+		return Invalid("ends_at must be after starts_at")
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/validation"
+
+	"gorm.io/gorm"
+)
+
+// Audited entities besides those of the validation package
+const (
+	EntityAlert  = "alert"
+	EntityAgency = "agency"
+	EntityAPIKey = "api_key"
+)
+
+// FieldChange is one changed field in an audit diff
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// snapshot turns a model into a JSON object for the audit log. Route IDs are
+// hidden from the public JSON of stops and schedules, so they are added back
+// here to make reverts possible.
+func snapshot(v interface{}) json.RawMessage {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return json.RawMessage("null")
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+
+	var routeID uint
+	switch m := reflect.Indirect(reflect.ValueOf(v)).Interface().(type) {
+	case models.Stop:
+		routeID = m.RouteID
+	case models.Schedule:
+		routeID = m.RouteID
+	default:
+		return raw
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw
+	}
+	fields["route_id"] = routeID
+	raw, _ = json.Marshal(fields)
+	return raw
+}
+
+// unmarshalSnapshot decodes a snapshot, restoring the hidden route IDs
+func unmarshalSnapshot(raw json.RawMessage, target interface{}) error {
+	if err := json.Unmarshal(raw, target); err != nil {
+		return err
+	}
+	var ref struct {
+		RouteID uint `json:"route_id"`
+	}
+	_ = json.Unmarshal(raw, &ref)
+
+	switch m := target.(type) {
+	case *models.Stop:
+		m.RouteID = ref.RouteID
+	case *models.Schedule:
+		m.RouteID = ref.RouteID
+	}
+	return nil
+}
+
+// diffSnapshots returns {"field": {"from": x, "to": y}} for changed top-level fields
+func diffSnapshots(before, after json.RawMessage) json.RawMessage {
+	var b, a map[string]interface{}
+	_ = json.Unmarshal(before, &b)
+	_ = json.Unmarshal(after, &a)
+
+	diff := map[string]FieldChange{}
+	for k, v := range b {
+		if !reflect.DeepEqual(v, a[k]) {
+			diff[k] = FieldChange{From: v, To: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			diff[k] = FieldChange{To: v}
+		}
+	}
+	raw, _ := json.Marshal(diff)
+	return raw
+}
+
+// RecordAudit stores an audit entry for a change made by actor.
+// before/after are the entity before and after the change (nil when absent).
+// store is the transaction of the change, so the change does not stand
+// without its entry.
+func RecordAudit(store repository.Store, actor Actor, action, entity string, entityID uint, before, after interface{}) error {
+	b, a := snapshot(before), snapshot(after)
+	err := store.Audit().Add(&models.AuditEntry{
+		AgencyID:  actor.AgencyID,
+		ActorID:   actor.ID,
+		ActorName: actor.Name,
+		Action:    action,
+		Entity:    entity,
+		EntityID:  entityID,
+		Before:    b,
+		After:     a,
+		Diff:      diffSnapshots(b, a),
+		IP:        actor.IP,
+	})
+	if err != nil {
+		return fmt.Errorf("record audit entry: %w", err)
+	}
+	return nil
+}
+
+// AuditService undoes audited changes
+type AuditService interface {
+	// Revert puts a route, stop or schedule back in the state it had before
+	// an entry of the actor's agency, and returns it. Reverting a create
+	// deletes the entity (and returns nil); reverting a delete recreates it,
+	// a route with its stops and schedules.
+	Revert(ch Change, entryID uint) (interface{}, error)
+}
+
+// NewAuditService returns the AuditService working on store
+func NewAuditService(store repository.Store) AuditService {
+	return &auditService{store: store}
+}
+
+type auditService struct {
+	store repository.Store
+}
+
+func (s *auditService) Revert(ch Change, entryID uint) (interface{}, error) {
+	agencyID := ch.Actor.AgencyID
+	entry, err := s.store.Audit().Get(agencyID, entryID)
+	if err != nil {
+		return nil, lookupError(err, "audit entry")
+	}
+
+	current, err := getEntity(s.store, agencyID, entry.Entity, entry.EntityID)
+	exists := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !exists {
+		current = nil
+	}
+
+	if string(entry.Before) == "null" {
+		// the entry created the entity: revert by deleting it
+		if !exists {
+			return nil, nil
+		}
+		routeID := routeOf(current)
+		return nil, checkedWrite(s.store, ch, IssuesFor(validation.EntityRoute, &routeID), func(tx repository.Store) (uint, error) {
+			if err := deleteEntity(tx, entry.Entity, entry.EntityID); err != nil {
+				return 0, err
+			}
+			return routeID, RecordAudit(tx, ch.Actor, models.AuditRevert, entry.Entity, entry.EntityID, current, nil)
+		})
+	}
+
+	target := newEntity(entry.Entity)
+	if err := unmarshalSnapshot(entry.Before, target); err != nil {
+		return nil, fmt.Errorf("invalid audit snapshot: %w", err)
+	}
+	match := IssuesFor(entry.Entity, &entry.EntityID)
+	if entry.Entity == validation.EntityRoute {
+		match = IssuesOfRoute(&entry.EntityID)
+	}
+	err = checkedWrite(s.store, ch, match, func(tx repository.Store) (uint, error) {
+		if err := revertTo(tx, agencyID, entry, exists, target); err != nil {
+			return 0, err
+		}
+		return routeOf(target), RecordAudit(tx, ch.Actor, models.AuditRevert, entry.Entity, entry.EntityID, current, target)
+	})
+	return target, trashError(err, entry.Entity)
+}
+
+// revertTo writes target, the state of the entity before entry, in tx
+func revertTo(tx repository.Store, agencyID uint, entry models.AuditEntry, exists bool, target interface{}) error {
+	if exists {
+		return saveEntity(tx, target, false)
+	}
+	// a deleted entity may still be in the trash: bring that row back
+	err := restoreEntity(tx, agencyID, entry.Entity, entry.EntityID)
+	switch {
+	case err == nil:
+		return saveEntity(tx, target, false)
+	case errors.Is(err, repository.ErrNotInTrash):
+		return saveEntity(tx, target, true)
+	default:
+		return err
+	}
+}
+
+// The revertable entities (routes, stops and schedules) are handled as
+// pointers to their models by the helpers below
+
+func newEntity(entity string) interface{} {
+	switch entity {
+	case validation.EntityRoute:
+		return &models.Route{}
+	case validation.EntityStop:
+		return &models.Stop{}
+	}
+	return &models.Schedule{}
+}
+
+// getEntity returns a live entity of the agency
+func getEntity(store repository.Store, agencyID uint, entity string, id uint) (interface{}, error) {
+	switch entity {
+	case validation.EntityRoute:
+		route, err := store.Routes().Get(agencyID, id)
+		return &route, err
+	case validation.EntityStop:
+		stop, err := store.Stops().Get(agencyID, id)
+		return &stop, err
+	case validation.EntitySchedule:
+		sch, err := store.Schedules().Get(agencyID, id)
+		return &sch, err
+	}
+	return nil, Invalid("entity cannot be reverted")
+}
+
+// deleteEntity moves an entity to the trash, a route with its stops and schedules
+func deleteEntity(tx repository.Store, entity string, id uint) error {
+	switch entity {
+	case validation.EntityRoute:
+		return tx.Routes().Trash(id)
+	case validation.EntityStop:
+		return tx.Stops().Delete(id)
+	}
+	return tx.Schedules().Delete(id)
+}
+
+// restoreEntity brings an entity of the agency back from the trash
+func restoreEntity(tx repository.Store, agencyID uint, entity string, id uint) error {
+	var err error
+	switch entity {
+	case validation.EntityRoute:
+		_, err = tx.Routes().Restore(agencyID, id)
+	case validation.EntityStop:
+		_, err = tx.Stops().Restore(agencyID, id)
+	default:
+		_, err = tx.Schedules().Restore(agencyID, id)
+	}
+	return err
+}
+
+// saveEntity updates an entity, or creates it (a route with its stops and
+// schedules) when create is set
+func saveEntity(tx repository.Store, m interface{}, create bool) error {
+	switch m := m.(type) {
+	case *models.Route:
+		if create {
+			return tx.Routes().Create(m)
+		}
+		return tx.Routes().Save(m)
+	case *models.Stop:
+		if create {
+			return tx.Stops().Create(m)
+		}
+		return tx.Stops().Save(m)
+	case *models.Schedule:
+		if create {
+			return tx.Schedules().Create(m)
+		}
+		return tx.Schedules().Save(m)
+	}
+	return fmt.Errorf("cannot save %T", m)
+}
+
+// routeOf is the route of a route, stop or schedule
+func routeOf(m interface{}) uint {
+	switch m := m.(type) {
+	case *models.Route:
+		return m.ID
+	case *models.Stop:
+		return m.RouteID
+	case *models.Schedule:
+		return m.RouteID
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"busapp/config"
+	"busapp/metrics"
+	"busapp/models"
+	"busapp/repository"
+	"busapp/utils"
+	"busapp/validation"
+)
+
+// Arrival estimates: buses leave at the departures of a schedule and travel
+// between consecutive stops in a straight line at the configured average
+// speed. Times are in the timezone of the route's agency.
+
+var (
+	// ErrNoSchedules is returned for a route without schedules
+	ErrNoSchedules = errors.New("no schedules for this route")
+	// ErrInvalidSchedule is returned when a departure cannot be parsed
+	ErrInvalidSchedule = errors.New("invalid schedule format")
+)
+
+// Clock returns the current time; tests inject a fixed one
+type Clock func() time.Time
+
+// Trip is one departure with its estimated arrival at each stop
+type Trip struct {
+	Departure time.Time
+	Arrivals  []time.Time // one per stop of the route, in order
+}
+
+// NextBuses are the upcoming buses of a route
+type NextBuses struct {
+	Route    models.Route
+	Schedule models.Schedule // the schedule the buses run on
+	Now      time.Time       // in the agency's timezone
+	Next     time.Time       // first departure at or after Now
+	Trips    []Trip
+}
+
+// ETAService estimates arrivals
+type ETAService interface {
+	// NextBuses returns count buses of a route, estimated at the current time
+	NextBuses(routeID uint, count int) (NextBuses, error)
+}
+
+// NewETAService returns the ETAService reading routes from store, with now
+// as its clock
+func NewETAService(store repository.Store, now Clock) ETAService {
+	return &etaService{routes: NewRouteService(store), now: now}
+}
+
+type etaService struct {
+	routes RouteService
+	now    Clock
+}
+
+func (s *etaService) NextBuses(routeID uint, count int) (NextBuses, error) {
+	route, err := s.routes.Get(routeID)
+	if err != nil {
+		return NextBuses{}, err
+	}
+	now := s.now().In(AgencyLocation(route.Agency))
+	return PlanNextBuses(route, now, config.Get().AverageSpeedKmH, count)
+}
+
+// PlanNextBuses computes the buses of a route at now, which must be in the
+// agency's timezone. For simplicity it uses the first schedule of the route;
+// the trips are its first count departures of now's day.
+func PlanNextBuses(route models.Route, now time.Time, speedKmH float64, count int) (NextBuses, error) {
+	defer metrics.Since(metrics.ETAComputations, time.Now())
+	if len(route.Schedules) == 0 {
+		return NextBuses{}, ErrNoSchedules
+	}
+	schedule := route.Schedules[0]
+
+	first, next, err := Departures(schedule, now)
+	if err != nil {
+		return NextBuses{}, err
+	}
+
+	plan := NextBuses{Route: route, Schedule: schedule, Now: now, Next: next, Trips: []Trip{}}
+	for i := 0; i < count; i++ {
+		departure := first.Add(time.Duration(i*schedule.FrequencyMin) * time.Minute)
+		plan.Trips = append(plan.Trips, Trip{
+			Departure: departure,
+			Arrivals:  StopArrivals(route.Stops, departure, speedKmH),
+		})
+	}
+	return plan, nil
+}
+
+// Departures returns the first departure of a schedule on now's day and the
+// next one at or after now. Buses run every FrequencyMin minutes (once when
+// 0) from the first departure until midnight.
+func Departures(schedule models.Schedule, now time.Time) (first, next time.Time, err error) {
+	dep, err := time.Parse(validation.DepartureLayout, schedule.Departure)
+	if err != nil {
+		return first, next, fmt.Errorf("%w: departure %q", ErrInvalidSchedule, schedule.Departure)
+	}
+
+	first = departureOn(now, dep)
+
+	next = first
+	if schedule.FrequencyMin <= 0 {
+		if next.Before(now) {
+			next = departureOn(now.AddDate(0, 0, 1), dep)
+		}
+		return first, next, nil
+	}
+	for next.Before(now) {
+		next = next.Add(time.Minute * time.Duration(schedule.FrequencyMin))
+	}
+	// service ends at midnight (as in the GTFS export): after the last bus
+	// of the day comes tomorrow's first
+	if midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()); !next.Before(midnight) {
+		next = departureOn(now.AddDate(0, 0, 1), dep)
+	}
+	return first, next, nil
+}
+
+// departureOn is the departure clock time dep on day's date. A time skipped
+// by a DST change runs when the clocks have moved on (02:30 becomes 03:30).
+func departureOn(day, dep time.Time) time.Time {
+	t := time.Date(day.Year(), day.Month(), day.Day(), dep.Hour(), dep.Minute(), 0, 0, day.Location())
+	if t.Hour() != dep.Hour() || t.Minute() != dep.Minute() {
+		t = time.Date(day.Year(), day.Month(), day.Day(), dep.Hour()+1, dep.Minute(), 0, 0, day.Location())
+	}
+	return t
+}
+
+// StopArrivals estimates when a bus leaving at departure reaches each stop
+// (stops in order), travelling at speedKmH
+func StopArrivals(stops []models.Stop, departure time.Time, speedKmH float64) []time.Time {
+	arrivals := make([]time.Time, len(stops))
+	arrival := departure
+	for j := range stops {
+		if j > 0 {
+			prev, curr := stops[j-1], stops[j]
+			distKm := utils.Haversine(prev.Latitude, prev.Longitude, curr.Latitude, curr.Longitude)
+			travelMinutes := (distKm / speedKmH) * 60
+			arrival = arrival.Add(time.Duration(travelMinutes) * time.Minute)
+		}
+		arrivals[j] = arrival
+	}
+	return arrivals
+}
+
+// AgencyLocation is the timezone of an agency, or the configured default
+func AgencyLocation(agency *models.Agency) *time.Location {
+	if agency != nil && agency.Timezone != "" {
+		if loc, err := time.LoadLocation(agency.Timezone); err == nil {
+			return loc
+		}
+	}
+	return config.Get().Location()
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"busapp/models"
+	"busapp/repository"
+)
+
+// two stops 0.1° of longitude apart on the equator (11.1 km, 11 minutes at 60 km/h)
+var etaStops = []models.Stop{
+	{Name: "West", Latitude: 0, Longitude: 1.0, OrderIndex: 1},
+	{Name: "East", Latitude: 0, Longitude: 1.1, OrderIndex: 2},
+}
+
+func at(hhmm string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", "2026-03-02 "+hhmm, time.UTC)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestPlanNextBuses(t *testing.T) {
+	route := models.Route{Name: "Line", Stops: etaStops, Schedules: []models.Schedule{{Departure: "06:00", FrequencyMin: 30}}}
+
+	plan, err := PlanNextBuses(route, at("07:10"), 60, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Next.Equal(at("07:30")) {
+		t.Errorf("next = %s, want 07:30", plan.Next.Format("15:04"))
+	}
+	if len(plan.Trips) != 3 {
+		t.Fatalf("%d trips, want 3", len(plan.Trips))
+	}
+	for i, want := range []string{"06:00", "06:30", "07:00"} {
+		trip := plan.Trips[i]
+		if got := trip.Departure.Format("15:04"); got != want {
+			t.Errorf("trip %d departs %s, want %s", i, got, want)
+		}
+		if len(trip.Arrivals) != 2 || !trip.Arrivals[0].Equal(trip.Departure) {
+			t.Fatalf("trip %d arrivals %v", i, trip.Arrivals)
+		}
+		if d := trip.Arrivals[1].Sub(trip.Arrivals[0]); d != 11*time.Minute {
+			t.Errorf("trip %d takes %s between stops, want 11m", i, d)
+		}
+	}
+}
+
+func TestPlanNextBusesErrors(t *testing.T) {
+	now := at("07:00")
+	if _, err := PlanNextBuses(models.Route{Stops: etaStops}, now, 60, 4); !errors.Is(err, ErrNoSchedules) {
+		t.Errorf("no schedules: err = %v, want ErrNoSchedules", err)
+	}
+	route := models.Route{Stops: etaStops, Schedules: []models.Schedule{{Departure: "6h", FrequencyMin: 30}}}
+	if _, err := PlanNextBuses(route, now, 60, 4); !errors.Is(err, ErrInvalidSchedule) {
+		t.Errorf("bad departure: err = %v, want ErrInvalidSchedule", err)
+	}
+}
+
+func TestPlanNextBusesAcrossMidnight(t *testing.T) {
+	route := models.Route{Stops: etaStops, Schedules: []models.Schedule{{Departure: "23:55"}}}
+	plan, err := PlanNextBuses(route, at("23:00"), 60, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrival := plan.Trips[0].Arrivals[1]; !arrival.Equal(at("00:06").AddDate(0, 0, 1)) {
+		t.Errorf("arrival %s, want 00:06 the next day", arrival)
+	}
+}
+
+func TestDepartures(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in New York, 2026-03-08 02:00 EST skips to 03:00 EDT and 2026-11-01
+	// 02:00 EDT falls back to 01:00 EST
+	utc := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name      string
+		departure string
+		frequency int
+		now       time.Time
+		want      time.Time
+	}{
+		{"before the first bus", "06:00", 30, at("05:10"), at("06:00")},
+		{"between buses", "06:00", 30, at("07:10"), at("07:30")},
+		{"at a departure", "06:00", 30, at("07:30"), at("07:30")},
+		{"daily bus still to come", "06:00", 0, at("05:00"), at("06:00")},
+		{"daily bus gone", "06:00", 0, at("07:00"), at("06:00").AddDate(0, 0, 1)},
+		{"last bus before midnight", "23:00", 40, at("23:30"), at("23:40")},
+		{"after the last bus", "23:00", 40, at("23:50"), at("23:00").AddDate(0, 0, 1)},
+		{"after the last bus of a morning service", "06:30", 30, at("23:50"), at("06:30").AddDate(0, 0, 1)},
+		{"after midnight, before the first bus", "23:30", 60, at("00:10"), at("23:30")},
+		{"bus at midnight is tomorrow's", "00:00", 0, at("00:01"), at("00:00").AddDate(0, 0, 1)},
+		{"spring forward, after the gap", "01:30", 30, utc("2026-03-08 07:10").In(ny), utc("2026-03-08 07:30")},
+		{"spring forward, departure in the gap", "02:30", 0, utc("2026-03-08 05:00").In(ny), utc("2026-03-08 07:30")},
+		{"fall back, second 01:40", "00:30", 30, utc("2026-11-01 06:40").In(ny), utc("2026-11-01 07:00")},
+		{"fall back, first 01:40", "00:30", 30, utc("2026-11-01 05:40").In(ny), utc("2026-11-01 06:00")},
+		{"fall back, after the last bus", "21:00", 90, utc("2026-11-02 04:31").In(ny), utc("2026-11-03 02:00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, next, err := Departures(models.Schedule{Departure: tt.departure, FrequencyMin: tt.frequency}, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !next.Equal(tt.want) {
+				t.Errorf("next = %s, want %s", next, tt.want.In(tt.now.Location()))
+			}
+		})
+	}
+}
+
+func FuzzDepartures(f *testing.F) {
+	f.Add("06:00", 30, int64(1772432400), false)
+	f.Add("23:59", 1, int64(1772495940), true)
+	f.Add("02:30", 0, int64(1772953200), true)
+	f.Add("0:5", -5, int64(0), false)
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, departure string, frequency int, unix int64, inNY bool) {
+		now := time.Unix(unix%(1<<36), 0).UTC() // within ±2000 years
+		if inNY {
+			now = now.In(ny)
+		}
+		first, next, err := Departures(models.Schedule{Departure: departure, FrequencyMin: frequency}, now)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidSchedule) {
+				t.Fatalf("err = %v, want ErrInvalidSchedule", err)
+			}
+			return
+		}
+		if y, m, d := first.Date(); y != now.Year() || m != now.Month() || d != now.Day() {
+			t.Fatalf("first %s is not on %s's day", first, now)
+		}
+		if next.Before(now) || next.Sub(now) > 25*time.Hour {
+			t.Fatalf("next %s, now %s", next, now)
+		}
+	})
+}
+
+// routeStore serves one route; the other repositories are not used by ETAService
+type routeStore struct {
+	repository.Store
+	route models.Route
+}
+
+func (s routeStore) Routes() repository.Routes { return routeRepo{route: s.route} }
+
+type routeRepo struct {
+	repository.Routes
+	route models.Route
+}
+
+func (r routeRepo) Load(agencyID uint, ids ...uint) ([]models.Route, error) {
+	if len(ids) == 1 && ids[0] == r.route.ID {
+		return []models.Route{r.route}, nil
+	}
+	return nil, nil
+}
+
+func TestETAServiceUsesClockAndAgencyTimezone(t *testing.T) {
+	lagos := &models.Agency{Name: "Lagos", Timezone: "Africa/Lagos"} // UTC+1
+	route := models.Route{ID: 7, Agency: lagos, Stops: etaStops,
+		Schedules: []models.Schedule{{Departure: "06:00", FrequencyMin: 15}}}
+	clock := func() time.Time { return at("06:20") } // 07:20 in Lagos
+
+	svc := NewETAService(routeStore{route: route}, clock)
+	plan, err := svc.NextBuses(7, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plan.Now.Format("15:04"); got != "07:20" {
+		t.Errorf("now = %s, want 07:20 Lagos time", got)
+	}
+	if got := plan.Next.Format("15:04"); got != "07:30" {
+		t.Errorf("next = %s, want 07:30", got)
+	}
+
+	var se *Error
+	if _, err := svc.NextBuses(8, 1); !errors.As(err, &se) || se.Kind != KindNotFound {
+		t.Errorf("unknown route: err = %v, want NotFound", err)
+	}
+}
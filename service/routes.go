@@ -0,0 +1,313 @@
+package service
+
+import (
+	"errors"
+
+	"busapp/models"
+	"busapp/repository"
+	"busapp/validation"
+
+	"gorm.io/gorm"
+)
+
+// RouteService manages routes and their stops
+type RouteService interface {
+	// Get returns a live route with its agency, stops (in order) and schedules
+	Get(id uint) (models.Route, error)
+	// Create creates a route with its stops and schedules, in the actor's
+	// agency (or route.AgencyID for platform actors)
+	Create(ch Change, route models.Route) (models.Route, error)
+	// Update applies changes to a route
+	Update(ch Change, id uint, apply func(*models.Route)) (models.Route, error)
+	// Delete moves a route to the trash with its stops and schedules
+	Delete(ch Change, id uint) error
+	// Restore brings a route back from the trash with the stops and
+	// schedules trashed along with it
+	Restore(ch Change, id uint) (models.Route, error)
+	// ReplaceNetwork replaces every route of the actor's agency with routes,
+	// keeping their IDs; the current routes go to the trash
+	ReplaceNetwork(ch Change, routes []models.Route) error
+
+	// AddStop adds a stop to its route, right after afterStopID (0 = first)
+	// when set, shifting the later stops
+	AddStop(ch Change, stop models.Stop, afterStopID *uint) (models.Stop, error)
+	// UpdateStop applies changes to a stop
+	UpdateStop(ch Change, id uint, apply func(*models.Stop)) (models.Stop, error)
+	// DeleteStop moves a stop to the trash
+	DeleteStop(ch Change, id uint) error
+	// RestoreStop brings a stop back from the trash, while its route is live
+	RestoreStop(ch Change, id uint) (models.Stop, error)
+	// ReorderStops numbers the stops of a route 1..n in the order of
+	// stopIDs, which must list each of them once, and returns them in order
+	ReorderStops(ch Change, routeID uint, stopIDs []uint) ([]models.Stop, error)
+}
+
+// NewRouteService returns the RouteService working on store
+func NewRouteService(store repository.Store) RouteService {
+	return &routeService{store: store}
+}
+
+type routeService struct {
+	store repository.Store
+}
+
+func (s *routeService) Get(id uint) (models.Route, error) {
+	routes, err := s.store.Routes().Load(0, id)
+	if err != nil {
+		return models.Route{}, err
+	}
+	if len(routes) == 0 {
+		return models.Route{}, NotFound("route")
+	}
+	return routes[0], nil
+}
+
+func (s *routeService) Create(ch Change, route models.Route) (models.Route, error) {
+	if id := ch.Actor.AgencyID; id != 0 {
+		route.AgencyID = &id
+	}
+
+	err := checkedWrite(s.store, ch, IssuesOfRoute(&route.ID), func(tx repository.Store) (uint, error) {
+		if err := tx.Routes().Create(&route); err != nil {
+			return 0, err
+		}
+		return route.ID, RecordAudit(tx, ch.Actor, models.AuditCreate, validation.EntityRoute, route.ID, nil, route)
+	})
+	return route, err
+}
+
+func (s *routeService) Update(ch Change, id uint, apply func(*models.Route)) (models.Route, error) {
+	route, err := s.store.Routes().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return route, lookupError(err, "route")
+	}
+	before := route
+
+	apply(&route)
+
+	err = checkedWrite(s.store, ch, IssuesFor(validation.EntityRoute, &route.ID), func(tx repository.Store) (uint, error) {
+		if err := tx.Routes().Save(&route); err != nil {
+			return 0, err
+		}
+		return route.ID, RecordAudit(tx, ch.Actor, models.AuditUpdate, validation.EntityRoute, route.ID, before, route)
+	})
+	return route, err
+}
+
+func (s *routeService) Delete(ch Change, id uint) error {
+	routes, err := s.store.Routes().Load(ch.Actor.AgencyID, id)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return NotFound("route")
+	}
+	route := routes[0]
+	route.Agency = nil // not part of the audited state
+
+	return s.store.Transaction(func(tx repository.Store) error {
+		if err := tx.Routes().Trash(route.ID); err != nil {
+			return err
+		}
+		return RecordAudit(tx, ch.Actor, models.AuditDelete, validation.EntityRoute, route.ID, route, nil)
+	})
+}
+
+func (s *routeService) Restore(ch Change, id uint) (models.Route, error) {
+	var route models.Route
+	err := checkedWrite(s.store, ch, IssuesOfRoute(&id), func(tx repository.Store) (uint, error) {
+		var err error
+		if route, err = tx.Routes().Restore(ch.Actor.AgencyID, id); err != nil {
+			return 0, err
+		}
+		return route.ID, RecordAudit(tx, ch.Actor, models.AuditRestore, validation.EntityRoute, route.ID, nil, route)
+	})
+	return route, trashError(err, validation.EntityRoute)
+}
+
+// ReplaceNetwork validates each route it brings back, but does not report
+// the issues to ch.Validated. The routes brought back are audited as
+// reverts, the ones dropped as deletes.
+func (s *routeService) ReplaceNetwork(ch Change, routes []models.Route) error {
+	agencyID := ch.Actor.AgencyID
+	if agencyID == 0 {
+		return errors.New("replacing a network needs an agency")
+	}
+
+	return s.store.Transaction(func(tx repository.Store) error {
+		current, err := tx.Routes().Load(agencyID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Routes().Replace(agencyID, routes); err != nil {
+			return err
+		}
+
+		dropped := map[uint]models.Route{}
+		for _, r := range current {
+			r.Agency = nil // not part of the audited state
+			dropped[r.ID] = r
+		}
+		for _, r := range routes {
+			var before interface{}
+			if b, ok := dropped[r.ID]; ok {
+				before = b
+				delete(dropped, r.ID)
+			}
+			if err := RecordAudit(tx, ch.Actor, models.AuditRevert, validation.EntityRoute, r.ID, before, r); err != nil {
+				return err
+			}
+			if _, err := CheckRoute(tx, r.ID, ch.Strict, IssuesOfRoute(&r.ID)); err != nil {
+				return err
+			}
+		}
+		for _, r := range current {
+			if b, ok := dropped[r.ID]; ok {
+				if err := RecordAudit(tx, ch.Actor, models.AuditDelete, validation.EntityRoute, r.ID, b, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *routeService) AddStop(ch Change, stop models.Stop, afterStopID *uint) (models.Stop, error) {
+	if _, err := s.store.Routes().Get(ch.Actor.AgencyID, stop.RouteID); err != nil {
+		return stop, lookupError(err, "route")
+	}
+
+	err := checkedWrite(s.store, ch, IssuesFor(validation.EntityStop, &stop.ID), func(tx repository.Store) (uint, error) {
+		var shifted []models.Stop
+		var err error
+		if afterStopID != nil {
+			shifted, err = tx.Stops().InsertAfter(&stop, *afterStopID)
+		} else {
+			err = tx.Stops().Create(&stop)
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, before := range shifted {
+			after := before
+			after.OrderIndex++
+			if err := RecordAudit(tx, ch.Actor, models.AuditUpdate, validation.EntityStop, before.ID, before, after); err != nil {
+				return 0, err
+			}
+		}
+		return stop.RouteID, RecordAudit(tx, ch.Actor, models.AuditCreate, validation.EntityStop, stop.ID, nil, stop)
+	})
+	if errors.Is(err, repository.ErrStopNotOnRoute) {
+		return stop, Invalid("after_stop_id is not on this route")
+	}
+	return stop, err
+}
+
+func (s *routeService) UpdateStop(ch Change, id uint, apply func(*models.Stop)) (models.Stop, error) {
+	stop, err := s.store.Stops().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return stop, lookupError(err, "stop")
+	}
+	before := stop
+
+	apply(&stop)
+
+	err = checkedWrite(s.store, ch, IssuesFor(validation.EntityStop, &stop.ID), func(tx repository.Store) (uint, error) {
+		if err := tx.Stops().Save(&stop); err != nil {
+			return 0, err
+		}
+		return stop.RouteID, RecordAudit(tx, ch.Actor, models.AuditUpdate, validation.EntityStop, stop.ID, before, stop)
+	})
+	return stop, err
+}
+
+func (s *routeService) DeleteStop(ch Change, id uint) error {
+	stop, err := s.store.Stops().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return lookupError(err, "stop")
+	}
+
+	return checkedWrite(s.store, ch, IssuesFor(validation.EntityRoute, &stop.RouteID), func(tx repository.Store) (uint, error) {
+		if err := tx.Stops().Delete(id); err != nil {
+			return 0, err
+		}
+		return stop.RouteID, RecordAudit(tx, ch.Actor, models.AuditDelete, validation.EntityStop, stop.ID, stop, nil)
+	})
+}
+
+func (s *routeService) RestoreStop(ch Change, id uint) (models.Stop, error) {
+	var stop models.Stop
+	err := checkedWrite(s.store, ch, IssuesFor(validation.EntityStop, &id), func(tx repository.Store) (uint, error) {
+		var err error
+		if stop, err = tx.Stops().Restore(ch.Actor.AgencyID, id); err != nil {
+			return 0, err
+		}
+		return stop.RouteID, RecordAudit(tx, ch.Actor, models.AuditRestore, validation.EntityStop, stop.ID, nil, stop)
+	})
+	return stop, trashError(err, validation.EntityStop)
+}
+
+func (s *routeService) ReorderStops(ch Change, routeID uint, stopIDs []uint) ([]models.Stop, error) {
+	routes, err := s.store.Routes().Load(ch.Actor.AgencyID, routeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, NotFound("route")
+	}
+
+	current := map[uint]models.Stop{}
+	for _, stop := range routes[0].Stops {
+		current[stop.ID] = stop
+	}
+	stops := make([]models.Stop, 0, len(stopIDs))
+	for _, id := range stopIDs {
+		stop, ok := current[id]
+		if !ok {
+			return nil, Invalid("stop_ids must list each stop of the route exactly once")
+		}
+		delete(current, id)
+		stops = append(stops, stop)
+	}
+	if len(current) > 0 {
+		return nil, Invalid("stop_ids must list each stop of the route exactly once")
+	}
+
+	err = checkedWrite(s.store, ch, IssuesOfRoute(&routeID), func(tx repository.Store) (uint, error) {
+		for i := range stops {
+			before := stops[i]
+			if before.OrderIndex == i+1 {
+				continue
+			}
+			stops[i].OrderIndex = i + 1
+			if err := tx.Stops().Save(&stops[i]); err != nil {
+				return 0, err
+			}
+			if err := RecordAudit(tx, ch.Actor, models.AuditUpdate, validation.EntityStop, before.ID, before, stops[i]); err != nil {
+				return 0, err
+			}
+		}
+		return routeID, nil
+	})
+	return stops, err
+}
+
+// trashError turns the errors of a failed restore from the trash into
+// service errors
+func trashError(err error, entity string) error {
+	switch {
+	case errors.Is(err, repository.ErrNotInTrash):
+		return &Error{Kind: KindNotFound, Message: entity + " not found in trash"}
+	case errors.Is(err, repository.ErrRouteInTrash):
+		return Conflict("its route is in the trash, restore the route first")
+	}
+	return err
+}
+
+// lookupError turns a failed Get into NotFound(entity)
+func lookupError(err error, entity string) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return NotFound(entity)
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"busapp/models"
+	"busapp/repository"
+	"busapp/validation"
+)
+
+// ScheduleService manages the schedules of routes
+type ScheduleService interface {
+	// Add adds a schedule to its route
+	Add(ch Change, sch models.Schedule) (models.Schedule, error)
+	// Update applies changes to a schedule
+	Update(ch Change, id uint, apply func(*models.Schedule)) (models.Schedule, error)
+	// Delete moves a schedule to the trash
+	Delete(ch Change, id uint) error
+	// Restore brings a schedule back from the trash, while its route is live
+	Restore(ch Change, id uint) (models.Schedule, error)
+}
+
+// NewScheduleService returns the ScheduleService working on store
+func NewScheduleService(store repository.Store) ScheduleService {
+	return &scheduleService{store: store}
+}
+
+type scheduleService struct {
+	store repository.Store
+}
+
+func (s *scheduleService) Add(ch Change, sch models.Schedule) (models.Schedule, error) {
+	if _, err := s.store.Routes().Get(ch.Actor.AgencyID, sch.RouteID); err != nil {
+		return sch, lookupError(err, "route")
+	}
+
+	err := checkedWrite(s.store, ch, IssuesFor(validation.EntitySchedule, &sch.ID), func(tx repository.Store) (uint, error) {
+		if err := tx.Schedules().Create(&sch); err != nil {
+			return 0, err
+		}
+		return sch.RouteID, RecordAudit(tx, ch.Actor, models.AuditCreate, validation.EntitySchedule, sch.ID, nil, sch)
+	})
+	return sch, err
+}
+
+func (s *scheduleService) Update(ch Change, id uint, apply func(*models.Schedule)) (models.Schedule, error) {
+	sch, err := s.store.Schedules().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return sch, lookupError(err, "schedule")
+	}
+	before := sch
+
+	apply(&sch)
+
+	err = checkedWrite(s.store, ch, IssuesFor(validation.EntitySchedule, &sch.ID), func(tx repository.Store) (uint, error) {
+		if err := tx.Schedules().Save(&sch); err != nil {
+			return 0, err
+		}
+		return sch.RouteID, RecordAudit(tx, ch.Actor, models.AuditUpdate, validation.EntitySchedule, sch.ID, before, sch)
+	})
+	return sch, err
+}
+
+func (s *scheduleService) Delete(ch Change, id uint) error {
+	sch, err := s.store.Schedules().Get(ch.Actor.AgencyID, id)
+	if err != nil {
+		return lookupError(err, "schedule")
+	}
+
+	return checkedWrite(s.store, ch, IssuesFor(validation.EntityRoute, &sch.RouteID), func(tx repository.Store) (uint, error) {
+		if err := tx.Schedules().Delete(id); err != nil {
+			return 0, err
+		}
+		return sch.RouteID, RecordAudit(tx, ch.Actor, models.AuditDelete, validation.EntitySchedule, sch.ID, sch, nil)
+	})
+}
+
+func (s *scheduleService) Restore(ch Change, id uint) (models.Schedule, error) {
+	var sch models.Schedule
+	err := checkedWrite(s.store, ch, IssuesFor(validation.EntitySchedule, &id), func(tx repository.Store) (uint, error) {
+		var err error
+		if sch, err = tx.Schedules().Restore(ch.Actor.AgencyID, id); err != nil {
+			return 0, err
+		}
+		return sch.RouteID, RecordAudit(tx, ch.Actor, models.AuditRestore, validation.EntitySchedule, sch.ID, nil, sch)
+	})
+	return sch, trashError(err, validation.EntitySchedule)
+}
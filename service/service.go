@@ -0,0 +1,87 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"busapp/validation"
+)
+
+// Domain services of the network: routes and their stops, schedules, alerts,
+// and arrival estimates; agencies and API keys; reverts of audited changes.
+// They work on the repository interfaces and know nothing about HTTP, so the
+// REST handlers, the GraphQL resolvers, the busapp command and tests all
+// share them.
+//
+// Every write is limited to the agency of its Actor and recorded in the
+// audit log; writes to routes, stops and schedules are also checked by the
+// validation rules.
+
+// Actor is who makes a change: an admin over HTTP, or a command-line job
+type Actor struct {
+	AgencyID uint // 0 = platform-wide
+	ID       uint // admin ID, 0 for the CLI
+	Name     string
+	IP       string
+}
+
+// Change describes a write: who makes it and how it is validated
+type Change struct {
+	Actor Actor
+	// Strict rolls back writes leaving validation errors on the written
+	// entity, with a *ValidationError
+	Strict bool
+	// Validated, when set, receives the issues of the written entity after
+	// a successful write
+	Validated func(issues []validation.Issue)
+}
+
+// Kind classifies the errors a caller can fix
+type Kind int
+
+const (
+	KindInvalid  Kind = iota + 1 // bad input
+	KindNotFound                 // missing or outside the actor's agency
+	KindConflict                 // clashes with existing data
+)
+
+// Error is a write refused because of its input; other errors are failures
+type Error struct {
+	Kind    Kind
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Invalid refuses bad input
+func Invalid(message string) error {
+	return &Error{Kind: KindInvalid, Message: message}
+}
+
+// NotFound refuses a missing entity ("route", "stop", ...)
+func NotFound(entity string) error {
+	return &Error{Kind: KindNotFound, Message: entity + " not found"}
+}
+
+// Conflict refuses input clashing with existing data
+func Conflict(message string) error {
+	return &Error{Kind: KindConflict, Message: message}
+}
+
+// ValidationError aborts a write that left validation errors in strict mode
+type ValidationError struct {
+	Issues []validation.Issue
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("validation failed with %d error(s)", len(e.Issues))
+}
+
+// FailedIssues returns the errors behind a strict-mode rejection
+func FailedIssues(err error) ([]validation.Issue, bool) {
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		return nil, false
+	}
+	return ve.Issues, true
+}
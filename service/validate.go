@@ -0,0 +1,63 @@
+package service
+
+import (
+	"busapp/repository"
+	"busapp/validation"
+)
+
+// ValidateRoutes runs the rules on routes (all of the agency when no ids are given)
+func ValidateRoutes(store repository.Store, agencyID uint, routeIDs ...uint) ([]validation.Issue, error) {
+	routes, err := store.Routes().Load(agencyID, routeIDs...)
+	if err != nil {
+		return nil, err
+	}
+	return validation.Validate(routes), nil
+}
+
+// IssuesFor matches issues about one entity
+func IssuesFor(entity string, id *uint) func(validation.Issue) bool {
+	return func(i validation.Issue) bool { return i.Entity == entity && i.EntityID == *id }
+}
+
+// IssuesOfRoute matches every issue on a route (the route and its stops and schedules)
+func IssuesOfRoute(id *uint) func(validation.Issue) bool {
+	return func(i validation.Issue) bool { return i.RouteID == *id }
+}
+
+// CheckRoute validates a route just written in tx and keeps the issues
+// accepted by match. In strict mode matching errors fail with a
+// *ValidationError, which rolls the transaction back.
+func CheckRoute(tx repository.Store, routeID uint, strict bool, match func(validation.Issue) bool) ([]validation.Issue, error) {
+	all, err := ValidateRoutes(tx, 0, routeID)
+	if err != nil {
+		return nil, err
+	}
+	var issues []validation.Issue
+	for _, i := range all {
+		if match(i) {
+			issues = append(issues, i)
+		}
+	}
+	if errs := validation.Errors(issues); len(errs) > 0 && strict {
+		return issues, &ValidationError{Issues: errs}
+	}
+	return issues, nil
+}
+
+// checkedWrite runs write in a transaction, then checks the route it touched
+// (see CheckRoute) and reports the issues to ch.Validated
+func checkedWrite(store repository.Store, ch Change, match func(validation.Issue) bool, write func(tx repository.Store) (routeID uint, err error)) error {
+	var issues []validation.Issue
+	err := store.Transaction(func(tx repository.Store) error {
+		routeID, err := write(tx)
+		if err != nil {
+			return err
+		}
+		issues, err = CheckRoute(tx, routeID, ch.Strict, match)
+		return err
+	})
+	if err == nil && ch.Validated != nil {
+		ch.Validated(issues)
+	}
+	return err
+}
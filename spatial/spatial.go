@@ -0,0 +1,212 @@
+package spatial
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"busapp/utils"
+
+	"gorm.io/gorm"
+)
+
+// Location queries over stops (nearby stops, stops in a bounding box).
+//
+// On PostgreSQL with PostGIS, a schema migration adds a geometry column to
+// stops, generated from latitude and longitude so writes need no changes,
+// with GiST indexes; both queries then run entirely in the database
+// (ST_DWithin and &&). On
+// SQLite, or PostgreSQL without PostGIS, the database filters on the indexed
+// latitude/longitude columns and nearby distances are refined in Go with the
+// haversine formula. Distances are on a sphere either way, so both paths
+// return the same stops.
+//
+// Only live stops of live routes are returned.
+
+// Point is a WGS84 coordinate
+type Point struct {
+	Lat, Lon float64
+}
+
+// BBox is a latitude/longitude box; MinLon > MaxLon crosses the antimeridian
+type BBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// Options narrow a query
+type Options struct {
+	Limit    int  // default 50
+	AgencyID uint // 0 = all agencies
+}
+
+// Stop is a stop returned by a query, with its route
+type Stop struct {
+	ID         uint     `json:"id"`
+	RouteID    uint     `json:"route_id"`
+	RouteName  string   `json:"route_name"`
+	AgencyID   *uint    `json:"agency_id,omitempty"`
+	Name       string   `json:"name"`
+	Latitude   float64  `json:"latitude"`
+	Longitude  float64  `json:"longitude"`
+	DistanceKm *float64 `json:"distance_km,omitempty"` // nearby queries only
+}
+
+// postgisEnabled is set by Setup when stops have the geom column
+var postgisEnabled bool
+
+// PostGISEnabled reports whether queries run on PostGIS
+func PostGISEnabled() bool { return postgisEnabled }
+
+var postgisSchema = []string{
+	`ALTER TABLE stops ADD COLUMN IF NOT EXISTS geom geometry(Point, 4326)
+		GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_stops_geom ON stops USING GIST (geom)`,
+	// distances in metres go through geography
+	`CREATE INDEX IF NOT EXISTS idx_stops_geog ON stops USING GIST ((geom::geography))`,
+}
+
+// CreateColumn adds the PostGIS column and indexes when the database has
+// PostGIS (a schema migration). Without it queries fall back to plain
+// columns, so a missing extension is not an error.
+func CreateColumn(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	var n int
+	if err := db.Raw("SELECT COUNT(*) FROM pg_available_extensions WHERE name = 'postgis'").Scan(&n).Error; err != nil || n == 0 {
+		return nil
+	}
+	// inside the migration transaction, so probe with a savepoint
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Exec("CREATE EXTENSION IF NOT EXISTS postgis").Error
+	}); err != nil {
+		return nil // available but not installed, and we may not install it
+	}
+
+	for _, stmt := range postgisSchema {
+		if err := db.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("postgis: %w", err)
+		}
+	}
+	return nil
+}
+
+// DropColumn removes what CreateColumn created (the extension stays)
+func DropColumn(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return db.Exec("ALTER TABLE stops DROP COLUMN IF EXISTS geom").Error
+}
+
+// Setup turns PostGIS queries on when stops have the geom column
+func Setup(db *gorm.DB) error {
+	postgisEnabled = db.Dialector.Name() == "postgres" && db.Migrator().HasColumn("stops", "geom")
+	return nil
+}
+
+// stopColumns are the columns of Stop
+const stopColumns = "stops.id, stops.route_id, routes.name AS route_name, routes.agency_id, stops.name, stops.latitude, stops.longitude"
+
+// liveStops limits a stops query to live stops of live routes
+func liveStops(db *gorm.DB, opts Options) *gorm.DB {
+	q := db.Table("stops").
+		Joins("JOIN routes ON routes.id = stops.route_id AND routes.deleted_at IS NULL").
+		Where("stops.deleted_at IS NULL")
+	if opts.AgencyID != 0 {
+		q = q.Where("routes.agency_id = ?", opts.AgencyID)
+	}
+	return q
+}
+
+// inBox limits q to stops within b using the latitude/longitude columns
+func inBox(q *gorm.DB, b BBox) *gorm.DB {
+	q = q.Where("stops.latitude BETWEEN ? AND ?", b.MinLat, b.MaxLat)
+	if b.MinLon <= b.MaxLon {
+		return q.Where("stops.longitude BETWEEN ? AND ?", b.MinLon, b.MaxLon)
+	}
+	return q.Where("(stops.longitude >= ? OR stops.longitude <= ?)", b.MinLon, b.MaxLon)
+}
+
+// Nearby returns the stops within radiusKm of p, closest first
+func Nearby(db *gorm.DB, p Point, radiusKm float64, opts Options) ([]Stop, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = 50
+	}
+
+	stops := []Stop{}
+	if postgisEnabled {
+		const point = "ST_SetSRID(ST_MakePoint(?, ?), 4326)::geography"
+		err := liveStops(db, opts).
+			Select(stopColumns+", ST_Distance(stops.geom::geography, "+point+", false) / 1000 AS distance_km", p.Lon, p.Lat).
+			Where("ST_DWithin(stops.geom::geography, "+point+", ?, false)", p.Lon, p.Lat, radiusKm*1000).
+			Order("distance_km asc, stops.id asc").Limit(opts.Limit).
+			Scan(&stops).Error
+		return stops, err
+	}
+
+	var candidates []Stop
+	if err := inBox(liveStops(db, opts), boxAround(p, radiusKm)).Select(stopColumns).Scan(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range candidates {
+		d := utils.Haversine(p.Lat, p.Lon, s.Latitude, s.Longitude)
+		if d <= radiusKm {
+			s.DistanceKm = &d
+			stops = append(stops, s)
+		}
+	}
+	sort.SliceStable(stops, func(i, j int) bool {
+		if *stops[i].DistanceKm != *stops[j].DistanceKm {
+			return *stops[i].DistanceKm < *stops[j].DistanceKm
+		}
+		return stops[i].ID < stops[j].ID
+	})
+	if len(stops) > opts.Limit {
+		stops = stops[:opts.Limit]
+	}
+	return stops, nil
+}
+
+// InBBox returns the stops inside b, by ID
+func InBBox(db *gorm.DB, b BBox, opts Options) ([]Stop, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = 50
+	}
+
+	q := liveStops(db, opts)
+	if postgisEnabled && b.MinLon <= b.MaxLon {
+		q = q.Where("stops.geom && ST_MakeEnvelope(?, ?, ?, ?, 4326)", b.MinLon, b.MinLat, b.MaxLon, b.MaxLat)
+	} else {
+		q = inBox(q, b)
+	}
+
+	stops := []Stop{}
+	err := q.Select(stopColumns).Order("stops.id asc").Limit(opts.Limit).Scan(&stops).Error
+	return stops, err
+}
+
+// boxAround is a bounding box containing every point within radiusKm of p
+func boxAround(p Point, radiusKm float64) BBox {
+	dLat := radiusKm / 111.32 // km per degree of latitude
+	b := BBox{MinLat: math.Max(p.Lat-dLat, -90), MaxLat: math.Min(p.Lat+dLat, 90), MinLon: -180, MaxLon: 180}
+
+	// longitude degrees shrink towards the poles; near them take every longitude
+	if cos := math.Cos((math.Abs(p.Lat) + dLat) * math.Pi / 180); cos > 0.01 && dLat/cos < 180 {
+		dLon := dLat / cos
+		b.MinLon, b.MaxLon = wrapLon(p.Lon-dLon), wrapLon(p.Lon+dLon)
+	}
+	return b
+}
+
+// wrapLon brings a longitude back into [-180, 180]
+func wrapLon(lon float64) float64 {
+	switch {
+	case lon < -180:
+		return lon + 360
+	case lon > 180:
+		return lon - 360
+	}
+	return lon
+}
@@ -0,0 +1,181 @@
+package spatial
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"busapp/db"
+	"busapp/models"
+
+	"gorm.io/gorm"
+)
+
+// forEachBackend runs fn against SQLite and, when TEST_POSTGRES_DSN points at
+// a scratch database (PostGIS optional), against PostgreSQL. Tables are
+// dropped and recreated first.
+func forEachBackend(t *testing.T, fn func(t *testing.T, gdb *gorm.DB)) {
+	backends := map[string]string{
+		db.DriverSQLite:   filepath.Join(t.TempDir(), "test.db"),
+		db.DriverPostgres: os.Getenv("TEST_POSTGRES_DSN"),
+	}
+	for _, name := range []string{db.DriverSQLite, db.DriverPostgres} {
+		t.Run(name, func(t *testing.T) {
+			dsn := backends[name]
+			if dsn == "" {
+				if os.Getenv("CI") != "" {
+					t.Fatal("TEST_POSTGRES_DSN not set on CI, see .github/workflows/test.yml")
+				}
+				t.Skip("TEST_POSTGRES_DSN not set")
+			}
+			if got := db.Driver(dsn); got != name {
+				t.Fatalf("DSN selects %s, want %s", got, name)
+			}
+			gdb, err := db.InitDB(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sqlDB, err := gdb.DB(); err == nil {
+				t.Cleanup(func() { sqlDB.Close() })
+			}
+			if err := gdb.Migrator().DropTable(&models.Stop{}, &models.Schedule{}, &models.Route{}, &models.Agency{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := gdb.AutoMigrate(&models.Agency{}, &models.Route{}, &models.Stop{}, &models.Schedule{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := CreateColumn(gdb); err != nil {
+				t.Fatal(err)
+			}
+			if err := Setup(gdb); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("postgis: %v", PostGISEnabled())
+			fn(t, gdb)
+		})
+	}
+}
+
+// seedStops creates two agencies' routes around Yaba (Lagos), a deleted
+// route, and a route across the antimeridian (Fiji)
+func seedStops(t *testing.T, gdb *gorm.DB) {
+	agencies := []models.Agency{{Name: "A"}, {Name: "B"}}
+	if err := gdb.Create(&agencies).Error; err != nil {
+		t.Fatal(err)
+	}
+	routes := []models.Route{
+		{Name: "Yaba–Ikeja", AgencyID: &agencies[0].ID, Stops: []models.Stop{
+			{Name: "Yaba", Latitude: 6.5086, Longitude: 3.3747, OrderIndex: 1},
+			{Name: "Ojuelegba", Latitude: 6.5095, Longitude: 3.3664, OrderIndex: 2},
+			{Name: "Maryland", Latitude: 6.5480, Longitude: 3.3632, OrderIndex: 3},
+			{Name: "Ikeja", Latitude: 6.6014, Longitude: 3.3515, OrderIndex: 4},
+		}},
+		{Name: "Yaba–Surulere", AgencyID: &agencies[1].ID, Stops: []models.Stop{
+			{Name: "Yaba B", Latitude: 6.5090, Longitude: 3.3750, OrderIndex: 1},
+		}},
+		{Name: "Deleted", Stops: []models.Stop{
+			{Name: "Ghost", Latitude: 6.5087, Longitude: 3.3748, OrderIndex: 1},
+		}},
+		{Name: "Taveuni", Stops: []models.Stop{
+			{Name: "East", Latitude: -16.8, Longitude: 179.99, OrderIndex: 1},
+			{Name: "West", Latitude: -16.8, Longitude: -179.99, OrderIndex: 2},
+		}},
+	}
+	if err := gdb.Create(&routes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Delete(&routes[2]).Error; err != nil {
+		t.Fatal(err)
+	}
+	// a deleted stop on a live route
+	dead := models.Stop{RouteID: routes[0].ID, Name: "Closed", Latitude: 6.5086, Longitude: 3.3747, OrderIndex: 5,
+		DeletedAt: gorm.DeletedAt{Time: time.Now(), Valid: true}}
+	if err := gdb.Create(&dead).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(stops []Stop) []string {
+	out := make([]string, len(stops))
+	for i, s := range stops {
+		out[i] = s.Name
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNearby(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, gdb *gorm.DB) {
+		seedStops(t, gdb)
+		yaba := Point{Lat: 6.5086, Lon: 3.3747}
+
+		tests := []struct {
+			name   string
+			p      Point
+			radius float64
+			opts   Options
+			want   []string
+		}{
+			{"closest first", yaba, 1, Options{}, []string{"Yaba", "Yaba B", "Ojuelegba"}},
+			{"wider radius", yaba, 5, Options{}, []string{"Yaba", "Yaba B", "Ojuelegba", "Maryland"}},
+			{"limit", yaba, 5, Options{Limit: 2}, []string{"Yaba", "Yaba B"}},
+			{"agency", yaba, 5, Options{AgencyID: 2}, []string{"Yaba B"}},
+			{"nothing around", Point{Lat: 0, Lon: 0}, 50, Options{}, []string{}},
+			{"across the antimeridian", Point{Lat: -16.8, Lon: -179.99}, 5, Options{}, []string{"West", "East"}},
+		}
+		for _, tt := range tests {
+			got, err := Nearby(gdb, tt.p, tt.radius, tt.opts)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if !equal(names(got), tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, names(got), tt.want)
+			}
+			for _, s := range got {
+				if s.DistanceKm == nil || *s.DistanceKm > tt.radius {
+					t.Errorf("%s: %s has distance %v", tt.name, s.Name, s.DistanceKm)
+				}
+			}
+		}
+	})
+}
+
+func TestInBBox(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, gdb *gorm.DB) {
+		seedStops(t, gdb)
+
+		tests := []struct {
+			name string
+			box  BBox
+			opts Options
+			want []string
+		}{
+			{"central Yaba", BBox{MinLat: 6.50, MinLon: 3.36, MaxLat: 6.51, MaxLon: 3.38}, Options{}, []string{"Yaba", "Ojuelegba", "Yaba B"}},
+			{"agency", BBox{MinLat: 6.50, MinLon: 3.36, MaxLat: 6.51, MaxLon: 3.38}, Options{AgencyID: 1}, []string{"Yaba", "Ojuelegba"}},
+			{"limit", BBox{MinLat: 6, MinLon: 3, MaxLat: 7, MaxLon: 4}, Options{Limit: 3}, []string{"Yaba", "Ojuelegba", "Maryland"}},
+			{"empty", BBox{MinLat: 10, MinLon: 10, MaxLat: 11, MaxLon: 11}, Options{}, []string{}},
+			{"across the antimeridian", BBox{MinLat: -17, MinLon: 179, MaxLat: -16, MaxLon: -179}, Options{}, []string{"East", "West"}},
+		}
+		for _, tt := range tests {
+			got, err := InBBox(gdb, tt.box, tt.opts)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if !equal(names(got), tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, names(got), tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package validation
+
+import (
+	"fmt"
+	"time"
+
+	"busapp/models"
+)
+
+// DepartureLayout is the format of Schedule.Departure
+const DepartureLayout = "15:04"
+
+func init() {
+	Register(RuleFunc{"stop-coordinates", checkStopCoordinates})
+	Register(RuleFunc{"stop-order-unique", checkStopOrder})
+	Register(RuleFunc{"stop-name-unique", checkStopNames})
+	Register(RuleFunc{"schedule-departure", checkDepartures})
+	Register(RuleFunc{"schedule-frequency", checkFrequencies})
+	Register(RuleFunc{"route-min-stops", checkRouteStops})
+	Register(RuleFunc{"route-has-schedule", checkRouteSchedules})
+}
+
+// checkStopCoordinates flags stops at 0,0 (unset) or outside valid ranges
+func checkStopCoordinates(route models.Route) []Issue {
+	var issues []Issue
+	for _, s := range route.Stops {
+		switch {
+		case s.Latitude == 0 && s.Longitude == 0:
+			issues = append(issues, Issue{Severity: SeverityError, Entity: EntityStop, EntityID: s.ID,
+				Message: fmt.Sprintf("stop %q has no coordinates (0,0)", s.Name)})
+		case s.Latitude < -90 || s.Latitude > 90 || s.Longitude < -180 || s.Longitude > 180:
+			issues = append(issues, Issue{Severity: SeverityError, Entity: EntityStop, EntityID: s.ID,
+				Message: fmt.Sprintf("stop %q has coordinates out of range", s.Name)})
+		}
+	}
+	return issues
+}
+
+// checkStopOrder flags stops sharing an order_index on the same route
+func checkStopOrder(route models.Route) []Issue {
+	var issues []Issue
+	seen := map[int]models.Stop{}
+	for _, s := range route.Stops {
+		if first, ok := seen[s.OrderIndex]; ok {
+			issues = append(issues, Issue{Severity: SeverityError, Entity: EntityStop, EntityID: s.ID,
+				Message: fmt.Sprintf("stop %q has the same order_index (%d) as %q", s.Name, s.OrderIndex, first.Name)})
+			continue
+		}
+		seen[s.OrderIndex] = s
+	}
+	return issues
+}
+
+// checkStopNames flags stops with the same name on a route (imports match stops by name)
+func checkStopNames(route models.Route) []Issue {
+	var issues []Issue
+	seen := map[string]bool{}
+	for _, s := range route.Stops {
+		if seen[s.Name] {
+			issues = append(issues, Issue{Severity: SeverityWarning, Entity: EntityStop, EntityID: s.ID,
+				Message: fmt.Sprintf("stop name %q is used more than once on the route", s.Name)})
+		}
+		seen[s.Name] = true
+	}
+	return issues
+}
+
+// checkDepartures flags departures that are not HH:MM
+func checkDepartures(route models.Route) []Issue {
+	var issues []Issue
+	for _, sch := range route.Schedules {
+		if _, err := time.Parse(DepartureLayout, sch.Departure); err != nil {
+			issues = append(issues, Issue{Severity: SeverityError, Entity: EntitySchedule, EntityID: sch.ID,
+				Message: fmt.Sprintf("departure %q is not HH:MM", sch.Departure)})
+		}
+	}
+	return issues
+}
+
+// checkFrequencies flags zero or negative frequencies
+func checkFrequencies(route models.Route) []Issue {
+	var issues []Issue
+	for _, sch := range route.Schedules {
+		if sch.FrequencyMin <= 0 {
+			issues = append(issues, Issue{Severity: SeverityError, Entity: EntitySchedule, EntityID: sch.ID,
+				Message: fmt.Sprintf("frequency_min must be positive, got %d", sch.FrequencyMin)})
+		}
+	}
+	return issues
+}
+
+// checkRouteStops warns about routes that cannot be travelled
+func checkRouteStops(route models.Route) []Issue {
+	if len(route.Stops) >= 2 {
+		return nil
+	}
+	return []Issue{{Severity: SeverityWarning, Entity: EntityRoute, EntityID: route.ID,
+		Message: fmt.Sprintf("route %q has %d stop(s), needs at least 2", route.Name, len(route.Stops))}}
+}
+
+// checkRouteSchedules warns about routes without any departures
+func checkRouteSchedules(route models.Route) []Issue {
+	if len(route.Schedules) > 0 {
+		return nil
+	}
+	return []Issue{{Severity: SeverityWarning, Entity: EntityRoute, EntityID: route.ID,
+		Message: fmt.Sprintf("route %q has no schedules", route.Name)}}
+}
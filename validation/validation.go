@@ -0,0 +1,116 @@
+package validation
+
+import (
+	"sort"
+	"sync"
+
+	"busapp/models"
+)
+
+// Severity of an issue: errors are bad data, warnings are suspicious data
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Entity names used in issues
+const (
+	EntityRoute    = "route"
+	EntityStop     = "stop"
+	EntitySchedule = "schedule"
+)
+
+// Issue is one problem found by a rule
+type Issue struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Entity   string   `json:"entity"`
+	EntityID uint     `json:"entity_id"`
+	RouteID  uint     `json:"route_id"`
+	Message  string   `json:"message"`
+}
+
+// Rule checks one route (with its stops and schedules loaded)
+type Rule interface {
+	Name() string
+	Check(route models.Route) []Issue
+}
+
+// RuleFunc adapts a function to the Rule interface
+type RuleFunc struct {
+	RuleName string
+	Fn       func(route models.Route) []Issue
+}
+
+func (r RuleFunc) Name() string                     { return r.RuleName }
+func (r RuleFunc) Check(route models.Route) []Issue { return r.Fn(route) }
+
+var (
+	mu    sync.RWMutex
+	rules []Rule
+)
+
+// Register adds a rule to the set used by Validate
+func Register(r Rule) {
+	mu.Lock()
+	defer mu.Unlock()
+	rules = append(rules, r)
+}
+
+// Rules returns the registered rules
+func Rules() []Rule {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]Rule(nil), rules...)
+}
+
+// Validate runs every registered rule on the routes. Issues are sorted by
+// route, entity and rule; the rule name is filled in when a rule left it empty.
+func Validate(routes []models.Route) []Issue {
+	return ValidateWith(Rules(), routes)
+}
+
+// ValidateWith runs the given rules on the routes
+func ValidateWith(ruleSet []Rule, routes []models.Route) []Issue {
+	issues := []Issue{}
+	for _, route := range routes {
+		for _, rule := range ruleSet {
+			for _, issue := range rule.Check(route) {
+				if issue.Rule == "" {
+					issue.Rule = rule.Name()
+				}
+				if issue.RouteID == 0 {
+					issue.RouteID = route.ID
+				}
+				issues = append(issues, issue)
+			}
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.RouteID != b.RouteID {
+			return a.RouteID < b.RouteID
+		}
+		if a.Entity != b.Entity {
+			return a.Entity < b.Entity
+		}
+		if a.EntityID != b.EntityID {
+			return a.EntityID < b.EntityID
+		}
+		return a.Rule < b.Rule
+	})
+	return issues
+}
+
+// Errors returns only the error-level issues
+func Errors(issues []Issue) []Issue {
+	var errs []Issue
+	for _, i := range issues {
+		if i.Severity == SeverityError {
+			errs = append(errs, i)
+		}
+	}
+	return errs
+}